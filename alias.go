@@ -0,0 +1,226 @@
+package scs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// errInvalidAlias is returned by openAlias when the alias target can't be
+// decrypted.
+var errInvalidAlias = errors.New("scs: invalid session token alias")
+
+// Alias kinds, which are sealed along with the new session token so that
+// aliases for tokens replaced by RenewToken can be told apart from aliases for
+// rotated tokens.
+const (
+	aliasRotation byte = 'o'
+	aliasRenewal  byte = 'n'
+)
+
+// aliasing reports whether replaced session tokens should be aliased to their
+// replacements, rather than deleted.
+func (s *SessionManager) aliasing() bool {
+	switch s.Store.(type) {
+	case AliasCtxStore, AliasStore:
+	default:
+		return false
+	}
+	return s.RenewGracePeriod > 0 || (s.RotationInterval > 0 && s.RotationGracePeriod > 0)
+}
+
+// deferRenewal records that the session token has been replaced, so that the
+// old token is aliased to the new one when the session data is next committed.
+// Until then, the old token remains in the session store and can still be used
+// by concurrent requests. If the token has already been replaced in the
+// current request, the old token from the first replacement is kept, and the
+// alias is treated as a renewal if either replacement was. It must be called
+// with sd.mu held.
+func (sd *sessionData) deferRenewal(oldToken string, grace time.Duration, renewal bool) {
+	sd.renewal = sd.renewal || renewal
+	if sd.renewedFrom != "" {
+		return
+	}
+	sd.renewedFrom = oldToken
+	sd.renewGrace = grace
+}
+
+// finishRenewal deletes the session token which was replaced by RenewToken or
+// rotation from the store, and replaces it with an alias to the current
+// session token which expires at the end of the grace period. It must be
+// called with sd.mu held, after the session data has been committed under the
+// new token.
+func (s *SessionManager) finishRenewal(ctx context.Context, sd *sessionData, expiry time.Time) error {
+	if sd.renewedFrom == "" {
+		return nil
+	}
+
+	err := s.doStoreDelete(ctx, sd.renewedFrom)
+	if err != nil {
+		return err
+	}
+
+	target, err := sealAlias(sd.renewedFrom, sd.token, sd.renewal)
+	if err != nil {
+		return err
+	}
+
+	aliasExpiry := time.Now().Add(sd.renewGrace)
+	if expiry.Before(aliasExpiry) {
+		aliasExpiry = expiry
+	}
+
+	err = s.doStoreAlias(ctx, sd.renewedFrom, target, aliasExpiry)
+	if err != nil {
+		return err
+	}
+
+	sd.renewedFrom = ""
+	sd.renewal = false
+	return nil
+}
+
+// resolveAlias returns the session token which the given session token has
+// been replaced by, if there is an alias for it in the store. The renewal flag
+// reports whether the token was replaced by RenewToken, rather than rotation.
+func (s *SessionManager) resolveAlias(ctx context.Context, token string) (newToken string, renewal bool, found bool, err error) {
+	target, found, err := s.doStoreFindAlias(ctx, token)
+	if err != nil || !found {
+		return "", false, false, err
+	}
+
+	// An alias which can't be opened is treated like a tampered token.
+	newToken, renewal, err = openAlias(token, target)
+	if err != nil {
+		return "", false, false, nil
+	}
+	return newToken, renewal, true, nil
+}
+
+// followRenewal reports whether session data which was loaded using an alias
+// for a token replaced by RenewToken may be used for the current request.
+// Because RenewToken is called when privilege levels change, the old token may
+// have been planted by an attacker (session fixation), so the alias is only
+// followed by requests from the client that the session is bound to.
+func followRenewal(req *loadRequest, reserved map[string]interface{}) bool {
+	if req == nil || !req.bindFingerprint {
+		return false
+	}
+	stored, ok := reserved[fingerprintKey].(string)
+	return ok && stored == req.fingerprint
+}
+
+// reissueToken returns the session token and expiry time if the session data
+// was loaded using an alias for a replaced token, so that the LoadAndSave
+// middleware can send the current token to the client.
+func (s *SessionManager) reissueToken(ctx context.Context) (token string, expiry time.Time, reissue bool) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !sd.reissue || sd.token == "" {
+		return "", time.Time{}, false
+	}
+
+	sd.reissue = false
+	return sd.token, s.expiry(sd.deadline), true
+}
+
+// sealAlias encrypts the new session token using a key derived from the old
+// session token, so that the new token can only be recovered by a client that
+// presents the old one. This means that aliases don't expose session tokens if
+// HashTokenInStore is set. The alias kind is sealed along with the new token.
+func sealAlias(oldToken, newToken string, renewal bool) (string, error) {
+	gcm, err := aliasCipher(oldToken)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	kind := aliasRotation
+	if renewal {
+		kind = aliasRenewal
+	}
+
+	b := gcm.Seal(nonce, nonce, append([]byte{kind}, newToken...), nil)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openAlias decrypts a new session token which was encrypted by sealAlias, and
+// reports whether the alias is for a token replaced by RenewToken.
+func openAlias(oldToken, target string) (newToken string, renewal bool, err error) {
+	gcm, err := aliasCipher(oldToken)
+	if err != nil {
+		return "", false, err
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(target)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return "", false, errInvalidAlias
+	}
+
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil || len(plain) == 0 {
+		return "", false, errInvalidAlias
+	}
+
+	switch plain[0] {
+	case aliasRotation:
+		return string(plain[1:]), false, nil
+	case aliasRenewal:
+		return string(plain[1:]), true, nil
+	default:
+		return "", false, errInvalidAlias
+	}
+}
+
+// aliasCipher returns an AES-GCM cipher keyed by the old session token. The key
+// is domain separated from hashToken, so that it can't be derived from a hashed
+// token in the store.
+func aliasCipher(oldToken string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("scs alias key\x00" + oldToken))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *SessionManager) doStoreAlias(ctx context.Context, token string, target string, expiry time.Time) (err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "Alias", Store: true})
+	defer func() { finish(OperationResult{Err: err}) }()
+
+	if s.HashTokenInStore {
+		token = hashToken(token)
+	}
+	cs, ok := s.Store.(AliasCtxStore)
+	if ok {
+		return cs.AliasCtx(ctx, token, target, expiry)
+	}
+	return s.Store.(AliasStore).Alias(token, target, expiry)
+}
+
+func (s *SessionManager) doStoreFindAlias(ctx context.Context, token string) (target string, found bool, err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "FindAlias", Store: true, Reads: true})
+	defer func() { finish(OperationResult{Err: err, Found: found}) }()
+
+	if s.HashTokenInStore {
+		token = hashToken(token)
+	}
+	cs, ok := s.Store.(AliasCtxStore)
+	if ok {
+		return cs.FindAliasCtx(ctx, token)
+	}
+	return s.Store.(AliasStore).FindAlias(token)
+}
@@ -1,8 +1,10 @@
 package boltstore
 
 import (
+	"context"
 	"encoding/binary"
 	"log"
+	"sync"
 	"time"
 
 	"go.etcd.io/bbolt"
@@ -12,8 +14,37 @@ var bucketName = []byte("scs:session")
 
 // BoltStore represents the session store.
 type BoltStore struct {
-	db          *bbolt.DB
-	stopCleanup chan bool
+	db             *bbolt.DB
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
+}
+
+// Config contains the settings for a BoltStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by BoltStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
 }
 
 // New returns a new Boltstore instance, with a background cleanup goroutine
@@ -27,15 +58,22 @@ func New(db *bbolt.DB) *BoltStore {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *bbolt.DB, cleanupInterval time.Duration) *BoltStore {
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new BoltStore instance with the settings in cfg.
+func NewWithConfig(db *bbolt.DB, cfg Config) *BoltStore {
 	db.Update(func(tx *bbolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(bucketName)
 		return err
 	})
 	bs := &BoltStore{
-		db: db,
+		db:             db,
+		logger:         cfg.Logger,
+		onCleanupError: cfg.OnCleanupError,
 	}
-	if cleanupInterval > 0 {
-		go bs.startCleanup(cleanupInterval)
+	if cfg.CleanupInterval > 0 {
+		bs.startCleanup(cfg.CleanupInterval)
 	}
 	return bs
 }
@@ -115,54 +153,115 @@ func (bs *BoltStore) All() (map[string][]byte, error) {
 	return sessions, nil
 }
 
-func (bs *BoltStore) startCleanup(cleanupInterval time.Duration) {
-	bs.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(cleanupInterval)
-	for {
-		select {
-		case <-ticker.C:
-			err := bs.deleteExpired()
-			if err != nil {
-				log.Println(err)
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
+func (bs *BoltStore) startCleanup(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bs.stopCleanup = cancel
+	bs.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(bs.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := bs.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					bs.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-bs.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the BoltStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (bs *BoltStore) RunCleanup(ctx context.Context) error {
+	n, err := bs.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		bs.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the BoltStore
-// instance. It's rare to terminate this; generally BoltStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the BoltStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the BoltStore is transient.
-// An example is creating a new BoltStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// BoltStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally BoltStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the BoltStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the BoltStore object from
+// being garbage collected unless you call Close.
+func (bs *BoltStore) Close(ctx context.Context) error {
+	if bs.stopCleanup == nil {
+		return nil
+	}
+	bs.stopCleanup()
+
+	select {
+	case <-bs.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the BoltStore
+// instance. It is equivalent to calling Close with context.Background().
 func (bs *BoltStore) StopCleanup() {
-	if bs.stopCleanup != nil {
-		bs.stopCleanup <- true
+	bs.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (bs *BoltStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return bs.stats.get()
+}
+
+func (bs *BoltStore) reportCleanupError(err error) {
+	if bs.logger == nil {
+		log.Println(err)
+	} else {
+		bs.logger.Error("boltstore: cleanup failed", "store", "boltstore", "operation", "cleanup", "error", err)
+	}
+
+	if bs.onCleanupError != nil {
+		bs.onCleanupError(err)
 	}
 }
 
-func (bs *BoltStore) deleteExpired() error {
+func (bs *BoltStore) deleteExpired(ctx context.Context) (int64, error) {
 	var expiredTokens [][]byte
-	bs.db.View(func(tx *bbolt.Tx) error {
+	err := bs.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(bucketName)
-		bucket.ForEach(func(token, val []byte) error {
+		return bucket.ForEach(func(token, val []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			if uint64(time.Now().UnixNano()) > binary.BigEndian.Uint64(val[:8]) {
-				expiredTokens = append(expiredTokens, token)
+				expiredTokens = append(expiredTokens, append([]byte(nil), token...))
 			}
 			return nil
 		})
-		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
 
 	if len(expiredTokens) > 0 {
-		return bs.db.Update(func(tx *bbolt.Tx) error {
+		err = bs.db.Update(func(tx *bbolt.Tx) error {
 			for _, token := range expiredTokens {
 				bucket := tx.Bucket(bucketName)
 				err := bucket.Delete([]byte(token))
@@ -172,7 +271,36 @@ func (bs *BoltStore) deleteExpired() error {
 			}
 			return nil
 		})
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	return nil
+	return int64(len(expiredTokens)), nil
+}
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
 }
@@ -2,6 +2,7 @@ package boltstore
 
 import (
 	"bytes"
+	"context"
 	"testing"
 	"time"
 
@@ -184,9 +185,13 @@ func TestDeleteExpired(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 
-	if err := m.deleteExpired(); err != nil {
+	deleted, err := m.deleteExpired(context.Background())
+	if err != nil {
 		t.Fatalf("expected nil, got %v", err)
 	}
+	if deleted != 2 {
+		t.Fatalf("expected 2, got %v", deleted)
+	}
 
 	err = db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(bucketName)
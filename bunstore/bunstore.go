@@ -3,6 +3,7 @@ package bunstore
 import (
 	"context"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/uptrace/bun"
@@ -11,8 +12,13 @@ import (
 
 // BunStore represents the session store.
 type BunStore struct {
-	db          *bun.DB
-	stopCleanup chan bool
+	db             *bun.DB
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
 }
 
 type session struct {
@@ -23,6 +29,30 @@ type session struct {
 	Expiry time.Time `bun:"expiry"`
 }
 
+// Config contains the settings for a BunStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by BunStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
+}
+
 // New returns a new BunStore instance, with a background cleanup goroutine
 // that runs every 5 minutes to remove expired session data.
 func New(db *bun.DB) (*BunStore, error) {
@@ -34,10 +64,15 @@ func New(db *bun.DB) (*BunStore, error) {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *bun.DB, cleanupInterval time.Duration) (*BunStore, error) {
-	b := &BunStore{db: db}
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
 
-	if cleanupInterval > 0 {
-		go b.startCleanup(cleanupInterval)
+// NewWithConfig returns a new BunStore instance with the settings in cfg.
+func NewWithConfig(db *bun.DB, cfg Config) (*BunStore, error) {
+	b := &BunStore{db: db, logger: cfg.Logger, onCleanupError: cfg.OnCleanupError}
+
+	if cfg.CleanupInterval > 0 {
+		b.startCleanup(cfg.CleanupInterval)
 	}
 
 	return b, nil
@@ -122,47 +157,102 @@ func (b *BunStore) AllCtx(ctx context.Context) (map[string][]byte, error) {
 	return ss, nil
 }
 
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
 func (b *BunStore) startCleanup(interval time.Duration) {
-	b.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			err := b.deleteExpired()
-			if err != nil {
-				log.Println(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopCleanup = cancel
+	b.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(b.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := b.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					b.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-b.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the BunStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (b *BunStore) RunCleanup(ctx context.Context) error {
+	n, err := b.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		b.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the BunStore
-// instance. It's rare to terminate this; generally BunStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the BunStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the BunStore is transient.
-// An example is creating a new BunStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// BunStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally BunStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the BunStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the BunStore object from
+// being garbage collected unless you call Close.
+func (b *BunStore) Close(ctx context.Context) error {
+	if b.stopCleanup == nil {
+		return nil
+	}
+	b.stopCleanup()
+
+	select {
+	case <-b.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the BunStore
+// instance. It is equivalent to calling Close with context.Background().
 func (b *BunStore) StopCleanup() {
-	if b.stopCleanup != nil {
-		b.stopCleanup <- true
+	b.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (b *BunStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return b.stats.get()
+}
+
+func (b *BunStore) reportCleanupError(err error) {
+	if b.logger == nil {
+		log.Println(err)
+	} else {
+		b.logger.Error("bunstore: cleanup failed", "store", "bunstore", "operation", "cleanup", "error", err)
+	}
+
+	if b.onCleanupError != nil {
+		b.onCleanupError(err)
 	}
 }
 
-func (b *BunStore) deleteExpired() error {
-	ctx := context.Background()
-	_, err := b.db.NewDelete().Model(&session{}).Where("expiry < ?", time.Now()).Exec(ctx)
+func (b *BunStore) deleteExpired(ctx context.Context) (int64, error) {
+	res, err := b.db.NewDelete().Model(&session{}).Where("expiry < ?", time.Now()).Exec(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return res.RowsAffected()
 }
 
 // We have to add the plain Store methods here to be recognized a Store
@@ -178,3 +268,29 @@ func (b *BunStore) Commit(token string, bb []byte, expiry time.Time) error {
 func (b *BunStore) Delete(token string) error {
 	panic("missing context arg")
 }
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
+}
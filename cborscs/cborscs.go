@@ -0,0 +1,250 @@
+// Package cborscs provides a CBOR codec for SCS session data.
+package cborscs
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Type IDs for the types which CBORCodec can encode and decode without them
+// being registered. They are negative so that they don't collide with the IDs
+// of registered types.
+const (
+	nilID int8 = -(iota + 1)
+	stringID
+	boolID
+	intID
+	int8ID
+	int16ID
+	int32ID
+	int64ID
+	uintID
+	uint8ID
+	uint16ID
+	uint32ID
+	uint64ID
+	float32ID
+	float64ID
+	bytesID
+	timeID
+	durationID
+	stringsID
+)
+
+var builtinTypes = map[int8]reflect.Type{
+	stringID:   reflect.TypeOf(""),
+	boolID:     reflect.TypeOf(false),
+	intID:      reflect.TypeOf(int(0)),
+	int8ID:     reflect.TypeOf(int8(0)),
+	int16ID:    reflect.TypeOf(int16(0)),
+	int32ID:    reflect.TypeOf(int32(0)),
+	int64ID:    reflect.TypeOf(int64(0)),
+	uintID:     reflect.TypeOf(uint(0)),
+	uint8ID:    reflect.TypeOf(uint8(0)),
+	uint16ID:   reflect.TypeOf(uint16(0)),
+	uint32ID:   reflect.TypeOf(uint32(0)),
+	uint64ID:   reflect.TypeOf(uint64(0)),
+	float32ID:  reflect.TypeOf(float32(0)),
+	float64ID:  reflect.TypeOf(float64(0)),
+	bytesID:    reflect.TypeOf([]byte(nil)),
+	timeID:     reflect.TypeOf(time.Time{}),
+	durationID: reflect.TypeOf(time.Duration(0)),
+	stringsID:  reflect.TypeOf([]string(nil)),
+}
+
+var builtinIDs = func() map[reflect.Type]int8 {
+	ids := make(map[reflect.Type]int8, len(builtinTypes))
+	for id, typ := range builtinTypes {
+		ids[typ] = id
+	}
+	return ids
+}()
+
+var (
+	encMode cbor.EncMode
+	decMode cbor.DecMode
+)
+
+func init() {
+	encOpts := cbor.CoreDetEncOptions()
+	encOpts.Time = cbor.TimeRFC3339Nano
+	encOpts.TimeTag = cbor.EncTagRequired
+
+	decOpts := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}
+
+	var err error
+	if encMode, err = encOpts.EncMode(); err != nil {
+		panic(err)
+	}
+	if decMode, err = decOpts.DecMode(); err != nil {
+		panic(err)
+	}
+}
+
+type payload struct {
+	_        struct{} `cbor:",toarray"`
+	Deadline time.Time
+	Values   map[string]entry
+}
+
+type entry struct {
+	_     struct{} `cbor:",toarray"`
+	ID    int8
+	Value cbor.RawMessage
+}
+
+// CBORCodec implements scs.Codec using CBOR (RFC 8949). The session data is
+// encoded as a two-element array containing the deadline (as an RFC 3339
+// date/time string with tag 0) and a map of the values. Each value is encoded
+// as a two-element array containing a type ID and the value itself, so that it
+// is decoded to the same Go type that it was encoded from and the typed
+// getters such as GetInt, GetTime and GetBytes keep working.
+//
+// Strings, bools, integer and floating-point types, []byte, []string,
+// time.Time and time.Duration are supported without registration. Any other
+// type, such as your own structs, must be registered with a unique ID using
+// the RegisterExt method before it is encoded or decoded. This includes the
+// types that scs stores for flash messages and metadata ([]scs.Flash and
+// scs.Metadata), if you use those features. Structs are encoded as maps keyed by
+// field name, and the `cbor` struct tag can be used to customize them.
+//
+// The encoding follows the Core Deterministic Encoding Requirements of RFC
+// 8949, so encoding the same values twice produces the same bytes.
+//
+// The zero value for a CBORCodec is ready to use. A CBORCodec must not be
+// copied after first use.
+type CBORCodec struct {
+	mu    sync.RWMutex
+	types map[int8]reflect.Type
+	ids   map[reflect.Type]int8
+}
+
+// New returns a new CBORCodec, which should be assigned to the Codec field of
+// a scs.SessionManager.
+func New() *CBORCodec {
+	return &CBORCodec{}
+}
+
+// RegisterExt records the type of value under the given ID, which must be
+// between 0 and 127. Values of that type will be encoded with the ID, and
+// values with the ID will be decoded to that type. Because the ID is stored
+// instead of the Go type name, registered types can be renamed or moved
+// without invalidating existing sessions. RegisterExt panics if the ID or the
+// type has already been registered, or if the type is supported without
+// registration.
+func (c *CBORCodec) RegisterExt(id int8, value interface{}) {
+	if id < 0 {
+		panic(fmt.Sprintf("cborscs: ext ID %d is reserved", id))
+	}
+	typ := reflect.TypeOf(value)
+	if typ == nil {
+		panic("cborscs: attempt to register nil value")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.types == nil {
+		c.types = make(map[int8]reflect.Type)
+		c.ids = make(map[reflect.Type]int8)
+	}
+
+	if t, ok := c.types[id]; ok {
+		panic(fmt.Sprintf("cborscs: ext ID %d is already registered for type %s", id, t))
+	}
+	if _, ok := builtinIDs[typ]; ok {
+		panic(fmt.Sprintf("cborscs: type %s does not need to be registered", typ))
+	}
+	if i, ok := c.ids[typ]; ok {
+		panic(fmt.Sprintf("cborscs: type %s is already registered with ext ID %d", typ, i))
+	}
+
+	c.types[id] = typ
+	c.ids[typ] = id
+}
+
+func (c *CBORCodec) typeForID(id int8) (reflect.Type, bool) {
+	if typ, ok := builtinTypes[id]; ok {
+		return typ, true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	typ, ok := c.types[id]
+	return typ, ok
+}
+
+func (c *CBORCodec) idForType(typ reflect.Type) (int8, bool) {
+	if id, ok := builtinIDs[typ]; ok {
+		return id, true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.ids[typ]
+	return id, ok
+}
+
+// Encode converts a session deadline and values into a byte slice. It returns
+// an error if a value has a type which isn't supported or registered.
+func (c *CBORCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	p := payload{
+		Deadline: deadline,
+		Values:   make(map[string]entry, len(values)),
+	}
+
+	for key, value := range values {
+		id := nilID
+		if value != nil {
+			var ok bool
+			id, ok = c.idForType(reflect.TypeOf(value))
+			if !ok {
+				return nil, fmt.Errorf("cborscs: type %T for key %q is not registered", value, key)
+			}
+		}
+
+		b, err := encMode.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("cborscs: encoding key %q: %w", key, err)
+		}
+		p.Values[key] = entry{ID: id, Value: b}
+	}
+
+	return encMode.Marshal(p)
+}
+
+// Decode converts a byte slice into a session deadline and values. It returns
+// an error if a value has a type ID which isn't registered.
+func (c *CBORCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	var p payload
+	if err := decMode.Unmarshal(b, &p); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	values := make(map[string]interface{}, len(p.Values))
+	for key, e := range p.Values {
+		if e.ID == nilID {
+			values[key] = nil
+			continue
+		}
+
+		typ, ok := c.typeForID(e.ID)
+		if !ok {
+			return time.Time{}, nil, fmt.Errorf("cborscs: ext ID %d for key %q is not registered", e.ID, key)
+		}
+
+		ptr := reflect.New(typ)
+		if err := decMode.Unmarshal(e.Value, ptr.Interface()); err != nil {
+			return time.Time{}, nil, fmt.Errorf("cborscs: decoding key %q: %w", key, err)
+		}
+		values[key] = ptr.Elem().Interface()
+	}
+
+	return p.Deadline, values, nil
+}
@@ -0,0 +1,297 @@
+package cborscs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type cartItem struct {
+	SKU      string
+	Quantity int
+	Price    int64
+}
+
+type cart struct {
+	Items    []cartItem
+	Coupon   string
+	Modified time.Time
+}
+
+// flash and metadata have the same fields as scs.Flash and scs.Metadata, so
+// that the benchmarks can use session data typical of an application.
+type flash struct {
+	Level   string
+	Message string
+	Data    interface{}
+}
+
+type metadata struct {
+	CreatedAt time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+}
+
+func init() {
+	// The GobCodec benchmarks need these to be registered.
+	gob.Register(cart{})
+	gob.Register(time.Time{})
+	gob.Register([]flash{})
+	gob.Register(metadata{})
+}
+
+func TestRoundTrip(t *testing.T) {
+	codec := New()
+	codec.RegisterExt(1, cart{})
+	codec.RegisterExt(2, &cartItem{})
+
+	deadline := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	values := map[string]interface{}{
+		"int":      42,
+		"int8":     int8(-42),
+		"int32":    int32(-7),
+		"uint16":   uint16(7),
+		"uint64":   uint64(1<<64 - 1),
+		"float32":  float32(1.5),
+		"duration": 90 * time.Second,
+		"bytes":    []byte("bar"),
+		"strings":  []string{"a", "b"},
+		"nil":      nil,
+		"cart":     cart{Items: []cartItem{{SKU: "apple", Quantity: 2, Price: 150}}},
+		"item":     &cartItem{SKU: "pear", Quantity: 1, Price: 90},
+	}
+
+	b, err := codec.Encode(deadline, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b2, err := codec.Encode(deadline, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Errorf("encoding is not deterministic")
+	}
+
+	_, gotValues, err := codec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotValues, values) {
+		t.Errorf("got %#v: expected %#v", gotValues, values)
+	}
+}
+
+func TestIntegerTypes(t *testing.T) {
+	codec := New()
+
+	values := map[string]interface{}{"positive": 42, "negative": -42}
+	b, err := codec.Encode(time.Now(), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain CBOR decoder decodes integers as uint64 or int64, depending on
+	// their sign.
+	var raw []interface{}
+	if err := cbor.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	rawValues, ok := raw[1].(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("got %T: expected map", raw[1])
+	}
+	for key, want := range map[string]interface{}{"positive": uint64(42), "negative": int64(-42)} {
+		entry, ok := rawValues[key].([]interface{})
+		if !ok || len(entry) != 2 || entry[1] != want {
+			t.Errorf("%s: got %#v: expected value %T(%v)", key, rawValues[key], want, want)
+		}
+	}
+
+	// The codec restores the original int type from the type ID.
+	_, gotValues, err := codec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotValues, values) {
+		t.Errorf("got %#v: expected %#v", gotValues, values)
+	}
+}
+
+func TestTimeOffset(t *testing.T) {
+	codec := New()
+
+	// Times are encoded as RFC 3339 strings, so they keep their UTC offset
+	// (but not the name of their time zone).
+	zone := time.FixedZone("UTC+3", 3*60*60)
+	deadline := time.Date(2030, 1, 2, 3, 4, 5, 6, zone)
+	tm := time.Date(2020, 5, 6, 7, 8, 9, 10, zone)
+
+	b, err := codec.Encode(deadline, map[string]interface{}{"time": tm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotDeadline, gotValues, err := codec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotTime, ok := gotValues["time"].(time.Time)
+	if !ok {
+		t.Fatalf("got %T: expected time.Time", gotValues["time"])
+	}
+
+	for _, tc := range []struct {
+		got, want time.Time
+	}{
+		{gotDeadline, deadline},
+		{gotTime, tm},
+	} {
+		if !tc.got.Equal(tc.want) {
+			t.Errorf("got %v: expected %v", tc.got, tc.want)
+		}
+		if _, offset := tc.got.Zone(); offset != 3*60*60 {
+			t.Errorf("got offset %d: expected %d", offset, 3*60*60)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	codec := New()
+
+	_, err := codec.Encode(time.Now(), map[string]interface{}{"cart": cart{}})
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("got %v: expected unregistered type error", err)
+	}
+
+	other := New()
+	other.RegisterExt(1, cart{})
+	b, err := other.Encode(time.Now(), map[string]interface{}{"cart": cart{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = codec.Decode(b)
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("got %v: expected unregistered ID error", err)
+	}
+
+	_, _, err = codec.Decode([]byte("not cbor"))
+	if err == nil {
+		t.Error("expected error decoding invalid data")
+	}
+
+	for _, tc := range []struct {
+		id    int8
+		value interface{}
+	}{
+		{-1, cart{}},
+		{1, time.Time{}},
+		{1, nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterExt(%d, %T) did not panic", tc.id, tc.value)
+				}
+			}()
+			codec.RegisterExt(tc.id, tc.value)
+		}()
+	}
+}
+
+// benchmarkValues returns session data typical of a logged-in user with a
+// shopping cart.
+func benchmarkValues() map[string]interface{} {
+	now := time.Date(2024, 3, 4, 5, 6, 7, 8, time.UTC)
+	return map[string]interface{}{
+		"__userID":        "8d3f7b2e-5c1a-4e9b-a0f6-2d7c9e1b4a53",
+		"__tokenIssuedAt": now.UnixNano(),
+		"__csrfSecret":    "q3Jk8Zp0vW2xYt6LmN4bR9sD1fG7hC5a",
+		"__metadata": metadata{
+			CreatedAt: now,
+			LastSeen:  now,
+			IP:        "203.0.113.42",
+			UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:123.0) Gecko/20100101 Firefox/123.0",
+		},
+		"__flashes": []flash{{Level: "success", Message: "Item added to your cart."}},
+		"locale":    "en-GB",
+		"visits":    27,
+		"lastLogin": now,
+		"cart": cart{
+			Items: []cartItem{
+				{SKU: "SKU-1001", Quantity: 2, Price: 1999},
+				{SKU: "SKU-2042", Quantity: 1, Price: 4950},
+				{SKU: "SKU-3310", Quantity: 3, Price: 299},
+			},
+			Coupon:   "SPRING24",
+			Modified: now,
+		},
+	}
+}
+
+func benchmarkCodecs() []struct {
+	name  string
+	codec scs.Codec
+} {
+	codec := New()
+	codec.RegisterExt(1, cart{})
+	codec.RegisterExt(2, []flash(nil))
+	codec.RegisterExt(3, metadata{})
+
+	return []struct {
+		name  string
+		codec scs.Codec
+	}{
+		{"gob", scs.GobCodec{}},
+		{"cbor", codec},
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	values := benchmarkValues()
+	deadline := time.Now().Add(time.Hour)
+
+	for _, bc := range benchmarkCodecs() {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			var size int
+			for i := 0; i < b.N; i++ {
+				data, err := bc.codec.Encode(deadline, values)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "encoded-bytes")
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	values := benchmarkValues()
+	deadline := time.Now().Add(time.Hour)
+
+	for _, bc := range benchmarkCodecs() {
+		b.Run(bc.name, func(b *testing.B) {
+			data, err := bc.codec.Encode(deadline, values)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := bc.codec.Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/alexedwards/scs/cborscs
+
+go 1.20
+
+require (
+	github.com/alexedwards/scs/v2 v2.9.0
+	github.com/fxamacker/cbor/v2 v2.9.4
+)
+
+require github.com/x448/float16 v0.8.4 // indirect
@@ -2,7 +2,15 @@ package scs
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sync"
 	"time"
 )
 
@@ -13,6 +21,19 @@ type Codec interface {
 	Decode([]byte) (deadline time.Time, values map[string]interface{}, err error)
 }
 
+// TokenCodec is the interface for codecs which need to know which session the
+// data belongs to, for example to bind encrypted session data to it. If the
+// SessionManager.Codec implements TokenCodec, its methods are used instead of
+// Encode and Decode. The key is the key that the session data is stored under
+// in the session store: the session token, or a hash of it if
+// SessionManager.HashTokenInStore is set. It is empty if the session store is
+// a ClientStore.
+type TokenCodec interface {
+	Codec
+	EncodeToken(key string, deadline time.Time, values map[string]interface{}) ([]byte, error)
+	DecodeToken(key string, b []byte) (deadline time.Time, values map[string]interface{}, err error)
+}
+
 // GobCodec is used for encoding/decoding session data to and from a byte
 // slice using the encoding/gob package.
 type GobCodec struct{}
@@ -49,3 +70,423 @@ func (GobCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
 
 	return aux.Deadline, aux.Values, nil
 }
+
+// jsonBuiltinTypes are the types which JSONCodec can encode and decode without
+// them being registered, keyed by their type tag.
+var jsonBuiltinTypes = map[string]reflect.Type{
+	"string":   reflect.TypeOf(""),
+	"bool":     reflect.TypeOf(false),
+	"int":      reflect.TypeOf(int(0)),
+	"int8":     reflect.TypeOf(int8(0)),
+	"int16":    reflect.TypeOf(int16(0)),
+	"int32":    reflect.TypeOf(int32(0)),
+	"int64":    reflect.TypeOf(int64(0)),
+	"uint":     reflect.TypeOf(uint(0)),
+	"uint8":    reflect.TypeOf(uint8(0)),
+	"uint16":   reflect.TypeOf(uint16(0)),
+	"uint32":   reflect.TypeOf(uint32(0)),
+	"uint64":   reflect.TypeOf(uint64(0)),
+	"float32":  reflect.TypeOf(float32(0)),
+	"float64":  reflect.TypeOf(float64(0)),
+	"bytes":    reflect.TypeOf([]byte(nil)),
+	"time":     reflect.TypeOf(time.Time{}),
+	"duration": reflect.TypeOf(time.Duration(0)),
+	"strings":  reflect.TypeOf([]string(nil)),
+
+	// Types used by the SessionManager for reserved session data keys.
+	"scs.flashes":  reflect.TypeOf([]Flash(nil)),
+	"scs.metadata": reflect.TypeOf(Metadata{}),
+}
+
+var jsonBuiltinTags = func() map[reflect.Type]string {
+	tags := make(map[reflect.Type]string, len(jsonBuiltinTypes))
+	for tag, typ := range jsonBuiltinTypes {
+		tags[typ] = tag
+	}
+	return tags
+}()
+
+// JSONCodec is used for encoding/decoding session data to and from a byte
+// slice using the encoding/json package. Unlike GobCodec, the encoded data can
+// be read by programs which aren't written in Go.
+//
+// Each value is stored alongside a type tag, so that values are decoded to
+// the same type that they were encoded from, and the typed getters such as
+// GetInt, GetTime and GetBytes keep working. Strings, bools, integer and
+// floating-point types, []byte, []string, time.Time and time.Duration are
+// supported without registration. Any other type, such as your own structs,
+// must be registered with a unique tag using the Register method before it is
+// encoded or decoded. Because the tag is stored instead of the Go type name,
+// registered types can be renamed or moved without invalidating existing
+// sessions.
+//
+// The zero value for a JSONCodec is ready to use. A JSONCodec must not be
+// copied after first use, so set the SessionManager.Codec field to a pointer:
+//
+//	codec := &scs.JSONCodec{}
+//	codec.Register("user", User{})
+//	sessionManager.Codec = codec
+type JSONCodec struct {
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+	tags  map[reflect.Type]string
+}
+
+// Register records the type of value under the given tag. Values of that type
+// will be encoded with the tag, and values with the tag will be decoded to
+// that type using the encoding/json package. Register panics if the tag or
+// the type has already been registered, or if the tag is used by one of the
+// built-in types.
+func (c *JSONCodec) Register(tag string, value interface{}) {
+	if tag == "" {
+		panic("scs: attempt to register empty JSONCodec tag")
+	}
+	typ := reflect.TypeOf(value)
+	if typ == nil {
+		panic("scs: attempt to register nil value with JSONCodec")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.types == nil {
+		c.types = make(map[string]reflect.Type)
+		c.tags = make(map[reflect.Type]string)
+	}
+
+	if _, ok := jsonBuiltinTypes[tag]; ok {
+		panic(fmt.Sprintf("scs: JSONCodec tag %q is reserved", tag))
+	}
+	if t, ok := c.types[tag]; ok {
+		panic(fmt.Sprintf("scs: JSONCodec tag %q is already registered for type %s", tag, t))
+	}
+	if _, ok := jsonBuiltinTags[typ]; ok {
+		panic(fmt.Sprintf("scs: type %s does not need to be registered with JSONCodec", typ))
+	}
+	if t, ok := c.tags[typ]; ok {
+		panic(fmt.Sprintf("scs: type %s is already registered with JSONCodec tag %q", typ, t))
+	}
+
+	c.types[tag] = typ
+	c.tags[typ] = tag
+}
+
+func (c *JSONCodec) typeForTag(tag string) (reflect.Type, bool) {
+	if typ, ok := jsonBuiltinTypes[tag]; ok {
+		return typ, true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	typ, ok := c.types[tag]
+	return typ, ok
+}
+
+func (c *JSONCodec) tagForType(typ reflect.Type) (string, bool) {
+	if tag, ok := jsonBuiltinTags[typ]; ok {
+		return tag, true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tag, ok := c.tags[typ]
+	return tag, ok
+}
+
+// jsonValue is the encoded form of a single session data value. A nil value
+// is encoded with an empty type tag and no value.
+type jsonValue struct {
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type jsonSession struct {
+	Deadline time.Time            `json:"deadline"`
+	Values   map[string]jsonValue `json:"values"`
+}
+
+// Encode converts a session deadline and values into a byte slice. It returns
+// an error if a value has a type which isn't supported or registered. The
+// output is deterministic, with the values sorted by key.
+func (c *JSONCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	aux := jsonSession{
+		Deadline: deadline,
+		Values:   make(map[string]jsonValue, len(values)),
+	}
+
+	for key, value := range values {
+		if value == nil {
+			aux.Values[key] = jsonValue{}
+			continue
+		}
+
+		tag, ok := c.tagForType(reflect.TypeOf(value))
+		if !ok {
+			return nil, fmt.Errorf("scs: type %T for key %q is not registered with JSONCodec", value, key)
+		}
+
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		aux.Values[key] = jsonValue{Type: tag, Value: b}
+	}
+
+	return json.Marshal(aux)
+}
+
+// Decode converts a byte slice into a session deadline and values. It returns
+// an error if a value has a type tag which isn't registered.
+func (c *JSONCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	var aux jsonSession
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	values := make(map[string]interface{}, len(aux.Values))
+	for key, jv := range aux.Values {
+		if jv.Type == "" {
+			values[key] = nil
+			continue
+		}
+
+		typ, ok := c.typeForTag(jv.Type)
+		if !ok {
+			return time.Time{}, nil, fmt.Errorf("scs: JSONCodec tag %q for key %q is not registered", jv.Type, key)
+		}
+
+		ptr := reflect.New(typ)
+		if err := json.Unmarshal(jv.Value, ptr.Interface()); err != nil {
+			return time.Time{}, nil, fmt.Errorf("scs: decoding key %q: %v", key, err)
+		}
+		values[key] = ptr.Elem().Interface()
+	}
+
+	return aux.Deadline, values, nil
+}
+
+// Compressor is the interface for compression algorithms used by
+// CompressingCodec.
+type Compressor interface {
+	// ID returns a number between 1 and 15 which identifies the algorithm. It
+	// is recorded in the header of compressed session data so that the data
+	// can be decompressed with the same algorithm. ID 1 is used by
+	// GzipCompressor, and IDs 2 and 3 are used by the zstd and snappy
+	// compressors in the github.com/alexedwards/scs/compressscs package.
+	ID() uint8
+
+	// Compress returns the compressed form of b.
+	Compress(b []byte) ([]byte, error)
+
+	// Decompress returns the decompressed form of b. It should return an
+	// error rather than decompressing more than a reasonable maximum size
+	// (such as DefaultMaxDecompressedSize), so that a small amount of
+	// malicious session data can't exhaust the available memory.
+	Decompress(b []byte) ([]byte, error)
+}
+
+// DefaultMaxDecompressedSize is the maximum size in bytes of session data
+// which is decompressed by GzipCompressor, if its MaxSize field isn't set. The
+// compressors in the github.com/alexedwards/scs/compressscs package use the
+// same limit by default.
+const DefaultMaxDecompressedSize = 16 << 20
+
+// ErrDecompressedTooLarge is returned by Compressor implementations when the
+// decompressed session data would be larger than the maximum size.
+var ErrDecompressedTooLarge = errors.New("scs: decompressed session data is too large")
+
+// GzipCompressor is a Compressor which uses the compress/gzip package.
+type GzipCompressor struct {
+	// Level is the gzip compression level. If it is zero,
+	// gzip.DefaultCompression is used.
+	Level int
+
+	// MaxSize is the maximum size in bytes of decompressed session data.
+	// Decompress returns ErrDecompressedTooLarge for data which decompresses
+	// to more than this. If it is zero, DefaultMaxDecompressedSize is used.
+	MaxSize int
+}
+
+// ID returns 1.
+func (GzipCompressor) ID() uint8 {
+	return 1
+}
+
+// Compress returns the gzip-compressed form of b.
+func (g GzipCompressor) Compress(b []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress returns the decompressed form of the gzip-compressed b.
+func (g GzipCompressor) Decompress(b []byte) ([]byte, error) {
+	maxSize := g.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxDecompressedSize
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// Read one byte more than the maximum, to tell whether there is more.
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return out, nil
+}
+
+// DefaultCompressionThreshold is the size in bytes above which
+// CompressingCodec compresses session data, if its Threshold field isn't set.
+const DefaultCompressionThreshold = 1024
+
+// compressionHeader is the first byte of session data encoded by
+// CompressingCodec. The low four bits hold the ID of the Compressor, or zero
+// if the data isn't compressed. Bytes in this range are never the first byte
+// of data encoded by GobCodec, so data written before compression was enabled
+// can still be decoded.
+const (
+	compressionHeader     byte = 0xe0
+	compressionHeaderMask byte = 0xf0
+)
+
+// CompressingCodec is a Codec which wraps another Codec and compresses the
+// encoded session data when it is larger than a threshold. A header byte
+// identifying the compression algorithm is written before the data.
+//
+// Session data which doesn't start with a header byte is passed to the
+// wrapped Codec unchanged, so sessions encoded by GobCodec before the
+// CompressingCodec was enabled can still be decoded. Session data compressed
+// with gzip can always be decoded, so that you can switch from the default
+// Compressor to a different one without logging your users out. To switch
+// between other algorithms, add the old Compressor to Decompressors.
+type CompressingCodec struct {
+	// Codec is the wrapped Codec. If it is nil, GobCodec is used.
+	Codec Codec
+
+	// Compressor is the compression algorithm. If it is nil, GzipCompressor
+	// with the default compression level is used.
+	Compressor Compressor
+
+	// Decompressors are additional compression algorithms which are only
+	// used to decode session data which was compressed with them, for example
+	// by a Compressor which has since been replaced.
+	Decompressors []Compressor
+
+	// Threshold is the size in bytes of encoded session data above which it
+	// is compressed. If it is zero, DefaultCompressionThreshold is used.
+	Threshold int
+}
+
+func (c CompressingCodec) codec() Codec {
+	if c.Codec == nil {
+		return GobCodec{}
+	}
+	return c.Codec
+}
+
+func (c CompressingCodec) compressor() Compressor {
+	if c.Compressor == nil {
+		return GzipCompressor{}
+	}
+	return c.Compressor
+}
+
+// Encode converts a session deadline and values into a byte slice, using the
+// wrapped Codec, and compresses it if it is larger than the threshold.
+func (c CompressingCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	b, err := c.codec().Encode(deadline, values)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := c.Threshold
+	if threshold == 0 {
+		threshold = DefaultCompressionThreshold
+	}
+
+	if len(b) > threshold {
+		compressor := c.compressor()
+		id := compressor.ID()
+		if id == 0 || id > 15 {
+			return nil, fmt.Errorf("scs: invalid compressor ID %d", id)
+		}
+
+		compressed, err := compressor.Compress(b)
+		if err != nil {
+			return nil, err
+		}
+		// Only use the compressed data if it is actually smaller.
+		if len(compressed) < len(b) {
+			return append([]byte{compressionHeader | id}, compressed...), nil
+		}
+	}
+
+	return append([]byte{compressionHeader}, b...), nil
+}
+
+// Decode decompresses a byte slice, if necessary, and converts it into a
+// session deadline and values using the wrapped Codec. It returns an error if
+// the data was compressed with an algorithm other than gzip, the Compressor
+// or one of the Decompressors.
+func (c CompressingCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	if len(b) == 0 || b[0]&compressionHeaderMask != compressionHeader {
+		return c.codec().Decode(b)
+	}
+
+	id := b[0] &^ compressionHeaderMask
+	b = b[1:]
+	if id != 0 {
+		compressor, ok := c.decompressor(id)
+		if !ok {
+			return time.Time{}, nil, fmt.Errorf("scs: session data compressed with unknown compressor ID %d", id)
+		}
+
+		var err error
+		b, err = compressor.Decompress(b)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+	}
+
+	return c.codec().Decode(b)
+}
+
+// decompressor returns the Compressor to decompress session data with the
+// given compressor ID.
+func (c CompressingCodec) decompressor(id uint8) (Compressor, bool) {
+	if compressor := c.compressor(); compressor.ID() == id {
+		return compressor, true
+	}
+	for _, compressor := range c.Decompressors {
+		if compressor.ID() == id {
+			return compressor, true
+		}
+	}
+	if id == (GzipCompressor{}).ID() {
+		return GzipCompressor{}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,297 @@
+package scs
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCart struct {
+	Items []string
+	Total int64
+}
+
+func TestJSONCodec(t *testing.T) {
+	t.Parallel()
+
+	codec := &JSONCodec{}
+	codec.Register("cart", testCart{})
+	codec.Register("cart_ptr", &testCart{})
+
+	deadline := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	values := map[string]interface{}{
+		"string":   "foo",
+		"bool":     true,
+		"int":      42,
+		"int32":    int32(-7),
+		"int64":    int64(1<<62 + 1),
+		"uint64":   uint64(1<<64 - 1),
+		"float64":  1.5,
+		"bytes":    []byte("bar"),
+		"time":     time.Date(2020, 5, 6, 7, 8, 9, 10, time.UTC),
+		"duration": 90 * time.Second,
+		"strings":  []string{"a", "b"},
+		"nil":      nil,
+		"cart":     testCart{Items: []string{"apple"}, Total: 3},
+		"cart_ptr": &testCart{Items: []string{"pear"}, Total: 4},
+		"flashes":  []Flash{{Level: FlashInfo, Message: "hello"}},
+	}
+
+	b, err := codec.Encode(deadline, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b2, err := codec.Encode(deadline, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Errorf("encoding is not deterministic: %s != %s", b, b2)
+	}
+
+	gotDeadline, gotValues, err := codec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotDeadline.Equal(deadline) {
+		t.Errorf("got %v: expected %v", gotDeadline, deadline)
+	}
+	if !reflect.DeepEqual(gotValues, values) {
+		t.Errorf("got %#v: expected %#v", gotValues, values)
+	}
+}
+
+func TestJSONCodecErrors(t *testing.T) {
+	t.Parallel()
+
+	codec := &JSONCodec{}
+
+	_, err := codec.Encode(time.Now(), map[string]interface{}{"cart": testCart{}})
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("got %v: expected unregistered type error", err)
+	}
+
+	_, _, err = codec.Decode([]byte(`{"deadline":"2030-01-01T00:00:00Z","values":{"cart":{"type":"cart","value":{}}}}`))
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("got %v: expected unregistered tag error", err)
+	}
+
+	_, _, err = codec.Decode([]byte(`{"deadline":"2030-01-01T00:00:00Z","values":{"count":{"type":"int","value":"x"}}}`))
+	if err == nil || !strings.Contains(err.Error(), `"count"`) {
+		t.Errorf("got %v: expected decoding error", err)
+	}
+
+	for _, tc := range []struct {
+		tag   string
+		value interface{}
+	}{
+		{"", testCart{}},
+		{"time", testCart{}},
+		{"other", time.Time{}},
+		{"nil", nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q, %T) did not panic", tc.tag, tc.value)
+				}
+			}()
+			codec.Register(tc.tag, tc.value)
+		}()
+	}
+
+	codec.Register("cart", testCart{})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("duplicate Register did not panic")
+			}
+		}()
+		codec.Register("cart2", testCart{})
+	}()
+}
+
+func TestJSONCodecSessionManager(t *testing.T) {
+	t.Parallel()
+
+	codec := &JSONCodec{}
+	codec.Register("cart", testCart{})
+
+	s := New()
+	s.Codec = codec
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	s.Put(ctx, "int", 123)
+	s.Put(ctx, "int64", int64(456))
+	s.Put(ctx, "time", now)
+	s.Put(ctx, "bytes", []byte("data"))
+	s.Put(ctx, "cart", testCart{Items: []string{"apple"}, Total: 1})
+	s.AddFlash(ctx, FlashSuccess, "saved")
+
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.GetInt(ctx, "int"); got != 123 {
+		t.Errorf("got %v: expected %v", got, 123)
+	}
+	if got := s.GetInt64(ctx, "int64"); got != 456 {
+		t.Errorf("got %v: expected %v", got, 456)
+	}
+	if got := s.GetTime(ctx, "time"); !got.Equal(now) {
+		t.Errorf("got %v: expected %v", got, now)
+	}
+	if got := s.GetBytes(ctx, "bytes"); string(got) != "data" {
+		t.Errorf("got %q: expected %q", got, "data")
+	}
+	if got, ok := s.Get(ctx, "cart").(testCart); !ok || got.Total != 1 {
+		t.Errorf("got %#v: expected testCart", s.Get(ctx, "cart"))
+	}
+	if flashes := s.Flashes(ctx); len(flashes) != 1 || flashes[0].Message != "saved" {
+		t.Errorf("got %#v: expected one flash", flashes)
+	}
+}
+
+func TestCompressingCodec(t *testing.T) {
+	t.Parallel()
+
+	codec := CompressingCodec{Threshold: 100}
+	deadline := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	small := map[string]interface{}{"foo": "bar"}
+	large := map[string]interface{}{"foo": strings.Repeat("bar", 1000)}
+
+	for _, tc := range []struct {
+		name   string
+		values map[string]interface{}
+		header byte
+	}{
+		{"small", small, 0xe0},
+		{"large", large, 0xe1},
+	} {
+		b, err := codec.Encode(deadline, tc.values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != tc.header {
+			t.Errorf("%s: got header %#x: expected %#x", tc.name, b[0], tc.header)
+		}
+		if tc.name == "large" && len(b) >= 3000 {
+			t.Errorf("%s: got %d bytes: expected data to be compressed", tc.name, len(b))
+		}
+
+		gotDeadline, gotValues, err := codec.Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gotDeadline.Equal(deadline) {
+			t.Errorf("%s: got %v: expected %v", tc.name, gotDeadline, deadline)
+		}
+		if !reflect.DeepEqual(gotValues, tc.values) {
+			t.Errorf("%s: got %v: expected %v", tc.name, gotValues, tc.values)
+		}
+	}
+
+	// Data encoded by GobCodec before compression was enabled.
+	legacy, err := GobCodec{}.Encode(deadline, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, gotValues, err := codec.Decode(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotValues, large) {
+		t.Errorf("got %v: expected %v", gotValues, large)
+	}
+
+	// Data compressed with an algorithm which isn't configured.
+	_, _, err = codec.Decode([]byte{0xe2, 0x00})
+	if err == nil || !strings.Contains(err.Error(), "unknown compressor") {
+		t.Errorf("got %v: expected unknown compressor error", err)
+	}
+
+	// Data compressed with gzip can still be decoded after switching to a
+	// different Compressor, and data compressed with a replaced Compressor
+	// can be decoded if it is one of the Decompressors.
+	gzipped, err := codec.Encode(deadline, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := CompressingCodec{Threshold: 100, Compressor: testCompressor{id: 2}}
+	otherCompressed, err := other.Encode(deadline, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherCompressed[0] != 0xe2 {
+		t.Errorf("got header %#x: expected %#x", otherCompressed[0], 0xe2)
+	}
+
+	switched := CompressingCodec{Compressor: testCompressor{id: 3}, Decompressors: []Compressor{testCompressor{id: 2}}}
+	for _, b := range [][]byte{gzipped, otherCompressed} {
+		_, gotValues, err := switched.Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotValues, large) {
+			t.Errorf("got %v: expected %v", gotValues, large)
+		}
+	}
+}
+
+// testCompressor is a Compressor which uses gzip under a different ID, for
+// testing how compressor IDs are matched.
+type testCompressor struct {
+	id uint8
+}
+
+func (c testCompressor) ID() uint8 { return c.id }
+
+func (c testCompressor) Compress(b []byte) ([]byte, error) {
+	return GzipCompressor{}.Compress(b)
+}
+
+func (c testCompressor) Decompress(b []byte) ([]byte, error) {
+	return GzipCompressor{}.Decompress(b)
+}
+
+func TestGzipCompressorMaxSize(t *testing.T) {
+	t.Parallel()
+
+	b, err := GzipCompressor{}.Compress(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		maxSize int
+		err     error
+	}{
+		{0, nil},
+		{1000, nil},
+		{999, ErrDecompressedTooLarge},
+	} {
+		out, err := GzipCompressor{MaxSize: tc.maxSize}.Decompress(b)
+		if err != tc.err {
+			t.Errorf("MaxSize %d: got %v: expected %v", tc.maxSize, err, tc.err)
+		}
+		if err == nil && len(out) != 1000 {
+			t.Errorf("MaxSize %d: got %d bytes: expected %d", tc.maxSize, len(out), 1000)
+		}
+	}
+}
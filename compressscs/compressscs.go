@@ -0,0 +1,99 @@
+// Package compressscs provides zstd and snappy compressors for use with
+// scs.CompressingCodec.
+package compressscs
+
+import (
+	"errors"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultMaxDecompressedSize is the maximum size in bytes of session data
+// which is decompressed by ZstdCompressor, and by SnappyCompressor if its
+// MaxSize field isn't set. It is the same as the limit used by
+// scs.GzipCompressor.
+const DefaultMaxDecompressedSize = 16 << 20
+
+// ErrDecompressedTooLarge is returned by Decompress when the decompressed
+// session data would be larger than the maximum size.
+var ErrDecompressedTooLarge = errors.New("compressscs: decompressed session data is too large")
+
+// ZstdCompressor is a scs.Compressor which uses zstd. It is safe for
+// concurrent use.
+type ZstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewZstdCompressor returns a new ZstdCompressor. The opts are passed to
+// zstd.NewWriter, and can be used to set the compression level. Decompress
+// returns ErrDecompressedTooLarge for data which decompresses to more than
+// DefaultMaxDecompressedSize bytes.
+func NewZstdCompressor(opts ...zstd.EOption) (*ZstdCompressor, error) {
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(DefaultMaxDecompressedSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZstdCompressor{encoder: encoder, decoder: decoder}, nil
+}
+
+// ID returns 2.
+func (z *ZstdCompressor) ID() uint8 {
+	return 2
+}
+
+// Compress returns the zstd-compressed form of b.
+func (z *ZstdCompressor) Compress(b []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(b, nil), nil
+}
+
+// Decompress returns the decompressed form of the zstd-compressed b.
+func (z *ZstdCompressor) Decompress(b []byte) ([]byte, error) {
+	out, err := z.decoder.DecodeAll(b, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, ErrDecompressedTooLarge
+	}
+	return out, err
+}
+
+// SnappyCompressor is a scs.Compressor which uses snappy. Snappy compresses
+// less than gzip or zstd, but is faster.
+type SnappyCompressor struct {
+	// MaxSize is the maximum size in bytes of decompressed session data.
+	// Decompress returns ErrDecompressedTooLarge for data which decompresses
+	// to more than this. If it is zero, DefaultMaxDecompressedSize is used.
+	MaxSize int
+}
+
+// ID returns 3.
+func (c SnappyCompressor) ID() uint8 {
+	return 3
+}
+
+// Compress returns the snappy-compressed form of b.
+func (c SnappyCompressor) Compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+// Decompress returns the decompressed form of the snappy-compressed b.
+func (c SnappyCompressor) Decompress(b []byte) ([]byte, error) {
+	maxSize := c.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxDecompressedSize
+	}
+
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return snappy.Decode(nil, b)
+}
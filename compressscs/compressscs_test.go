@@ -0,0 +1,102 @@
+package compressscs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	zstdCompressor, err := NewZstdCompressor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(strings.Repeat("bar", 1000))
+
+	for _, tc := range []struct {
+		name       string
+		compressor interface {
+			ID() uint8
+			Compress([]byte) ([]byte, error)
+			Decompress([]byte) ([]byte, error)
+		}
+		id uint8
+	}{
+		{"zstd", zstdCompressor, 2},
+		{"snappy", SnappyCompressor{}, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.compressor.ID() != tc.id {
+				t.Errorf("got ID %d: expected %d", tc.compressor.ID(), tc.id)
+			}
+
+			b, err := tc.compressor.Compress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) >= len(data) {
+				t.Errorf("got %d bytes: expected fewer than %d", len(b), len(data))
+			}
+
+			out, err := tc.compressor.Decompress(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("got %q: expected %q", out, data)
+			}
+		})
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	zstdCompressor, err := NewZstdCompressor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]byte, DefaultMaxDecompressedSize+1)
+	for _, tc := range []struct {
+		name       string
+		compressor interface {
+			Compress([]byte) ([]byte, error)
+			Decompress([]byte) ([]byte, error)
+		}
+	}{
+		{"zstd", zstdCompressor},
+		{"snappy", SnappyCompressor{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.compressor.Compress(large)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = tc.compressor.Decompress(b)
+			if err != ErrDecompressedTooLarge {
+				t.Errorf("got %v: expected %v", err, ErrDecompressedTooLarge)
+			}
+
+			b, err = tc.compressor.Compress(large[:DefaultMaxDecompressedSize])
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := tc.compressor.Decompress(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != DefaultMaxDecompressedSize {
+				t.Errorf("got %d bytes: expected %d", len(out), DefaultMaxDecompressedSize)
+			}
+		})
+	}
+
+	b, err := SnappyCompressor{}.Compress(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SnappyCompressor{MaxSize: 999}.Decompress(b)
+	if err != ErrDecompressedTooLarge {
+		t.Errorf("got %v: expected %v", err, ErrDecompressedTooLarge)
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/alexedwards/scs/compressscs
+
+go 1.22
+
+require (
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.18.0
+)
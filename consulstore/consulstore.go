@@ -1,8 +1,10 @@
 package consulstore
 
 import (
+	"context"
 	"encoding/binary"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
@@ -10,10 +12,43 @@ import (
 
 // ConsulStore represents the session store.
 type ConsulStore struct {
-	client      *api.Client
-	kv          *api.KV
-	prefix      string
-	stopCleanup chan bool
+	client         *api.Client
+	kv             *api.KV
+	prefix         string
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
+}
+
+// Config contains the settings for a ConsulStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Prefix controls the Consul key prefix, which can be used to avoid
+	// naming clashes if necessary. The default is "scs:session:".
+	Prefix string
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by ConsulStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
 }
 
 // New returns a new ConsulStore instance.
@@ -29,14 +64,26 @@ func New(client *api.Client) *ConsulStore {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithOptions(client *api.Client, cleanupInterval time.Duration, prefix string) *ConsulStore {
+	return NewWithConfig(client, Config{CleanupInterval: cleanupInterval, Prefix: prefix})
+}
+
+// NewWithConfig returns a new ConsulStore instance with the settings in cfg.
+func NewWithConfig(client *api.Client, cfg Config) *ConsulStore {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "scs:session:"
+	}
+
 	c := &ConsulStore{
-		client: client,
-		kv:     client.KV(),
-		prefix: prefix,
+		client:         client,
+		kv:             client.KV(),
+		prefix:         prefix,
+		logger:         cfg.Logger,
+		onCleanupError: cfg.OnCleanupError,
 	}
 
-	if cleanupInterval > 0 {
-		go c.startCleanup(cleanupInterval)
+	if cfg.CleanupInterval > 0 {
+		c.startCleanup(cfg.CleanupInterval)
 	}
 
 	return c
@@ -101,50 +148,145 @@ func (c *ConsulStore) All() (map[string][]byte, error) {
 	return sessions, nil
 }
 
-func (c *ConsulStore) startCleanup(cleanupInterval time.Duration) {
-	c.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(cleanupInterval)
-	for {
-		select {
-		case <-ticker.C:
-			err := c.deleteExpired()
-			if err != nil {
-				log.Println(err)
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
+func (c *ConsulStore) startCleanup(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopCleanup = cancel
+	c.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(c.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := c.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					c.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-c.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the ConsulStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (c *ConsulStore) RunCleanup(ctx context.Context) error {
+	n, err := c.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		c.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the ConsulStore
-// instance. It's rare to terminate this; generally ConsulStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the ConsulStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the ConsulStore is transient.
-// An example is creating a new ConsulStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// ConsulStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally ConsulStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the ConsulStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the ConsulStore object from
+// being garbage collected unless you call Close.
+func (c *ConsulStore) Close(ctx context.Context) error {
+	if c.stopCleanup == nil {
+		return nil
+	}
+	c.stopCleanup()
+
+	select {
+	case <-c.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the ConsulStore
+// instance. It is equivalent to calling Close with context.Background().
 func (c *ConsulStore) StopCleanup() {
-	if c.stopCleanup != nil {
-		c.stopCleanup <- true
+	c.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (c *ConsulStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return c.stats.get()
+}
+
+func (c *ConsulStore) reportCleanupError(err error) {
+	if c.logger == nil {
+		log.Println(err)
+	} else {
+		c.logger.Error("consulstore: cleanup failed", "store", "consulstore", "operation", "cleanup", "error", err)
+	}
+
+	if c.onCleanupError != nil {
+		c.onCleanupError(err)
 	}
 }
 
-func (c *ConsulStore) deleteExpired() error {
-	pairs, _, err := c.kv.List(c.prefix, nil)
+func (c *ConsulStore) deleteExpired(ctx context.Context) (int64, error) {
+	pairs, _, err := c.kv.List(c.prefix, (&api.QueryOptions{}).WithContext(ctx))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	var (
+		deleted  int64
+		firstErr error
+	)
 	for _, pair := range pairs {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
 		if uint64(time.Now().UnixNano()) > binary.BigEndian.Uint64(pair.Value[:8]) {
-			c.kv.Delete(pair.Key, nil)
+			if _, err := c.kv.Delete(pair.Key, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			deleted++
 		}
 	}
 
-	return nil
+	return deleted, firstErr
+}
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
 }
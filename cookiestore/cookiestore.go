@@ -0,0 +1,137 @@
+package cookiestore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultMaxSize is the default maximum length of a sealed session token. It
+// leaves room within the 4096 byte limit that browsers place on cookies for
+// the cookie name and attributes.
+const DefaultMaxSize = 3800
+
+// ErrTooLarge is returned by Seal when the sealed session token would be longer
+// than the MaxSize of the CookieStore.
+var ErrTooLarge = errors.New("cookiestore: session data is too large to fit in a cookie")
+
+// CookieStore represents the session store. Rather than keeping the session
+// data on the server, it seals the session data using AES-GCM authenticated
+// encryption and uses the result as the session token, so that the data is
+// carried entirely by the client.
+type CookieStore struct {
+	aeads []cipher.AEAD
+
+	// MaxSize controls the maximum length of a sealed session token. If the
+	// sealed session data would exceed this, Seal returns ErrTooLarge. The
+	// default is DefaultMaxSize.
+	MaxSize int
+}
+
+// New returns a new CookieStore instance. Each key must be 16, 24 or 32 bytes
+// long, to select AES-128, AES-192 or AES-256 respectively. The first key is
+// used to seal session data, and all of the keys are tried in turn when opening
+// it. This allows you to rotate keys by adding a new key at the front of the
+// list, and removing the old key once all sessions sealed with it have expired.
+func New(keys ...[]byte) (*CookieStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("cookiestore: at least one key is required")
+	}
+
+	c := &CookieStore{MaxSize: DefaultMaxSize}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("cookiestore: key %d: %v", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("cookiestore: key %d: %v", i, err)
+		}
+		c.aeads = append(c.aeads, aead)
+	}
+
+	return c, nil
+}
+
+// Seal encrypts and authenticates the session data along with its expiry time,
+// and returns the result as a session token.
+func (c *CookieStore) Seal(b []byte, expiry time.Time) (string, error) {
+	aead := c.aeads[0]
+
+	plaintext := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint64(plaintext, uint64(expiry.UnixNano()))
+	copy(plaintext[8:], b)
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil))
+	if len(token) > c.maxSize() {
+		return "", ErrTooLarge
+	}
+
+	return token, nil
+}
+
+// Find opens a session token created by Seal and returns the session data. If
+// the token has been tampered with, was sealed with an unknown key, or has
+// expired, the returned exists flag will be set to false.
+func (c *CookieStore) Find(token string) ([]byte, bool, error) {
+	if len(token) > c.maxSize() {
+		return nil, false, nil
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	for _, aead := range c.aeads {
+		if len(sealed) < aead.NonceSize()+aead.Overhead()+8 {
+			continue
+		}
+
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			continue
+		}
+
+		expiry := int64(binary.BigEndian.Uint64(plaintext))
+		if time.Now().UnixNano() > expiry {
+			return nil, false, nil
+		}
+
+		return plaintext[8:], true, nil
+	}
+
+	return nil, false, nil
+}
+
+// Commit is not supported by CookieStore, because the session data is carried
+// in the session token itself. The session manager calls Seal instead.
+func (c *CookieStore) Commit(token string, b []byte, expiry time.Time) error {
+	return errors.New("cookiestore: Commit is not supported, use Seal instead")
+}
+
+// Delete is a no-op for CookieStore, because the session data is carried in the
+// session token itself. Please note that this means a destroyed session can
+// still be used until it expires by a client which kept a copy of the token.
+func (c *CookieStore) Delete(token string) error {
+	return nil
+}
+
+func (c *CookieStore) maxSize() int {
+	if c.MaxSize <= 0 {
+		return DefaultMaxSize
+	}
+	return c.MaxSize
+}
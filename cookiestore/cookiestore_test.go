@@ -0,0 +1,144 @@
+package cookiestore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	key1 = []byte("0123456789abcdef0123456789abcdef")
+	key2 = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func TestSealAndFind(t *testing.T) {
+	c, err := New(key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := c.Seal([]byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+
+	b, found, err := c.Find(token)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+}
+
+func TestFindTampered(t *testing.T) {
+	c, err := New(key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := c.Seal([]byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(token)
+	if tampered[len(tampered)/2] == 'A' {
+		tampered[len(tampered)/2] = 'B'
+	} else {
+		tampered[len(tampered)/2] = 'A'
+	}
+
+	for _, tok := range []string{string(tampered), "not-base64!", "", token[:10]} {
+		_, found, err := c.Find(tok)
+		if err != nil {
+			t.Fatalf("got %v: expected %v", err, nil)
+		}
+		if found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+	}
+}
+
+func TestFindExpired(t *testing.T) {
+	c, err := New(key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := c.Seal([]byte("encoded_data"), time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, err := c.Find(token)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, err := New(key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := old.Seal([]byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := New(key2, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, found, err := rotated.Find(token)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+
+	token, err = rotated.Seal([]byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, found, err = old.Find(token)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestSealTooLarge(t *testing.T) {
+	c, err := New(key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Seal([]byte(strings.Repeat("x", DefaultMaxSize)), time.Now().Add(time.Minute))
+	if err != ErrTooLarge {
+		t.Fatalf("got %v: expected %v", err, ErrTooLarge)
+	}
+}
+
+func TestNewInvalidKey(t *testing.T) {
+	_, err := New([]byte("too-short"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	_, err = New()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
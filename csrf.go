@@ -0,0 +1,202 @@
+package scs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// csrfKey is the reserved session data key that the CSRF secret is stored
+// under.
+const csrfKey = "__csrfSecret"
+
+// csrfSecretLength is the length in bytes of the CSRF secret.
+const csrfSecretLength = 32
+
+// The default names of the form field and request header that the CSRF token
+// is read from, which are used if the CSRF FieldName or HeaderName is empty.
+const (
+	defaultCSRFFieldName  = "csrf_token"
+	defaultCSRFHeaderName = "X-CSRF-Token"
+)
+
+var (
+	// ErrCSRFTokenMissing is passed to the CSRF ErrorFunc when a request with
+	// an unsafe method doesn't include a CSRF token.
+	ErrCSRFTokenMissing = errors.New("scs: CSRF token missing")
+
+	// ErrCSRFTokenInvalid is passed to the CSRF ErrorFunc when a request with
+	// an unsafe method includes a CSRF token which doesn't match the session.
+	ErrCSRFTokenInvalid = errors.New("scs: CSRF token invalid")
+)
+
+// CSRF contains the configuration settings for the CSRF protection provided by
+// the CSRFToken method and the CSRFProtect middleware.
+type CSRF struct {
+	// FieldName sets the name of the form field that the CSRF token is read
+	// from. The default is "csrf_token".
+	FieldName string
+
+	// HeaderName sets the name of the request header that the CSRF token is
+	// read from. The header is checked before the form field. The default is
+	// "X-CSRF-Token".
+	HeaderName string
+
+	// ErrorFunc allows you to control behavior when a request fails the CSRF
+	// check. It is passed either ErrCSRFTokenMissing or ErrCSRFTokenInvalid.
+	// The default behavior is for a HTTP 403 "Forbidden" message to be sent to
+	// the client.
+	ErrorFunc func(http.ResponseWriter, *http.Request, error)
+}
+
+// CSRFToken returns a CSRF token for the session, which should be included in
+// forms as a hidden field (named by CSRF.FieldName) or sent by JavaScript in a
+// request header (named by CSRF.HeaderName). If the session doesn't have a
+// CSRF secret yet, one is generated and the session data status will be set
+// to Modified. The secret is regenerated when RenewToken is called.
+//
+// The token is masked with a random value each time CSRFToken is called, so
+// that it is different in every response, which protects against BREACH
+// attacks. Any token returned for the current secret will pass the check made
+// by the CSRFProtect middleware.
+func (s *SessionManager) CSRFToken(ctx context.Context) (string, error) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	secret := sd.csrfSecret()
+	if secret == nil {
+		secret = make([]byte, csrfSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return "", err
+		}
+		sd.setReserved(csrfKey, base64.RawURLEncoding.EncodeToString(secret))
+		sd.status = Modified
+	}
+
+	pad := make([]byte, csrfSecretLength)
+	if _, err := rand.Read(pad); err != nil {
+		return "", err
+	}
+
+	masked := make([]byte, 2*csrfSecretLength)
+	copy(masked, pad)
+	xorBytes(masked[csrfSecretLength:], secret, pad)
+
+	return base64.RawURLEncoding.EncodeToString(masked), nil
+}
+
+// CSRFProtect provides middleware which checks that requests with an unsafe
+// method (i.e. anything other than GET, HEAD, OPTIONS or TRACE) include a
+// valid CSRF token for the session, as returned by CSRFToken. If the check
+// fails, the CSRF ErrorFunc is called and next is not. It must be used inside
+// the LoadAndSave middleware.
+func (s *SessionManager) CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := s.checkCSRFToken(r); err != nil {
+			errorFunc := s.CSRF.ErrorFunc
+			if errorFunc == nil {
+				errorFunc = defaultCSRFErrorFunc
+			}
+			errorFunc(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkCSRFToken checks the CSRF token in the request header or form field
+// against the CSRF secret in the session.
+func (s *SessionManager) checkCSRFToken(r *http.Request) error {
+	headerName := s.CSRF.HeaderName
+	if headerName == "" {
+		headerName = defaultCSRFHeaderName
+	}
+	fieldName := s.CSRF.FieldName
+	if fieldName == "" {
+		fieldName = defaultCSRFFieldName
+	}
+
+	token := r.Header.Get(headerName)
+	if token == "" {
+		token = r.PostFormValue(fieldName)
+	}
+	if token == "" {
+		return ErrCSRFTokenMissing
+	}
+
+	masked, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(masked) != 2*csrfSecretLength {
+		return ErrCSRFTokenInvalid
+	}
+
+	sd := s.getSessionDataFromContext(r.Context())
+
+	sd.mu.Lock()
+	secret := sd.csrfSecret()
+	sd.mu.Unlock()
+	if secret == nil {
+		return ErrCSRFTokenInvalid
+	}
+
+	unmasked := make([]byte, csrfSecretLength)
+	xorBytes(unmasked, masked[csrfSecretLength:], masked[:csrfSecretLength])
+	if subtle.ConstantTimeCompare(unmasked, secret) != 1 {
+		return ErrCSRFTokenInvalid
+	}
+
+	return nil
+}
+
+// csrfSecret returns the CSRF secret for the session, or nil if there isn't
+// a valid one. It must be called with sd.mu held.
+func (sd *sessionData) csrfSecret() []byte {
+	encoded, ok := sd.reserved[csrfKey].(string)
+	if !ok {
+		return nil
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(secret) != csrfSecretLength {
+		return nil
+	}
+	return secret
+}
+
+// renewCSRFSecret replaces the CSRF secret for the session, if it has one, so
+// that CSRF tokens issued before the session token was renewed can no longer
+// be used. It must be called with sd.mu held.
+func (sd *sessionData) renewCSRFSecret() error {
+	if _, ok := sd.reserved[csrfKey]; !ok {
+		return nil
+	}
+
+	secret := make([]byte, csrfSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	sd.setReserved(csrfKey, base64.RawURLEncoding.EncodeToString(secret))
+	return nil
+}
+
+// xorBytes sets dst[i] = a[i] ^ b[i] for each byte of dst.
+func xorBytes(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+func defaultCSRFErrorFunc(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
@@ -0,0 +1,144 @@
+package scs
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSRFToken(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	token1, err := s.CSRFToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+
+	token2, err := s.CSRFToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token1 == token2 {
+		t.Error("want masked tokens to be different")
+	}
+
+	for _, token := range []string{token1, token2} {
+		r := httptest.NewRequest("POST", "/", nil).WithContext(ctx)
+		r.Header.Set("X-CSRF-Token", token)
+		if err := s.checkCSRFToken(r); err != nil {
+			t.Errorf("got %v: expected %v", err, nil)
+		}
+	}
+
+	err = s.RenewToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/", nil).WithContext(ctx)
+	r.Header.Set("X-CSRF-Token", token1)
+	if err := s.checkCSRFToken(r); err != ErrCSRFTokenInvalid {
+		t.Errorf("got %v: expected %v", err, ErrCSRFTokenInvalid)
+	}
+
+	// An empty FieldName or HeaderName falls back to the default name.
+	token3, err := s.CSRFToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CSRF = CSRF{}
+
+	r = httptest.NewRequest("POST", "/", nil).WithContext(ctx)
+	r.Header.Set("X-CSRF-Token", token3)
+	if err := s.checkCSRFToken(r); err != nil {
+		t.Errorf("got %v: expected %v", err, nil)
+	}
+
+	form := url.Values{"csrf_token": {token3}}
+	r = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode())).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := s.checkCSRFToken(r); err != nil {
+		t.Errorf("got %v: expected %v", err, nil)
+	}
+}
+
+func TestCSRFProtect(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	var csrfErr error
+	sessionManager.CSRF.ErrorFunc = func(w http.ResponseWriter, r *http.Request, err error) {
+		csrfErr = err
+		http.Error(w, "csrf", http.StatusForbidden)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/form", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := sessionManager.CSRFToken(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Write([]byte(token))
+	}))
+	mux.HandleFunc("/submit", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(sessionManager.CSRFProtect(mux)))
+	defer ts.Close()
+
+	_, token := ts.execute(t, "/form")
+
+	post := func(form url.Values) (int, string) {
+		rs, err := ts.Client().Post(ts.URL+"/submit", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		body, err := ioutil.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs.StatusCode, string(body)
+	}
+
+	code, body := post(url.Values{"csrf_token": {token}})
+	if code != http.StatusOK || body != "ok" {
+		t.Errorf("want %d %q; got %d %q", http.StatusOK, "ok", code, body)
+	}
+
+	code, _ = post(url.Values{})
+	if code != http.StatusForbidden {
+		t.Errorf("want %d; got %d", http.StatusForbidden, code)
+	}
+	if csrfErr != ErrCSRFTokenMissing {
+		t.Errorf("want %v; got %v", ErrCSRFTokenMissing, csrfErr)
+	}
+
+	code, _ = post(url.Values{"csrf_token": {"invalid"}})
+	if code != http.StatusForbidden {
+		t.Errorf("want %d; got %d", http.StatusForbidden, code)
+	}
+	if csrfErr != ErrCSRFTokenInvalid {
+		t.Errorf("want %v; got %v", ErrCSRFTokenInvalid, csrfErr)
+	}
+
+	_, body = ts.execute(t, "/submit")
+	if body != "ok" {
+		t.Errorf("want %q; got %q", "ok", body)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
@@ -29,12 +30,250 @@ const (
 	Destroyed
 )
 
+// ConflictPolicy controls how concurrent writes to the same session are
+// handled when the session store implements VersionedStore.
+type ConflictPolicy int
+
+const (
+	// LastWriteWins indicates that the session data committed by the last
+	// request will overwrite any changes made by other concurrent requests.
+	LastWriteWins ConflictPolicy = iota
+
+	// RetryOnConflict indicates that if the session data has been changed by
+	// a concurrent request since it was loaded, the session data should be
+	// reloaded from the store and the keys changed in the current request
+	// replayed on top of it before committing again.
+	RetryOnConflict
+
+	// ErrorOnConflict indicates that if the session data has been changed by a
+	// concurrent request since it was loaded, Commit should return
+	// ErrConflict.
+	ErrorOnConflict
+)
+
+// ErrConflict is returned by Commit when the session data has been changed by
+// a concurrent request and it could not be committed without overwriting
+// those changes.
+var ErrConflict = errors.New("scs: session data was modified by a concurrent request")
+
+// errSessionDeleted is returned by the merge function in mergeAndCommit to
+// stop the session data from being committed, because it has been deleted
+// from the store by a concurrent request.
+var errSessionDeleted = errors.New("scs: session data was deleted by a concurrent request")
+
+// maxConflictRetries is the maximum number of times that Commit will reload
+// and replay the session data when using the RetryOnConflict policy.
+const maxConflictRetries = 3
+
 type sessionData struct {
 	deadline time.Time
 	status   Status
 	token    string
 	values   map[string]interface{}
+	reserved map[string]interface{}
+	version  int64
+	changed  map[string]struct{}
+	cleared  bool
+	pending  bool
+	loadErr  error
+	touch    bool
+	bindUser bool
 	mu       sync.Mutex
+
+	// stored reports whether the session data was loaded from (or has been
+	// committed to) the store under the current token, as opposed to being
+	// new or having had its token replaced in the current request.
+	stored bool
+
+	// fingerprint is the fingerprint of the current request, and
+	// bindFingerprint reports whether it has been set.
+	fingerprint     string
+	bindFingerprint bool
+
+	// renewedFrom is the session token which was replaced in the current
+	// request and should be aliased to the new token on commit, and
+	// renewGrace is how long the alias should last for. renewal reports
+	// whether the token was replaced by RenewToken, rather than rotation.
+	// reissue reports whether the session data was loaded using such an alias.
+	renewedFrom string
+	renewGrace  time.Duration
+	renewal     bool
+	reissue     bool
+
+	// readOnly reports whether the session data is the copy kept under a
+	// rotated session token for RotationGracePeriod. It is never committed,
+	// and the client is never sent its token.
+	readOnly bool
+}
+
+// loadRequest holds the details of the request which session data is being
+// loaded for by the LoadAndSave middleware.
+type loadRequest struct {
+	// fingerprint is the fingerprint of the request, and bindFingerprint
+	// reports whether it has been set.
+	fingerprint     string
+	bindFingerprint bool
+}
+
+// markChanged records that the value for key has been added, updated or
+// deleted in the current request. It must be called with sd.mu held.
+func (sd *sessionData) markChanged(key string) {
+	if sd.changed == nil {
+		sd.changed = make(map[string]struct{})
+	}
+	sd.changed[key] = struct{}{}
+}
+
+// setReserved sets the reserved state for key, and records that it has been
+// changed in the current request. It must be called with sd.mu held.
+func (sd *sessionData) setReserved(key string, val interface{}) {
+	if sd.reserved == nil {
+		sd.reserved = make(map[string]interface{})
+	}
+	sd.reserved[key] = val
+	sd.markChanged(key)
+}
+
+// deleteReserved deletes the reserved state for key, and reports whether
+// there was any. It must be called with sd.mu held.
+func (sd *sessionData) deleteReserved(key string) bool {
+	if _, exists := sd.reserved[key]; !exists {
+		return false
+	}
+	delete(sd.reserved, key)
+	sd.markChanged(key)
+	return true
+}
+
+// applyChanges replays the keys which have been changed in the current
+// request on top of values and reserved (which should be a fresh copy of the
+// session data from the store), and then uses the result as the session data.
+// If the session data has been cleared in the current request, the stored
+// values are discarded. It must be called with sd.mu held.
+func (sd *sessionData) applyChanges(values, reserved map[string]interface{}) {
+	if sd.cleared {
+		return
+	}
+
+	for key := range sd.changed {
+		current, stored := sd.values, values
+		if reservedKey(key) {
+			current, stored = sd.reserved, reserved
+		}
+		if val, exists := current[key]; exists {
+			stored[key] = val
+		} else {
+			delete(stored, key)
+		}
+	}
+	sd.values, sd.reserved = values, reserved
+}
+
+// keepChanges discards all of the session data except for the keys which have
+// been changed in the current request, and the schema version. It reports
+// whether any of the changed keys are application keys (rather than reserved
+// keys), and so are worth keeping. It must be called with sd.mu held.
+func (sd *sessionData) keepChanges() bool {
+	values := make(map[string]interface{})
+	reserved := make(map[string]interface{})
+	keep := false
+	for key := range sd.changed {
+		if val, exists := sd.values[key]; exists {
+			values[key] = val
+			keep = true
+		} else if val, exists := sd.reserved[key]; exists && reservedKey(key) {
+			reserved[key] = val
+		}
+	}
+	if version, ok := sd.reserved[schemaVersionKey]; ok {
+		reserved[schemaVersionKey] = version
+	}
+	sd.values, sd.reserved = values, reserved
+	return keep
+}
+
+// rememberMeKey is the reserved session data key that the RememberMe setting
+// is stored under.
+const rememberMeKey = "__rememberMe"
+
+// reservedKeys are the session data keys that the SessionManager uses for the
+// reserved state it keeps for each session. They are passed to the Codec along
+// with the application's values, but are otherwise kept separate from them.
+var reservedKeys = map[string]bool{
+	csrfKey:          true,
+	fingerprintKey:   true,
+	flashKey:         true,
+	graceCopyKey:     true,
+	issuedAtKey:      true,
+	metadataKey:      true,
+	rememberMeKey:    true,
+	schemaVersionKey: true,
+	userIDKey:        true,
+}
+
+// reservedKey reports whether key is one of the reserved session data keys
+// used by the SessionManager.
+func reservedKey(key string) bool {
+	return reservedKeys[key]
+}
+
+// encodedValues returns the values to pass to the Codec, which are the
+// application's values together with the reserved state. It must be called
+// with sd.mu held.
+func (sd *sessionData) encodedValues() map[string]interface{} {
+	if len(sd.reserved) == 0 {
+		return sd.values
+	}
+
+	values := make(map[string]interface{}, len(sd.values)+len(sd.reserved))
+	for key, val := range sd.values {
+		values[key] = val
+	}
+	for key, val := range sd.reserved {
+		values[key] = val
+	}
+	return values
+}
+
+// splitReserved removes the reserved state from the decoded session data
+// values, and returns it.
+func splitReserved(values map[string]interface{}) map[string]interface{} {
+	reserved := make(map[string]interface{})
+	for key, val := range values {
+		if reservedKey(key) {
+			reserved[key] = val
+			delete(values, key)
+		}
+	}
+	return reserved
+}
+
+// decodeSession decodes the session data for the given session token,
+// separates the reserved state from the application's values, and applies any
+// upgrade functions registered for its schema version. The upgraded return
+// value reports whether any were applied.
+func (s *SessionManager) decodeSession(ctx context.Context, token string, b []byte) (deadline time.Time, values, reserved map[string]interface{}, upgraded bool, err error) {
+	deadline, values, err = s.decode(ctx, token, b)
+	if err != nil {
+		return time.Time{}, nil, nil, false, err
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	reserved = splitReserved(values)
+
+	upgraded, err = s.upgrade(values, reserved)
+	if err != nil {
+		return time.Time{}, nil, nil, false, err
+	}
+	return deadline, values, reserved, upgraded, nil
+}
+
+// resetChanges forgets any changes recorded in the current request. It must be
+// called with sd.mu held.
+func (sd *sessionData) resetChanges() {
+	sd.changed = nil
+	sd.cleared = false
 }
 
 func newSessionData(lifetime time.Duration) *sessionData {
@@ -49,40 +288,197 @@ func newSessionData(lifetime time.Duration) *sessionData {
 // and returns a new context.Context containing the session data. If no matching
 // token is found then this will create a new session.
 //
+// If an IdleTimeout is being used, the session data status will be set to
+// Modified, so that committing the session extends its expiry time.
+//
 // Most applications will use the LoadAndSave() middleware and will not need to
 // use this method.
 func (s *SessionManager) Load(ctx context.Context, token string) (context.Context, error) {
+	s.checkTokenEncryption()
+	return s.load(ctx, token, nil)
+}
+
+// load is the same as Load. If req is not nil then the caller (the LoadAndSave
+// middleware) extends the expiry time of unmodified sessions with a touch, so
+// they don't need to be marked as modified, and aliases for tokens replaced by
+// RenewToken are followed if the request fingerprint matches.
+func (s *SessionManager) load(ctx context.Context, token string, req *loadRequest) (context.Context, error) {
 	if _, ok := ctx.Value(s.contextKey).(*sessionData); ok {
 		return ctx, nil
 	}
 
+	octx, finish := s.instrument(ctx, Operation{Name: "Load", Reads: true})
+	sd, err := s.loadSessionData(octx, token, req)
+	if err != nil {
+		finish(OperationResult{Err: err})
+		if s.Hooks.OnLoadError != nil {
+			s.Hooks.OnLoadError(ctx, token, err)
+		}
+		return nil, err
+	}
+	finish(OperationResult{Found: sd.token != "", Status: sd.status})
+
+	return s.addSessionDataToContext(ctx, sd), nil
+}
+
+// loadSessionData retrieves the session data for the given token from the
+// session store. If no matching token is found then new session data is
+// returned. req is the same as for load.
+func (s *SessionManager) loadSessionData(ctx context.Context, token string, req *loadRequest) (*sessionData, error) {
 	if token == "" {
-		return s.addSessionDataToContext(ctx, newSessionData(s.Lifetime)), nil
+		return newSessionData(s.Lifetime), nil
 	}
 
-	b, found, err := s.doStoreFind(ctx, token)
+	find := func(token string) (b []byte, version int64, found bool, err error) {
+		if s.clientStore() {
+			b, found, err = s.doStoreClientFind(ctx, token)
+		} else if s.versioned() {
+			b, version, found, err = s.doStoreFindVersion(ctx, token)
+		} else {
+			b, found, err = s.doStoreFind(ctx, token)
+		}
+		return b, version, found, err
+	}
+
+	b, version, found, err := find(token)
 	if err != nil {
 		return nil, err
-	} else if !found {
-		return s.addSessionDataToContext(ctx, newSessionData(s.Lifetime)), nil
+	}
+
+	// If the token has been replaced by RenewToken or rotation within the
+	// grace period, then use the session data for the new token instead and
+	// send the new token to the client.
+	reissue, renewal := false, false
+	if !found && s.aliasing() {
+		newToken, renewedAlias, aliased, err := s.resolveAlias(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		if aliased {
+			b, version, found, err = find(newToken)
+			if err != nil {
+				return nil, err
+			}
+			token, reissue, renewal = newToken, true, renewedAlias
+		}
+	}
+	if !found {
+		return newSessionData(s.Lifetime), nil
 	}
 
 	sd := &sessionData{
-		status: Unmodified,
-		token:  token,
+		status:  Unmodified,
+		token:   token,
+		version: version,
+		reissue: reissue,
+		stored:  true,
 	}
-	if sd.deadline, sd.values, err = s.Codec.Decode(b); err != nil {
+	var upgraded bool
+	if sd.deadline, sd.values, sd.reserved, upgraded, err = s.decodeSession(ctx, token, b); err != nil {
 		return nil, err
 	}
 
-	// Mark the session data as modified if an idle timeout is being used. This
-	// will force the session data to be re-committed to the session store with
-	// a new expiry time.
-	if s.IdleTimeout > 0 {
+	// An alias for a token replaced by RenewToken is only followed by a
+	// request from the client the session is bound to. Otherwise the request
+	// gets a new session, and isn't sent the new token.
+	if renewal && !followRenewal(req, sd.reserved) {
+		s.logger().Warn("scs: renewed session token alias not followed", s.logAttrs("Load", token)...)
+		return newSessionData(s.Lifetime), nil
+	}
+
+	// The copy of the session data kept under a rotated token is only there
+	// so that concurrent requests which still present the old token can be
+	// served, so it must not be written back to the store.
+	if _, ok := sd.reserved[graceCopyKey]; ok {
+		delete(sd.reserved, graceCopyKey)
+		sd.readOnly = true
+		return sd, nil
+	}
+
+	// If the session data has been upgraded to a newer schema version, it
+	// needs to be re-committed in the new format.
+	if upgraded {
 		sd.status = Modified
 	}
 
-	return s.addSessionDataToContext(ctx, sd), nil
+	// If an idle timeout is being used, the expiry time in the session store
+	// needs to be extended. If the store supports it and the session is being
+	// loaded by the LoadAndSave middleware we do this with a touch, otherwise
+	// we mark the session data as modified. This will force the session data
+	// to be re-committed to the session store with a new expiry time.
+	if s.IdleTimeout > 0 {
+		if req != nil && s.touchable() {
+			sd.touch = true
+		} else {
+			sd.status = Modified
+		}
+	}
+
+	return sd, nil
+}
+
+// loadLazy returns a new context.Context containing placeholder session data
+// for the given token. The session data is only retrieved from the session
+// store when it is first accessed.
+func (s *SessionManager) loadLazy(ctx context.Context, token string) context.Context {
+	if _, ok := ctx.Value(s.contextKey).(*sessionData); ok {
+		return ctx
+	}
+
+	if token == "" {
+		return s.addSessionDataToContext(ctx, newSessionData(s.Lifetime))
+	}
+
+	return s.addSessionDataToContext(ctx, &sessionData{token: token, pending: true})
+}
+
+// loadPending retrieves the session data from the session store if it was
+// deferred by loadLazy. If the session data can't be retrieved then the
+// session is treated as new, and the error is recorded so that it is
+// returned by Commit.
+func (s *SessionManager) loadPending(ctx context.Context, sd *sessionData) {
+	sd.mu.Lock()
+
+	if !sd.pending {
+		sd.mu.Unlock()
+		return
+	}
+
+	token := sd.token
+	req := &loadRequest{fingerprint: sd.fingerprint, bindFingerprint: sd.bindFingerprint}
+	octx, finish := s.instrument(ctx, Operation{Name: "Load", Reads: true})
+	loaded, err := s.loadSessionData(octx, token, req)
+	if err != nil {
+		sd.loadErr = err
+		loaded = newSessionData(s.Lifetime)
+	}
+	finish(OperationResult{Err: err, Found: loaded.token != "", Status: loaded.status})
+
+	sd.pending = false
+	sd.deadline = loaded.deadline
+	sd.status = loaded.status
+	sd.token = loaded.token
+	sd.values = loaded.values
+	sd.reserved = loaded.reserved
+	sd.version = loaded.version
+	sd.stored = loaded.stored
+	sd.touch = loaded.touch
+	sd.reissue = loaded.reissue
+	sd.readOnly = loaded.readOnly
+	sd.mu.Unlock()
+
+	if err != nil {
+		if s.Hooks.OnLoadError != nil {
+			s.Hooks.OnLoadError(ctx, token, err)
+		}
+		return
+	}
+
+	if err = s.checkFingerprint(ctx, sd); err != nil {
+		sd.mu.Lock()
+		sd.loadErr = err
+		sd.mu.Unlock()
+	}
 }
 
 // Commit saves the session data to the session store and returns the session
@@ -93,34 +489,301 @@ func (s *SessionManager) Load(ctx context.Context, token string) (context.Contex
 func (s *SessionManager) Commit(ctx context.Context) (string, time.Time, error) {
 	sd := s.getSessionDataFromContext(ctx)
 
+	octx, finish := s.instrument(ctx, Operation{Name: "Commit"})
+	token, expiry, created, err := s.commit(octx, sd)
+	finish(OperationResult{Err: err, Status: sd.currentStatus(), Created: created})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if created && s.Hooks.OnCreate != nil {
+		s.Hooks.OnCreate(ctx, token)
+	}
+	if s.Hooks.OnCommit != nil {
+		s.Hooks.OnCommit(ctx, token, expiry)
+	}
+
+	return token, expiry, nil
+}
+
+// commit saves the session data to the session store. The created return value
+// reports whether a new session token was generated.
+func (s *SessionManager) commit(ctx context.Context, sd *sessionData) (token string, expiry time.Time, created bool, err error) {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
+	if sd.loadErr != nil {
+		return "", time.Time{}, false, sd.loadErr
+	}
+
+	if sd.readOnly {
+		return "", time.Time{}, false, ErrReadOnly
+	}
+
 	if sd.token == "" {
-		var err error
 		if sd.token, err = generateToken(); err != nil {
-			return "", time.Time{}, err
+			return "", time.Time{}, false, err
 		}
+		created = true
 	}
 
-	b, err := s.Codec.Encode(sd.deadline, sd.values)
+	expiry = s.expiry(sd.deadline)
+
+	if created && s.RotationInterval > 0 {
+		sd.setReserved(issuedAtKey, time.Now().UnixNano())
+	}
+
+	// Session data without a schema version (new or cleared sessions) is in the
+	// current format.
+	if s.schemaVersion > 0 {
+		if _, ok := sd.reserved[schemaVersionKey]; !ok {
+			sd.setReserved(schemaVersionKey, s.schemaVersion)
+		}
+	}
+
+	// New sessions are bound to the fingerprint of the request that they are
+	// first committed in.
+	if sd.bindFingerprint {
+		if _, ok := sd.reserved[fingerprintKey]; !ok {
+			sd.setReserved(fingerprintKey, sd.fingerprint)
+		}
+	}
+
+	switch {
+	case s.clientStore():
+		var b []byte
+		b, err = s.codecEncode(ctx, "", sd.deadline, sd.encodedValues())
+		if err == nil {
+			sd.token, err = s.doStoreSeal(ctx, b, expiry)
+		}
+	case s.versioned():
+		err = s.compareAndCommit(ctx, sd, expiry)
+	case s.MergeChanges:
+		err = s.mergeAndCommit(ctx, sd, expiry)
+	default:
+		var b []byte
+		b, err = s.encode(ctx, sd.token, sd.deadline, sd.encodedValues())
+		if err == nil {
+			err = s.doStoreCommit(ctx, sd.token, b, expiry)
+		}
+	}
 	if err != nil {
-		return "", time.Time{}, err
+		return "", time.Time{}, false, err
+	}
+
+	if err = s.finishRenewal(ctx, sd, expiry); err != nil {
+		return "", time.Time{}, false, err
+	}
+
+	// The user index is given the session deadline rather than the expiry
+	// time, because the session may be extended by an idle timeout without
+	// being bound again.
+	if sd.bindUser && !s.clientStore() && s.userIndexed() {
+		if userID, ok := sd.reserved[userIDKey].(string); ok {
+			err = s.doStoreBindUser(ctx, sd.token, userID, sd.deadline)
+		} else {
+			err = s.doStoreUnbindUser(ctx, sd.token)
+		}
+		if err != nil {
+			return "", time.Time{}, false, err
+		}
+	}
+	sd.bindUser = false
+
+	// Committing the session data extends the expiry time in the store, so it
+	// counts as a touch.
+	if s.TouchInterval > 0 {
+		s.touches.record(sd.token, time.Now())
+	}
+
+	sd.resetChanges()
+	sd.touch = false
+	sd.stored = true
+	return sd.token, expiry, created, nil
+}
+
+// touch extends the expiry time of the session data in the session store,
+// without re-committing the session data, using the TouchStore interface. It
+// is a no-op unless the session data was loaded with an idle timeout and has
+// not been committed since. The touched return value will be false if nothing
+// was done, including if the session was already touched within the last
+// TouchInterval.
+func (s *SessionManager) touch(ctx context.Context) (token string, expiry time.Time, touched bool, err error) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !sd.touch || sd.token == "" {
+		return "", time.Time{}, false, nil
 	}
 
-	expiry := sd.deadline
+	if s.TouchInterval > 0 && !s.touches.allow(sd.token, s.TouchInterval, time.Now()) {
+		return "", time.Time{}, false, nil
+	}
+
+	expiry = s.expiry(sd.deadline)
+	if err := s.doStoreTouch(ctx, sd.token, expiry); err != nil {
+		return "", time.Time{}, false, err
+	}
+
+	sd.touch = false
+	return sd.token, expiry, true, nil
+}
+
+// expiry returns the expiry time for session data with the given deadline,
+// taking into account the idle timeout.
+func (s *SessionManager) expiry(deadline time.Time) time.Time {
+	expiry := deadline
 	if s.IdleTimeout > 0 {
 		ie := time.Now().Add(s.IdleTimeout).UTC()
 		if ie.Before(expiry) {
 			expiry = ie
 		}
 	}
+	return expiry
+}
 
-	if err := s.doStoreCommit(ctx, sd.token, b, expiry); err != nil {
-		return "", time.Time{}, err
+// touchThrottle records when sessions were last touched, so that each session
+// is touched at most once per interval.
+type touchThrottle struct {
+	mu    sync.Mutex
+	last  map[string]time.Time
+	swept time.Time
+}
+
+// allow reports whether the session with the given token may be touched now,
+// and if so records the time.
+func (t *touchThrottle) allow(token string, interval time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.last == nil {
+		t.last = make(map[string]time.Time)
 	}
 
-	return sd.token, expiry, nil
+	// Periodically forget sessions which were touched more than one interval
+	// ago, so that the map doesn't grow without bound.
+	if now.Sub(t.swept) >= interval {
+		for token, last := range t.last {
+			if now.Sub(last) >= interval {
+				delete(t.last, token)
+			}
+		}
+		t.swept = now
+	}
+
+	if last, ok := t.last[token]; ok && now.Sub(last) < interval {
+		return false
+	}
+	t.last[token] = now
+	return true
+}
+
+// record records that the session with the given token was touched now.
+func (t *touchThrottle) record(token string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.last == nil {
+		t.last = make(map[string]time.Time)
+	}
+	t.last[token] = now
+}
+
+// compareAndCommit commits the session data using the VersionedStore
+// interface, reloading the session data and replaying the changes made in the
+// current request if necessary. It must be called with sd.mu held.
+func (s *SessionManager) compareAndCommit(ctx context.Context, sd *sessionData, expiry time.Time) error {
+	for attempt := 0; ; attempt++ {
+		b, err := s.encode(ctx, sd.token, sd.deadline, sd.encodedValues())
+		if err != nil {
+			return err
+		}
+
+		version, committed, err := s.doStoreCompareAndCommit(ctx, sd.token, b, expiry, sd.version)
+		if err != nil {
+			return err
+		}
+		if committed {
+			sd.version = version
+			return nil
+		}
+
+		// If nothing has been changed in the current request, then the commit
+		// is only extending the expiry time and there are no changes which
+		// could be lost. In that case it's always safe to replay.
+		hasChanges := len(sd.changed) > 0 || sd.cleared
+		if attempt >= maxConflictRetries || (hasChanges && s.ConflictPolicy != RetryOnConflict) {
+			return ErrConflict
+		}
+
+		b, version, found, err := s.doStoreFindVersion(ctx, sd.token)
+		if err != nil {
+			return err
+		}
+
+		values, reserved := make(map[string]interface{}), make(map[string]interface{})
+		if found {
+			if _, values, reserved, _, err = s.decodeSession(ctx, sd.token, b); err != nil {
+				return err
+			}
+		}
+		sd.applyChanges(values, reserved)
+		sd.version = version
+	}
+}
+
+// mergeAndCommit re-reads the session data from the store, merges in the keys
+// which have been changed in the current request, and commits the result. If
+// the store implements MergeStore then this is done atomically by the store.
+// It must be called with sd.mu held.
+func (s *SessionManager) mergeAndCommit(ctx context.Context, sd *sessionData, expiry time.Time) error {
+	merge := func(b []byte, found bool) ([]byte, error) {
+		switch {
+		case found:
+			_, values, reserved, _, err := s.decodeSession(ctx, sd.token, b)
+			if err != nil {
+				return nil, err
+			}
+			sd.applyChanges(values, reserved)
+		case sd.stored:
+			// The session data has been deleted from the store since it was
+			// loaded, for example by a concurrent request which destroyed the
+			// session on logout. Rather than bringing the whole session back,
+			// only the keys changed in the current request are kept.
+			if !sd.keepChanges() {
+				return nil, errSessionDeleted
+			}
+		}
+		// Otherwise this is a new session or the token has just been renewed,
+		// and there is nothing to merge with.
+		return s.encode(ctx, sd.token, sd.deadline, sd.encodedValues())
+	}
+
+	var err error
+	switch s.Store.(type) {
+	case MergeCtxStore, MergeStore:
+		err = s.doStoreMerge(ctx, sd.token, expiry, merge)
+		if err == errSessionDeleted {
+			return nil
+		}
+		return err
+	}
+
+	b, found, err := s.doStoreFind(ctx, sd.token)
+	if err != nil {
+		return err
+	}
+
+	b, err = merge(b, found)
+	if err == errSessionDeleted {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return s.doStoreCommit(ctx, sd.token, b, expiry)
 }
 
 // Destroy deletes the session data from the session store and sets the session
@@ -129,24 +792,56 @@ func (s *SessionManager) Commit(ctx context.Context) (string, time.Time, error)
 func (s *SessionManager) Destroy(ctx context.Context) error {
 	sd := s.getSessionDataFromContext(ctx)
 
+	octx, finish := s.instrument(ctx, Operation{Name: "Destroy"})
+	token, err := s.destroy(octx, sd)
+	finish(OperationResult{Err: err, Status: sd.currentStatus()})
+	if err != nil {
+		return err
+	}
+
+	if s.Hooks.OnDestroy != nil {
+		s.Hooks.OnDestroy(ctx, token)
+	}
+
+	return nil
+}
+
+// destroy deletes the session data from the session store and resets it. It
+// returns the token of the destroyed session.
+func (s *SessionManager) destroy(ctx context.Context, sd *sessionData) (string, error) {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
-	err := s.doStoreDelete(ctx, sd.token)
+	token := sd.token
+	err := s.doStoreDelete(ctx, token)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	// If the token was replaced in the current request but the old token has
+	// not yet been aliased, then the old token is still in the store.
+	if sd.renewedFrom != "" {
+		err = s.doStoreDelete(ctx, sd.renewedFrom)
+		if err != nil {
+			return "", err
+		}
+		sd.renewedFrom = ""
 	}
 
 	sd.status = Destroyed
 
 	// Reset everything else to defaults.
 	sd.token = ""
+	sd.version = 0
+	sd.stored = false
 	sd.deadline = time.Now().Add(s.Lifetime).UTC()
 	for key := range sd.values {
 		delete(sd.values, key)
 	}
+	sd.reserved = nil
+	sd.resetChanges()
 
-	return nil
+	return token, nil
 }
 
 // Put adds a key and corresponding value to the session data. Any existing
@@ -157,6 +852,7 @@ func (s *SessionManager) Put(ctx context.Context, key string, val interface{}) {
 
 	sd.mu.Lock()
 	sd.values[key] = val
+	sd.markChanged(key)
 	sd.status = Modified
 	sd.mu.Unlock()
 }
@@ -196,6 +892,7 @@ func (s *SessionManager) Pop(ctx context.Context, key string) interface{} {
 		return nil
 	}
 	delete(sd.values, key)
+	sd.markChanged(key)
 	sd.status = Modified
 
 	return val
@@ -216,25 +913,40 @@ func (s *SessionManager) Remove(ctx context.Context, key string) {
 	}
 
 	delete(sd.values, key)
+	sd.markChanged(key)
 	sd.status = Modified
 }
 
-// Clear removes all data for the current session. The session token and
-// lifetime are unaffected. If there is no data in the current session this is
-// a no-op.
+// Clear removes all data for the current session, including the user ID, CSRF
+// secret, flash messages and RememberMe setting. The session token, lifetime
+// and metadata are unaffected, as are the fingerprint the session is bound to
+// and the time its token was issued. Removing the user ID has the same effect
+// as UnbindUser. If there is no data in the current session this is a no-op.
 func (s *SessionManager) Clear(ctx context.Context) error {
 	sd := s.getSessionDataFromContext(ctx)
 
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
-	if len(sd.values) == 0 {
+	cleared := false
+	for key := range sd.reserved {
+		switch key {
+		case metadataKey, fingerprintKey, issuedAtKey, schemaVersionKey:
+			continue
+		}
+		cleared = sd.deleteReserved(key) || cleared
+		if key == userIDKey {
+			sd.bindUser = true
+		}
+	}
+	if len(sd.values) == 0 && !cleared {
 		return nil
 	}
 
 	for key := range sd.values {
 		delete(sd.values, key)
 	}
+	sd.cleared = true
 	sd.status = Modified
 	return nil
 }
@@ -274,6 +986,10 @@ func (s *SessionManager) Keys(ctx context.Context) []string {
 // the session data status will be set to Modified.
 //
 // The old session token and accompanying data are deleted from the session store.
+// If RenewGracePeriod is set and the session store implements AliasStore, this
+// is deferred until the session data is committed, and the old token is then
+// replaced by an alias to the new token which lasts for the grace period. If the
+// session has a CSRF secret, it is regenerated.
 //
 // To mitigate the risk of session fixation attacks, it's important that you call
 // RenewToken before making any changes to privilege levels (e.g. login and
@@ -282,26 +998,64 @@ func (s *SessionManager) Keys(ctx context.Context) []string {
 func (s *SessionManager) RenewToken(ctx context.Context) error {
 	sd := s.getSessionDataFromContext(ctx)
 
+	octx, finish := s.instrument(ctx, Operation{Name: "RenewToken"})
+	oldToken, newToken, err := s.renewToken(octx, sd)
+	finish(OperationResult{Err: err, Status: sd.currentStatus()})
+	if err != nil {
+		return err
+	}
+
+	if s.Hooks.OnRenew != nil {
+		s.Hooks.OnRenew(ctx, oldToken, newToken)
+	}
+
+	return nil
+}
+
+// renewToken replaces the session token with a new one, deleting the old
+// session token from the session store. If RenewGracePeriod is set and the
+// store supports it, the old token is instead aliased to the new one when the
+// session data is committed.
+func (s *SessionManager) renewToken(ctx context.Context, sd *sessionData) (oldToken, newToken string, err error) {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
-	if sd.token != "" {
-		err := s.doStoreDelete(ctx, sd.token)
-		if err != nil {
-			return err
+	oldToken = sd.token
+	if oldToken != "" {
+		if s.RenewGracePeriod > 0 && s.aliasing() {
+			sd.deferRenewal(oldToken, s.RenewGracePeriod, true)
+		} else {
+			err := s.doStoreDelete(ctx, oldToken)
+			if err != nil {
+				return "", "", err
+			}
 		}
 	}
 
-	newToken, err := generateToken()
+	newToken, err = generateToken()
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
+	err = sd.renewCSRFSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	// Session data loaded from the copy kept under a rotated token becomes a
+	// session of its own once its token is renewed.
 	sd.token = newToken
+	sd.version = 0
+	sd.stored = false
+	sd.readOnly = false
 	sd.deadline = time.Now().Add(s.Lifetime).UTC()
 	sd.status = Modified
+	_, sd.bindUser = sd.reserved[userIDKey]
+	if s.RotationInterval > 0 {
+		sd.setReserved(issuedAtKey, time.Now().UnixNano())
+	}
 
-	return nil
+	return oldToken, newToken, nil
 }
 
 // MergeSession is used to merge in data from a different session in case strict
@@ -317,7 +1071,7 @@ func (s *SessionManager) MergeSession(ctx context.Context, token string) error {
 		return nil
 	}
 
-	deadline, values, err := s.Codec.Decode(b)
+	deadline, values, reserved, _, err := s.decodeSession(ctx, token, b)
 	if err != nil {
 		return err
 	}
@@ -336,6 +1090,14 @@ func (s *SessionManager) MergeSession(ctx context.Context, token string) error {
 
 	for k, v := range values {
 		sd.values[k] = v
+		sd.markChanged(k)
+	}
+
+	// Flash messages are carried over from the other session, but the rest of
+	// its reserved state (such as its user ID and CSRF secret) is not.
+	if flashes, ok := reserved[flashKey].([]Flash); ok {
+		current, _ := sd.reserved[flashKey].([]Flash)
+		sd.setReserved(flashKey, append(current, flashes...))
 	}
 
 	sd.status = Modified
@@ -532,12 +1294,50 @@ func (s *SessionManager) PopTime(ctx context.Context, key string) time.Time {
 // if you have set SessionManager.Cookie.Persist = false (the default is true) and
 // you are using the standard LoadAndSave() middleware.
 func (s *SessionManager) RememberMe(ctx context.Context, val bool) {
-	s.Put(ctx, "__rememberMe", val)
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	sd.setReserved(rememberMeKey, val)
+	sd.status = Modified
+	sd.mu.Unlock()
+}
+
+// rememberMe reports whether RememberMe(true) has been called for the session.
+func (s *SessionManager) rememberMe(ctx context.Context) bool {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	rememberMe, _ := sd.reserved[rememberMeKey].(bool)
+	return rememberMe
+}
+
+// Count returns the number of active (i.e. not expired) sessions in the store.
+// If the session store implements CountStore or CountCtxStore then its Count
+// method is used, otherwise all active sessions are retrieved from the store
+// and counted. If the session store supports neither counting nor iteration
+// then Count will panic.
+func (s *SessionManager) Count(ctx context.Context) (int, error) {
+	switch cs := s.Store.(type) {
+	case CountCtxStore:
+		return cs.CountCtx(ctx)
+	case CountStore:
+		return cs.Count()
+	}
+
+	allSessions, err := s.doStoreAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(allSessions), nil
 }
 
 // Iterate retrieves all active (i.e. not expired) sessions from the store and
 // executes the provided function fn for each session. If the session store
-// being used does not support iteration then Iterate will panic.
+// being used does not support iteration then Iterate will panic. If
+// TokenEncryption is set, sessions can only be iterated over if their data key
+// is escrowed (see TokenEncryption.SkipWithoutEscrow).
 func (s *SessionManager) Iterate(ctx context.Context, fn func(context.Context) error) error {
 	allSessions, err := s.doStoreAll(ctx)
 	if err != nil {
@@ -548,9 +1348,20 @@ func (s *SessionManager) Iterate(ctx context.Context, fn func(context.Context) e
 		sd := &sessionData{
 			status: Unmodified,
 			token:  token,
+			stored: true,
 		}
 
-		sd.deadline, sd.values, err = s.Codec.Decode(b)
+		sd.deadline, sd.values, err = s.decodeStored(ctx, token, b)
+		if s.skipStored(err) {
+			continue
+		}
+		if err == nil {
+			if sd.values == nil {
+				sd.values = make(map[string]interface{})
+			}
+			sd.reserved = splitReserved(sd.values)
+			_, err = s.upgrade(sd.values, sd.reserved)
+		}
 		if err != nil {
 			return err
 		}
@@ -588,6 +1399,9 @@ func (s *SessionManager) SetDeadline(ctx context.Context, expire time.Time) {
 	defer sd.mu.Unlock()
 
 	sd.deadline = expire
+	if _, ok := sd.reserved[userIDKey]; ok {
+		sd.bindUser = true
+	}
 	sd.status = Modified
 }
 
@@ -608,6 +1422,15 @@ func (s *SessionManager) addSessionDataToContext(ctx context.Context, sd *sessio
 }
 
 func (s *SessionManager) getSessionDataFromContext(ctx context.Context) *sessionData {
+	sd := s.getPendingSessionDataFromContext(ctx)
+	s.loadPending(ctx, sd)
+	return sd
+}
+
+// getPendingSessionDataFromContext is the same as getSessionDataFromContext,
+// except that it doesn't retrieve session data which has been deferred by
+// loadLazy.
+func (s *SessionManager) getPendingSessionDataFromContext(ctx context.Context) *sessionData {
 	c, ok := ctx.Value(s.contextKey).(*sessionData)
 	if !ok {
 		panic("scs: no session data in context")
@@ -629,6 +1452,19 @@ func hashToken(token string) string {
 	return base64.RawURLEncoding.EncodeToString(hash[:])
 }
 
+// codecKey returns the key that the session data for token is stored under,
+// for passing to a TokenCodec. Client-side stores don't have a key, because
+// the token is derived from the encoded session data.
+func (s *SessionManager) codecKey(token string) string {
+	if s.clientStore() {
+		return ""
+	}
+	if s.HashTokenInStore {
+		return hashToken(token)
+	}
+	return token
+}
+
 type contextKey string
 
 var (
@@ -644,6 +1480,9 @@ func generateContextKey() contextKey {
 }
 
 func (s *SessionManager) doStoreDelete(ctx context.Context, token string) (err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "Delete", Store: true})
+	defer func() { finish(OperationResult{Err: err}) }()
+
 	if s.HashTokenInStore {
 		token = hashToken(token)
 	}
@@ -657,6 +1496,9 @@ func (s *SessionManager) doStoreDelete(ctx context.Context, token string) (err e
 }
 
 func (s *SessionManager) doStoreFind(ctx context.Context, token string) (b []byte, found bool, err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "Find", Store: true, Reads: true})
+	defer func() { finish(OperationResult{Err: err, Size: len(b), Found: found}) }()
+
 	if s.HashTokenInStore {
 		token = hashToken(token)
 	}
@@ -669,10 +1511,20 @@ func (s *SessionManager) doStoreFind(ctx context.Context, token string) (b []byt
 	return s.Store.Find(token)
 }
 
-func (s *SessionManager) doStoreCommit(ctx context.Context, token string, b []byte, expiry time.Time) (err error) {
+func (s *SessionManager) doStoreCommit(ctx context.Context, token string, b []byte, expiry time.Time) error {
 	if s.HashTokenInStore {
 		token = hashToken(token)
 	}
+	return s.doStoreCommitKey(ctx, token, b, expiry)
+}
+
+// doStoreCommitKey is the same as doStoreCommit, except that it takes the key
+// that the session data is stored under (for example, a key returned by
+// doStoreAll) rather than the session token.
+func (s *SessionManager) doStoreCommitKey(ctx context.Context, token string, b []byte, expiry time.Time) (err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "Commit", Store: true})
+	defer func() { finish(OperationResult{Err: err, Size: len(b)}) }()
+
 	c, ok := s.Store.(interface {
 		CommitCtx(context.Context, string, []byte, time.Time) error
 	})
@@ -682,7 +1534,120 @@ func (s *SessionManager) doStoreCommit(ctx context.Context, token string, b []by
 	return s.Store.Commit(token, b, expiry)
 }
 
-func (s *SessionManager) doStoreAll(ctx context.Context) (map[string][]byte, error) {
+func (s *SessionManager) clientStore() bool {
+	_, ok := s.Store.(ClientStore)
+	return ok
+}
+
+// doStoreClientFind opens the session data sealed in a token by a ClientStore.
+// The token is the sealed session data, so there's no need to hash it.
+func (s *SessionManager) doStoreClientFind(ctx context.Context, token string) (b []byte, found bool, err error) {
+	_, finish := s.instrument(ctx, Operation{Name: "Find", Store: true, Reads: true})
+	defer func() { finish(OperationResult{Err: err, Size: len(b), Found: found}) }()
+
+	return s.Store.(ClientStore).Find(token)
+}
+
+func (s *SessionManager) doStoreSeal(ctx context.Context, b []byte, expiry time.Time) (token string, err error) {
+	_, finish := s.instrument(ctx, Operation{Name: "Seal", Store: true})
+	defer func() { finish(OperationResult{Err: err, Size: len(b)}) }()
+
+	return s.Store.(ClientStore).Seal(b, expiry)
+}
+
+func (s *SessionManager) versioned() bool {
+	if s.ConflictPolicy == LastWriteWins {
+		return false
+	}
+	switch s.Store.(type) {
+	case VersionedCtxStore, VersionedStore:
+		return true
+	}
+	return false
+}
+
+func (s *SessionManager) doStoreFindVersion(ctx context.Context, token string) ([]byte, int64, bool, error) {
+	if s.HashTokenInStore {
+		token = hashToken(token)
+	}
+	return s.doStoreFindVersionKey(ctx, token)
+}
+
+func (s *SessionManager) doStoreFindVersionKey(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "FindVersion", Store: true, Reads: true})
+	defer func() { finish(OperationResult{Err: err, Size: len(b), Found: found}) }()
+
+	cs, ok := s.Store.(VersionedCtxStore)
+	if ok {
+		return cs.FindVersionCtx(ctx, token)
+	}
+	return s.Store.(VersionedStore).FindVersion(token)
+}
+
+func (s *SessionManager) doStoreCompareAndCommit(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (int64, bool, error) {
+	if s.HashTokenInStore {
+		token = hashToken(token)
+	}
+	return s.doStoreCompareAndCommitKey(ctx, token, b, expiry, version)
+}
+
+func (s *SessionManager) doStoreCompareAndCommitKey(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, committed bool, err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "CompareAndCommit", Store: true})
+	defer func() { finish(OperationResult{Err: err, Size: len(b)}) }()
+
+	cs, ok := s.Store.(VersionedCtxStore)
+	if ok {
+		return cs.CompareAndCommitCtx(ctx, token, b, expiry, version)
+	}
+	return s.Store.(VersionedStore).CompareAndCommit(token, b, expiry, version)
+}
+
+func (s *SessionManager) doStoreMerge(ctx context.Context, token string, expiry time.Time, fn func([]byte, bool) ([]byte, error)) (err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "Merge", Store: true})
+	defer func() { finish(OperationResult{Err: err}) }()
+
+	if s.HashTokenInStore {
+		token = hashToken(token)
+	}
+	cs, ok := s.Store.(MergeCtxStore)
+	if ok {
+		return cs.MergeCtx(ctx, token, expiry, fn)
+	}
+	return s.Store.(MergeStore).Merge(token, expiry, fn)
+}
+
+func (s *SessionManager) touchable() bool {
+	switch s.Store.(type) {
+	case TouchCtxStore, TouchStore:
+		return true
+	}
+	return false
+}
+
+func (s *SessionManager) doStoreTouch(ctx context.Context, token string, expiry time.Time) (err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "Touch", Store: true})
+	defer func() { finish(OperationResult{Err: err}) }()
+
+	if s.HashTokenInStore {
+		token = hashToken(token)
+	}
+	cs, ok := s.Store.(TouchCtxStore)
+	if ok {
+		return cs.TouchCtx(ctx, token, expiry)
+	}
+	return s.Store.(TouchStore).Touch(token, expiry)
+}
+
+func (s *SessionManager) doStoreAll(ctx context.Context) (sessions map[string][]byte, err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "All", Store: true, Reads: true})
+	defer func() {
+		size := 0
+		for _, b := range sessions {
+			size += len(b)
+		}
+		finish(OperationResult{Err: err, Size: size, Found: len(sessions) > 0})
+	}()
+
 	cs, ok := s.Store.(IterableCtxStore)
 	if ok {
 		return cs.AllCtx(ctx)
@@ -0,0 +1,107 @@
+//go:build go1.18
+// +build go1.18
+
+package scs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrKeyNotFound is returned by LookupAs and PopLookupAs when the given key is not present in
+// the session data.
+var ErrKeyNotFound = errors.New("scs: key not found in session data")
+
+// TypeError is returned by LookupAs and PopLookupAs when the value for a key is present in the
+// session data but does not have the requested type.
+type TypeError struct {
+	Key   string
+	Value interface{}
+	Want  string
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("scs: value for key %q has type %T, not %s", e.Key, e.Value, e.Want)
+}
+
+// GetAs returns the value for a given key from the session data, type
+// asserted to T. The ok return value will be false if the key does not exist or
+// the value could not be type asserted to T. For example:
+//
+//	user, ok := scs.GetAs[User](sessionManager, r.Context(), "user")
+//
+// If you need to tell a missing key apart from a value of the wrong type, use
+// LookupAs instead.
+func GetAs[T any](s *SessionManager, ctx context.Context, key string) (val T, ok bool) {
+	val, err := LookupAs[T](s, ctx, key)
+	return val, err == nil
+}
+
+// LookupAs returns the value for a given key from the session data, type
+// asserted to T. If the key does not exist then ErrKeyNotFound is returned. If
+// the value exists but could not be type asserted to T then a *TypeError is
+// returned.
+func LookupAs[T any](s *SessionManager, ctx context.Context, key string) (T, error) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	var zero T
+
+	val, exists := sd.values[key]
+	if !exists {
+		return zero, ErrKeyNotFound
+	}
+
+	t, ok := val.(T)
+	if !ok {
+		return zero, &TypeError{Key: key, Value: val, Want: reflect.TypeOf((*T)(nil)).Elem().String()}
+	}
+
+	return t, nil
+}
+
+// PopAs acts like a one-time GetAs. It returns the value for a given key from
+// the session data, type asserted to T, and deletes the key and value from the
+// session data. The session data status will be set to Modified.
+//
+// Unlike Pop, if the value could not be type asserted to T then it is left in
+// the session data and the ok return value will be false. If you need to tell
+// a missing key apart from a value of the wrong type, use PopLookupAs instead.
+func PopAs[T any](s *SessionManager, ctx context.Context, key string) (val T, ok bool) {
+	val, err := PopLookupAs[T](s, ctx, key)
+	return val, err == nil
+}
+
+// PopLookupAs acts like a one-time LookupAs. It returns the value for a given
+// key from the session data, type asserted to T, and deletes the key and value
+// from the session data. The session data status will be set to Modified. If
+// the key does not exist then ErrKeyNotFound is returned. If the value exists
+// but could not be type asserted to T then a *TypeError is returned, and the
+// value is left in the session data.
+func PopLookupAs[T any](s *SessionManager, ctx context.Context, key string) (T, error) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	var zero T
+
+	val, exists := sd.values[key]
+	if !exists {
+		return zero, ErrKeyNotFound
+	}
+
+	t, ok := val.(T)
+	if !ok {
+		return zero, &TypeError{Key: key, Value: val, Want: reflect.TypeOf((*T)(nil)).Elem().String()}
+	}
+	delete(sd.values, key)
+	sd.markChanged(key)
+	sd.status = Modified
+
+	return t, nil
+}
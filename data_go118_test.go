@@ -0,0 +1,157 @@
+//go:build go1.18
+// +build go1.18
+
+package scs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	Name string
+}
+
+func TestGetAs(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = testUser{Name: "alice"}
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	u, ok := GetAs[testUser](s, ctx, "foo")
+	if !ok {
+		t.Fatalf("got %v: expected %v", ok, true)
+	}
+	if u.Name != "alice" {
+		t.Errorf("got %q: expected %q", u.Name, "alice")
+	}
+
+	_, ok = GetAs[string](s, ctx, "foo")
+	if ok {
+		t.Errorf("got %v: expected %v", ok, false)
+	}
+
+	_, ok = GetAs[testUser](s, ctx, "bar")
+	if ok {
+		t.Errorf("got %v: expected %v", ok, false)
+	}
+
+	if sd.status != Unmodified {
+		t.Errorf("got %v: expected %v", sd.status, "unmodified")
+	}
+}
+
+func TestLookupAs(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = 42
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	i, err := LookupAs[int](s, ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 42 {
+		t.Errorf("got %d: expected %d", i, 42)
+	}
+
+	_, err = LookupAs[int](s, ctx, "bar")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v: expected %v", err, ErrKeyNotFound)
+	}
+
+	_, err = LookupAs[int64](s, ctx, "foo")
+	var te *TypeError
+	if !errors.As(err, &te) {
+		t.Fatalf("got %v: expected a *TypeError", err)
+	}
+	if te.Key != "foo" || te.Want != "int64" {
+		t.Errorf("got %q and %q: expected %q and %q", te.Key, te.Want, "foo", "int64")
+	}
+	if err.Error() != `scs: value for key "foo" has type int, not int64` {
+		t.Errorf("unexpected error message %q", err.Error())
+	}
+}
+
+func TestPopAs(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = "bar"
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	_, ok := PopAs[int](s, ctx, "foo")
+	if ok {
+		t.Errorf("got %v: expected %v", ok, false)
+	}
+	if _, exists := sd.values["foo"]; !exists {
+		t.Error("expected value of the wrong type to be retained")
+	}
+	if sd.status != Unmodified {
+		t.Errorf("got %v: expected %v", sd.status, "unmodified")
+	}
+
+	str, ok := PopAs[string](s, ctx, "foo")
+	if !ok {
+		t.Fatalf("got %v: expected %v", ok, true)
+	}
+	if str != "bar" {
+		t.Errorf("got %q: expected %q", str, "bar")
+	}
+	if _, exists := sd.values["foo"]; exists {
+		t.Error("expected value to be deleted")
+	}
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+}
+
+func TestPopLookupAs(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	sd.values["foo"] = 42
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	_, err := PopLookupAs[int](s, ctx, "bar")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v: expected %v", err, ErrKeyNotFound)
+	}
+
+	_, err = PopLookupAs[string](s, ctx, "foo")
+	var te *TypeError
+	if !errors.As(err, &te) {
+		t.Fatalf("got %v: expected a *TypeError", err)
+	}
+	if te.Key != "foo" || te.Want != "string" {
+		t.Errorf("got %q and %q: expected %q and %q", te.Key, te.Want, "foo", "string")
+	}
+	if _, exists := sd.values["foo"]; !exists {
+		t.Error("expected value of the wrong type to be retained")
+	}
+	if sd.status != Unmodified {
+		t.Errorf("got %v: expected %v", sd.status, "unmodified")
+	}
+
+	i, err := PopLookupAs[int](s, ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 42 {
+		t.Errorf("got %d: expected %d", i, 42)
+	}
+	if _, exists := sd.values["foo"]; exists {
+		t.Error("expected value to be deleted")
+	}
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+}
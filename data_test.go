@@ -5,10 +5,12 @@ import (
 	"context"
 	"errors"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/alexedwards/scs/v2/memstore"
 	"github.com/alexedwards/scs/v2/mockstore"
 )
 
@@ -395,6 +397,217 @@ func TestSessionManager_Commit(T *testing.T) {
 	})
 }
 
+func TestSessionManager_ConflictPolicy(T *testing.T) {
+	T.Parallel()
+
+	// loadConcurrent commits a session and then loads it into two separate
+	// contexts, simulating two concurrent requests.
+	loadConcurrent := func(t *testing.T, s *SessionManager) (context.Context, context.Context) {
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "foo", "bar")
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx1, err := s.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx2, err := s.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx1, ctx2
+	}
+
+	T.Run("last write wins", func(t *testing.T) {
+		s := New()
+
+		ctx1, ctx2 := loadConcurrent(t, s)
+		s.Put(ctx1, "baz", "qux")
+		s.Remove(ctx2, "foo")
+
+		if _, _, err := s.Commit(ctx1); err != nil {
+			t.Fatal(err)
+		}
+		token, _, err := s.Commit(ctx2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, err := s.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := s.Keys(ctx); len(keys) != 0 {
+			t.Errorf("got %v: expected no keys", keys)
+		}
+	})
+
+	T.Run("retry on conflict", func(t *testing.T) {
+		s := New()
+		s.ConflictPolicy = RetryOnConflict
+
+		ctx1, ctx2 := loadConcurrent(t, s)
+		s.Put(ctx1, "baz", "qux")
+		s.Remove(ctx2, "foo")
+
+		if _, _, err := s.Commit(ctx1); err != nil {
+			t.Fatal(err)
+		}
+		token, _, err := s.Commit(ctx2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, err := s.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := s.Keys(ctx); !reflect.DeepEqual(keys, []string{"baz"}) {
+			t.Errorf("got %v: expected %v", keys, []string{"baz"})
+		}
+	})
+
+	T.Run("error on conflict", func(t *testing.T) {
+		s := New()
+		s.ConflictPolicy = ErrorOnConflict
+
+		ctx1, ctx2 := loadConcurrent(t, s)
+		s.Put(ctx1, "baz", "qux")
+		s.Remove(ctx2, "foo")
+
+		if _, _, err := s.Commit(ctx1); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := s.Commit(ctx2)
+		if err != ErrConflict {
+			t.Errorf("got %v: expected %v", err, ErrConflict)
+		}
+	})
+
+	T.Run("error on conflict without changes", func(t *testing.T) {
+		s := New()
+		s.ConflictPolicy = ErrorOnConflict
+		s.IdleTimeout = time.Hour
+
+		ctx1, ctx2 := loadConcurrent(t, s)
+		s.Put(ctx1, "baz", "qux")
+
+		if _, _, err := s.Commit(ctx1); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.Commit(ctx2); err != nil {
+			t.Errorf("unexpected error returned: %v", err)
+		}
+		if s.GetString(ctx2, "baz") != "qux" {
+			t.Errorf("got %q: expected %q", s.GetString(ctx2, "baz"), "qux")
+		}
+	})
+}
+
+func TestSessionManager_MergeChanges(T *testing.T) {
+	T.Parallel()
+
+	// storeOnly hides any optional interfaces implemented by the underlying
+	// store, so that the read-modify-write fallback is used.
+	type storeOnly struct {
+		Store
+	}
+
+	for name, store := range map[string]func() Store{
+		"merge store": func() Store { return memstore.NewWithCleanupInterval(0) },
+		"plain store": func() Store { return storeOnly{memstore.NewWithCleanupInterval(0)} },
+	} {
+		store := store
+		T.Run(name, func(t *testing.T) {
+			s := New()
+			s.Store = store()
+			s.MergeChanges = true
+
+			ctx, err := s.Load(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Put(ctx, "foo", "bar")
+			s.Put(ctx, "baz", "qux")
+			token, _, err := s.Commit(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx1, err := s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx2, err := s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.Put(ctx1, "one", 1)
+			s.Remove(ctx2, "foo")
+			s.Put(ctx2, "two", 2)
+
+			if _, _, err := s.Commit(ctx1); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.Commit(ctx2); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, err = s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{"baz", "one", "two"}
+			if keys := s.Keys(ctx); !reflect.DeepEqual(keys, expected) {
+				t.Errorf("got %v: expected %v", keys, expected)
+			}
+
+			// A session destroyed by a concurrent request isn't brought back
+			// by a request which hasn't changed it, and only the keys changed
+			// in a request which has are kept.
+			ctx1, err = s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx2, err = s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Destroy(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			s.SetDeadline(ctx1, time.Now().Add(time.Hour))
+			if _, _, err := s.Commit(ctx1); err != nil {
+				t.Fatal(err)
+			}
+			if _, found, _ := s.Store.Find(token); found {
+				t.Error("expected destroyed session to stay deleted")
+			}
+
+			s.Put(ctx2, "three", 3)
+			if _, _, err := s.Commit(ctx2); err != nil {
+				t.Fatal(err)
+			}
+			ctx, err = s.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = []string{"three"}
+			if keys := s.Keys(ctx); !reflect.DeepEqual(keys, expected) {
+				t.Errorf("got %v: expected %v", keys, expected)
+			}
+		})
+	}
+}
+
 func TestPut(t *testing.T) {
 	t.Parallel()
 
@@ -484,6 +697,7 @@ func TestClear(t *testing.T) {
 	sd := newSessionData(time.Hour)
 	sd.values["foo"] = "bar"
 	sd.values["baz"] = "boz"
+	sd.reserved = map[string]interface{}{userIDKey: "alice", csrfKey: "secret", metadataKey: Metadata{IP: "127.0.0.1"}}
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
 	if err := s.Clear(ctx); err != nil {
@@ -498,11 +712,73 @@ func TestClear(t *testing.T) {
 		t.Errorf("got %v: expected %v", sd.values["baz"], nil)
 	}
 
+	if s.UserID(ctx) != "" {
+		t.Errorf("got %q: expected %q", s.UserID(ctx), "")
+	}
+
+	if _, exists := sd.reserved[csrfKey]; exists {
+		t.Error("expected CSRF secret to be removed")
+	}
+
+	if s.Metadata(ctx).IP != "127.0.0.1" {
+		t.Errorf("got %q: expected %q", s.Metadata(ctx).IP, "127.0.0.1")
+	}
+
 	if sd.status != Modified {
 		t.Errorf("got %v: expected %v", sd.status, "modified")
 	}
 }
 
+func TestReservedState(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.Store = memstore.NewWithCleanupInterval(0)
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	s.SetUserID(ctx, "alice")
+	s.AddFlash(ctx, FlashInfo, "hello")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reserved state is committed with the session data.
+	b, _, err := s.Store.Find(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, values, err := GobCodec{}.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[userIDKey] != "alice" {
+		t.Errorf("got %v: expected %v", values[userIDKey], "alice")
+	}
+
+	// But it is kept separate from the values once loaded.
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := s.Keys(ctx); !reflect.DeepEqual(keys, []string{"foo"}) {
+		t.Errorf("got %v: expected %v", keys, []string{"foo"})
+	}
+	if s.Exists(ctx, userIDKey) {
+		t.Error("expected user ID not to be in the values")
+	}
+	if got := s.UserID(ctx); got != "alice" {
+		t.Errorf("got %q: expected %q", got, "alice")
+	}
+	if flashes := s.PeekFlashes(ctx); len(flashes) != 1 {
+		t.Errorf("got %d: expected %d", len(flashes), 1)
+	}
+}
+
 func TestExists(t *testing.T) {
 	t.Parallel()
 
@@ -527,6 +803,7 @@ func TestKeys(t *testing.T) {
 	sd := newSessionData(time.Hour)
 	sd.values["foo"] = "bar"
 	sd.values["woo"] = "waa"
+	sd.reserved = map[string]interface{}{metadataKey: Metadata{}}
 	ctx := s.addSessionDataToContext(context.Background(), sd)
 
 	keys := s.Keys(ctx)
@@ -847,3 +1124,276 @@ func TestStatus(t *testing.T) {
 		t.Errorf("got %d: expected %d", status, Destroyed)
 	}
 }
+
+func TestUpgrade(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.Store = memstore.NewWithCleanupInterval(0)
+
+	// A session committed before any upgrade functions were registered.
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "name", "alice")
+	oldToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []int
+	s.Upgrade(0, func(values map[string]interface{}) error {
+		calls = append(calls, 0)
+		values["username"] = values["name"]
+		delete(values, "name")
+		return nil
+	})
+	s.Upgrade(2, func(values map[string]interface{}) error {
+		calls = append(calls, 2)
+		values["username"] = strings.ToUpper(values["username"].(string))
+		return nil
+	})
+
+	ctx, err = s.Load(context.Background(), oldToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "username"); got != "ALICE" {
+		t.Errorf("got %q: expected %q", got, "ALICE")
+	}
+	if s.Exists(ctx, "name") {
+		t.Error("expected old key to be removed")
+	}
+	if !reflect.DeepEqual(calls, []int{0, 2}) {
+		t.Errorf("got %v: expected %v", calls, []int{0, 2})
+	}
+	if status := s.Status(ctx); status != Modified {
+		t.Errorf("got %d: expected %d", status, Modified)
+	}
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once committed, the session data isn't upgraded again.
+	calls = nil
+	ctx, err = s.Load(context.Background(), oldToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "username"); got != "ALICE" {
+		t.Errorf("got %q: expected %q", got, "ALICE")
+	}
+	if len(calls) != 0 {
+		t.Errorf("got %v: expected no upgrades", calls)
+	}
+	if status := s.Status(ctx); status != Unmodified {
+		t.Errorf("got %d: expected %d", status, Unmodified)
+	}
+
+	// New sessions are committed with the current schema version.
+	ctx, err = s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "username", "bob")
+	newToken, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), newToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "username"); got != "bob" {
+		t.Errorf("got %q: expected %q", got, "bob")
+	}
+	if len(calls) != 0 {
+		t.Errorf("got %v: expected no upgrades", calls)
+	}
+
+	// Errors from upgrade functions are returned by Load.
+	if err := s.Store.Commit("failing_token", mustEncode(t, map[string]interface{}{schemaVersionKey: 2}), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	s.upgrades[2] = func(values map[string]interface{}) error {
+		return errors.New("boom")
+	}
+	if _, err := s.Load(context.Background(), "failing_token"); err == nil {
+		t.Error("expected error from upgrade function")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic registering a duplicate upgrade")
+		}
+	}()
+	s.Upgrade(0, func(values map[string]interface{}) error { return nil })
+}
+
+func TestUpgradeCodec(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.Store = memstore.NewWithCleanupInterval(0)
+
+	// A session encoded by a different codec before any upgrades were
+	// registered.
+	b, err := (&JSONCodec{}).Encode(time.Now().Add(time.Hour), map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store.Commit("json_token", b, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	s.UpgradeCodec(0, &JSONCodec{})
+	s.Upgrade(0, func(values map[string]interface{}) error {
+		calls++
+		values["username"] = values["name"]
+		delete(values, "name")
+		return nil
+	})
+
+	ctx, err := s.Load(context.Background(), "json_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "username"); got != "alice" {
+		t.Errorf("got %q: expected %q", got, "alice")
+	}
+	if calls != 1 {
+		t.Errorf("got %d: expected %d", calls, 1)
+	}
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The schema version is recorded in a header, and the rest of the data is
+	// encoded by the Codec without it.
+	b, found, err := s.Store.Find("json_token")
+	if err != nil || !found {
+		t.Fatalf("got %v, %v: expected session data", found, err)
+	}
+	if h := schemaVersionHeader + "\x01"; string(b[:len(h)]) != h {
+		t.Errorf("got header %q: expected %q", b[:len(h)], h)
+	}
+	_, values, err := GobCodec{}.Decode(b[len(schemaVersionHeader)+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, map[string]interface{}{"username": "alice"}) {
+		t.Errorf("got %v: expected %v", values, map[string]interface{}{"username": "alice"})
+	}
+
+	calls = 0
+	ctx, err = s.Load(context.Background(), "json_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "username"); got != "alice" {
+		t.Errorf("got %q: expected %q", got, "alice")
+	}
+	if calls != 0 {
+		t.Errorf("got %d: expected no upgrades", calls)
+	}
+
+	// Session data with a newer schema version keeps it when it is committed.
+	b, err = GobCodec{}.Encode(time.Now().Add(time.Hour), map[string]interface{}{"username": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store.Commit("newer_token", append([]byte(schemaVersionHeader+"\x05"), b...), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, err = s.Load(context.Background(), "newer_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	if _, _, err := s.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b, _, err = s.Store.Find("newer_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := schemaVersionHeader + "\x05"; string(b[:len(h)]) != h {
+		t.Errorf("got header %q: expected %q", b[:len(h)], h)
+	}
+
+	// A truncated header is an error.
+	if err := s.Store.Commit("invalid_token", []byte(schemaVersionHeader), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(context.Background(), "invalid_token"); err != errInvalidSchemaVersion {
+		t.Errorf("got %v: expected %v", err, errInvalidSchemaVersion)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic registering a duplicate codec")
+		}
+	}()
+	s.UpgradeCodec(0, GobCodec{})
+}
+
+// prefixCodec is a Codec whose encoded data starts with the same byte as the
+// schema version header.
+type prefixCodec struct{}
+
+func (prefixCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	b, err := GobCodec{}.Encode(deadline, values)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{0xb0, 0x01}, b...), nil
+}
+
+func (prefixCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	if len(b) < 2 || b[0] != 0xb0 || b[1] != 0x01 {
+		return time.Time{}, nil, errors.New("missing prefix")
+	}
+	return GobCodec{}.Decode(b[2:])
+}
+
+func TestSchemaVersionHeaderPrefix(t *testing.T) {
+	t.Parallel()
+
+	for _, upgrades := range []bool{false, true} {
+		s := New()
+		s.Store = memstore.NewWithCleanupInterval(0)
+		s.Codec = prefixCodec{}
+
+		b, err := prefixCodec{}.Encode(time.Now().Add(time.Hour), map[string]interface{}{"foo": "bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Store.Commit("prefixed_token", b, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if upgrades {
+			s.Upgrade(0, func(values map[string]interface{}) error { return nil })
+		}
+
+		ctx, err := s.Load(context.Background(), "prefixed_token")
+		if err != nil {
+			t.Fatalf("upgrades %v: %v", upgrades, err)
+		}
+		if got := s.GetString(ctx, "foo"); got != "bar" {
+			t.Errorf("upgrades %v: got %q: expected %q", upgrades, got, "bar")
+		}
+	}
+}
+
+func mustEncode(t *testing.T, values map[string]interface{}) []byte {
+	t.Helper()
+
+	b, err := GobCodec{}.Encode(time.Now().Add(time.Hour), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,397 @@
+package scs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrDecryptionFailed is returned by EncryptingCodec when session data can't
+// be decrypted, because it has been tampered with, was encrypted with a key
+// which isn't in the keyring or (if BindToken is set) was copied from a
+// different session.
+var ErrDecryptionFailed = errors.New("scs: session data could not be decrypted")
+
+// Keyring holds the keys used by EncryptingCodec. One key is active and is
+// used to encrypt session data; the others are only used to decrypt session
+// data which was encrypted before the active key was changed. Each key is
+// identified by a number which is recorded alongside the encrypted data.
+//
+// To rotate keys, add the new key with AddKey and make it active with
+// SetActive. Once all sessions have been re-encrypted with the new key (see
+// SessionManager.ReEncrypt) or have expired, the old key can be removed with
+// RemoveKey.
+//
+// A Keyring is safe for concurrent use.
+type Keyring struct {
+	mu       sync.RWMutex
+	activeID uint32
+	keys     map[uint32]cipher.AEAD
+}
+
+// NewKeyring returns a new Keyring with the given active key. Keys must be 32
+// bytes long, for AES-256.
+func NewKeyring(activeID uint32, activeKey []byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	if err := k.AddKey(activeID, activeKey); err != nil {
+		return nil, err
+	}
+	k.activeID = activeID
+	return k, nil
+}
+
+// AddKey adds a key to the keyring. It is only used to decrypt session data
+// until it is made active with SetActive. The key must be 32 bytes long.
+func (k *Keyring) AddKey(id uint32, key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("scs: encryption key %d must be 32 bytes long, not %d", id, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("scs: encryption key %d is already in the keyring", id)
+	}
+	k.keys[id] = aead
+	return nil
+}
+
+// SetActive makes the key with the given ID the active key, which is used to
+// encrypt session data. The previously active key is kept for decryption.
+func (k *Keyring) SetActive(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("scs: encryption key %d is not in the keyring", id)
+	}
+	k.activeID = id
+	return nil
+}
+
+// RemoveKey removes the key with the given ID from the keyring. Sessions which
+// are still encrypted with it can no longer be decrypted. The active key can't
+// be removed.
+func (k *Keyring) RemoveKey(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if id == k.activeID {
+		return fmt.Errorf("scs: encryption key %d is active and can't be removed", id)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// ActiveKeyID returns the ID of the active key.
+func (k *Keyring) ActiveKeyID() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.activeID
+}
+
+func (k *Keyring) active() (uint32, cipher.AEAD) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.activeID, k.keys[k.activeID]
+}
+
+func (k *Keyring) key(id uint32) (cipher.AEAD, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead, ok := k.keys[id]
+	return aead, ok
+}
+
+// Encrypted session data starts with a header containing a version byte and
+// the ID of the key that it was encrypted with. The low bit of the version
+// byte is set if the data is bound to the session token. Bytes in this range
+// are never the first byte of data encoded by GobCodec or CompressingCodec.
+const (
+	encryptionHeader      byte = 0xd0
+	encryptionHeaderBound byte = 0xd1
+	encryptionHeaderLen        = 5
+)
+
+// EncryptingCodec is a Codec which wraps another Codec and encrypts the
+// encoded session data with AES-256-GCM, using the active key in its Keyring.
+// The ID of the key is recorded with the encrypted data, so that data
+// encrypted with an older key can still be decrypted after the active key is
+// changed.
+//
+// If you are also using CompressingCodec, it should be wrapped by the
+// EncryptingCodec rather than the other way round, because encrypted data
+// doesn't compress.
+type EncryptingCodec struct {
+	// Codec is the wrapped Codec. If it is nil, GobCodec is used.
+	Codec Codec
+
+	// Keyring holds the encryption keys. It must not be nil.
+	Keyring *Keyring
+
+	// BindToken controls whether the encrypted session data is bound to the
+	// key that it is stored under in the session store. If it is set, session
+	// data copied from one session to another in the store can't be
+	// decrypted, and neither can session data which isn't bound, unless
+	// AllowUnbound is set. BindToken has no effect if the session store is a
+	// ClientStore.
+	BindToken bool
+
+	// AllowPlaintext controls whether session data which isn't encrypted is
+	// decoded. It can be set temporarily when you enable encryption, so that
+	// existing sessions are still valid until they are re-encrypted.
+	AllowPlaintext bool
+
+	// AllowUnbound controls whether session data which was encrypted before
+	// BindToken was set, and so isn't bound to a key, is decrypted when
+	// BindToken is set. It can be set temporarily when you enable BindToken,
+	// so that existing sessions are still valid until they are re-encrypted.
+	AllowUnbound bool
+}
+
+func (c EncryptingCodec) codec() Codec {
+	if c.Codec == nil {
+		return GobCodec{}
+	}
+	return c.Codec
+}
+
+// Encode converts a session deadline and values into a byte slice, using the
+// wrapped Codec, and encrypts it. The data isn't bound to a session token.
+func (c EncryptingCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	return c.EncodeToken("", deadline, values)
+}
+
+// Decode decrypts a byte slice and converts it into a session deadline and
+// values using the wrapped Codec.
+func (c EncryptingCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	return c.DecodeToken("", b)
+}
+
+// EncodeToken is the same as Encode, except that if BindToken is set the
+// encrypted data is bound to the given key.
+func (c EncryptingCodec) EncodeToken(key string, deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	b, err := c.codec().Encode(deadline, values)
+	if err != nil {
+		return nil, err
+	}
+
+	id, aead := c.Keyring.active()
+
+	out := make([]byte, encryptionHeaderLen+aead.NonceSize(), encryptionHeaderLen+aead.NonceSize()+len(b)+aead.Overhead())
+	out[0] = encryptionHeader
+	if c.BindToken && key != "" {
+		out[0] = encryptionHeaderBound
+	} else {
+		key = ""
+	}
+	binary.BigEndian.PutUint32(out[1:encryptionHeaderLen], id)
+
+	nonce := out[encryptionHeaderLen:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, nonce, b, additionalData(out[:encryptionHeaderLen], key)), nil
+}
+
+// DecodeToken is the same as Decode, except that session data which is bound
+// to a key is only decrypted if it is bound to the given key. If BindToken is
+// set, session data which isn't bound is only decrypted if AllowUnbound is
+// set.
+func (c EncryptingCodec) DecodeToken(key string, b []byte) (time.Time, map[string]interface{}, error) {
+	if !encrypted(b) {
+		if c.AllowPlaintext {
+			return c.codec().Decode(b)
+		}
+		return time.Time{}, nil, ErrDecryptionFailed
+	}
+
+	aead, ok := c.Keyring.key(binary.BigEndian.Uint32(b[1:encryptionHeaderLen]))
+	if !ok || len(b) < encryptionHeaderLen+aead.NonceSize() {
+		return time.Time{}, nil, ErrDecryptionFailed
+	}
+
+	header := b[:encryptionHeaderLen]
+	nonce := b[encryptionHeaderLen : encryptionHeaderLen+aead.NonceSize()]
+	ciphertext := b[encryptionHeaderLen+aead.NonceSize():]
+	if header[0] != encryptionHeaderBound {
+		if c.BindToken && key != "" && !c.AllowUnbound {
+			return time.Time{}, nil, ErrDecryptionFailed
+		}
+		key = ""
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData(header, key))
+	if err != nil {
+		return time.Time{}, nil, ErrDecryptionFailed
+	}
+
+	return c.codec().Decode(plaintext)
+}
+
+// needsReEncrypt reports whether the encrypted session data b should be
+// re-encrypted because it isn't encrypted, or was encrypted with a key which
+// isn't active, or its binding to the session token doesn't match BindToken.
+// The data may start with a schema version header, which is skipped.
+func (c EncryptingCodec) needsReEncrypt(b []byte) bool {
+	if _, rest, err := splitSchemaVersion(b); err == nil {
+		b = rest
+	}
+	if !encrypted(b) {
+		return true
+	}
+	if binary.BigEndian.Uint32(b[1:encryptionHeaderLen]) != c.Keyring.ActiveKeyID() {
+		return true
+	}
+	return (b[0] == encryptionHeaderBound) != c.BindToken
+}
+
+// newAEAD returns an AES-GCM cipher with the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypted(b []byte) bool {
+	return len(b) >= encryptionHeaderLen && (b[0] == encryptionHeader || b[0] == encryptionHeaderBound)
+}
+
+// additionalData returns the data which is authenticated, but not encrypted,
+// with the session data: the header and, if the data is bound to the session
+// token, the key that it is stored under.
+func additionalData(header []byte, key string) []byte {
+	if key == "" {
+		return header
+	}
+	ad := make([]byte, 0, len(header)+len(key))
+	ad = append(ad, header...)
+	return append(ad, key...)
+}
+
+// ReEncrypt re-encrypts the session data for every session in the store which
+// isn't encrypted with the active key of the EncryptingCodec's Keyring. It
+// returns the number of sessions which were re-encrypted. Once it has
+// finished, keys which are no longer active can be removed from the keyring.
+//
+// It also encrypts any session data which isn't encrypted yet (if
+// AllowPlaintext is set), and binds or unbinds session data to match the
+// BindToken setting (binding requires AllowUnbound to be set).
+//
+// The Codec must be an EncryptingCodec and the session store must support
+// iteration, otherwise an error is returned. If TokenEncryption is enabled,
+// sessions can only be re-encrypted if they have an escrowed key.
+//
+// If the store supports optimistic concurrency control (VersionedStore) then
+// sessions which are changed by a concurrent request are skipped, because they
+// have already been re-encrypted. Otherwise changes made by a concurrent
+// request may be lost. If an idle timeout is being used, re-encrypted sessions
+// have their expiry time extended.
+func (s *SessionManager) ReEncrypt(ctx context.Context) (int, error) {
+	var ec EncryptingCodec
+	switch c := s.Codec.(type) {
+	case EncryptingCodec:
+		ec = c
+	case *EncryptingCodec:
+		ec = *c
+	default:
+		return 0, fmt.Errorf("scs: ReEncrypt requires an EncryptingCodec, not %T", s.Codec)
+	}
+
+	switch s.Store.(type) {
+	case IterableCtxStore, IterableStore:
+	default:
+		return 0, fmt.Errorf("scs: type %T does not support iteration", s.Store)
+	}
+
+	allSessions, err := s.doStoreAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for key, b := range allSessions {
+		inner, _, err := s.unsealStored(b)
+		if s.skipStored(err) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if !ec.needsReEncrypt(inner) {
+			continue
+		}
+
+		ok, err := s.reEncrypt(ctx, ec, key, b)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *SessionManager) reEncrypt(ctx context.Context, ec EncryptingCodec, key string, b []byte) (bool, error) {
+	var version int64
+	versioned := false
+	switch s.Store.(type) {
+	case VersionedCtxStore, VersionedStore:
+		versioned = true
+	}
+
+	if versioned {
+		var found bool
+		var err error
+		b, version, found, err = s.doStoreFindVersionKey(ctx, key)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+
+	// If TokenEncryption is enabled, the data encryption key recovered from
+	// the escrow is used to encrypt the session data again.
+	inner, dataKey, err := s.unsealStored(b)
+	if err != nil || !ec.needsReEncrypt(inner) {
+		return false, err
+	}
+
+	deadline, values, err := s.codecDecode(ctx, key, inner)
+	if err != nil {
+		return false, err
+	}
+	b, err = s.codecEncode(ctx, key, deadline, values)
+	if err != nil {
+		return false, err
+	}
+	if dataKey != nil {
+		if b, err = s.TokenEncryption.seal(dataKey, b); err != nil {
+			return false, err
+		}
+	}
+
+	if versioned {
+		_, committed, err := s.doStoreCompareAndCommitKey(ctx, key, b, s.expiry(deadline), version)
+		return committed, err
+	}
+	return true, s.doStoreCommitKey(ctx, key, b, s.expiry(deadline))
+}
@@ -0,0 +1,429 @@
+package scs
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2/memstore"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryptingCodec(t *testing.T) {
+	t.Parallel()
+
+	keyring, err := NewKeyring(1, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := EncryptingCodec{Keyring: keyring}
+
+	deadline := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	values := map[string]interface{}{"secret": "plaintext value"}
+
+	b, err := codec.Encode(deadline, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("plaintext value")) {
+		t.Error("encoded data contains plaintext")
+	}
+
+	b2, err := codec.Encode(deadline, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(b, b2) {
+		t.Error("encoding the same data twice gave the same ciphertext")
+	}
+
+	gotDeadline, gotValues, err := codec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotDeadline.Equal(deadline) || !reflect.DeepEqual(gotValues, values) {
+		t.Errorf("got %v %v: expected %v %v", gotDeadline, gotValues, deadline, values)
+	}
+
+	tampered := append([]byte(nil), b...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := codec.Decode(tampered); err != ErrDecryptionFailed {
+		t.Errorf("got %v: expected %v", err, ErrDecryptionFailed)
+	}
+
+	plaintext, err := GobCodec{}.Encode(deadline, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := codec.Decode(plaintext); err != ErrDecryptionFailed {
+		t.Errorf("got %v: expected %v", err, ErrDecryptionFailed)
+	}
+	codec.AllowPlaintext = true
+	if _, gotValues, err := codec.Decode(plaintext); err != nil || !reflect.DeepEqual(gotValues, values) {
+		t.Errorf("got %v %v: expected %v", gotValues, err, values)
+	}
+
+	// Rotate the key. Data encrypted with the old key can still be decrypted
+	// until the old key is removed.
+	if err := keyring.AddKey(2, testKey(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.SetActive(2); err != nil {
+		t.Fatal(err)
+	}
+	if !codec.needsReEncrypt(b) {
+		t.Error("expected data encrypted with old key to need re-encrypting")
+	}
+	if _, _, err := codec.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.RemoveKey(2); err == nil {
+		t.Error("expected error removing active key")
+	}
+	if err := keyring.RemoveKey(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := codec.Decode(b); err != ErrDecryptionFailed {
+		t.Errorf("got %v: expected %v", err, ErrDecryptionFailed)
+	}
+
+	if _, err := NewKeyring(1, testKey(1)[:16]); err == nil {
+		t.Error("expected error for short key")
+	}
+	if err := keyring.AddKey(2, testKey(3)); err == nil {
+		t.Error("expected error for duplicate key ID")
+	}
+}
+
+func TestEncryptingCodecBindToken(t *testing.T) {
+	t.Parallel()
+
+	keyring, err := NewKeyring(1, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := memstore.NewWithCleanupInterval(0)
+
+	s := New()
+	s.Store = store
+	s.HashTokenInStore = true
+	s.Codec = EncryptingCodec{Keyring: keyring, BindToken: true}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	token, expiry, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "foo"); got != "bar" {
+		t.Errorf("got %q: expected %q", got, "bar")
+	}
+
+	// Copy the encrypted data to a different session.
+	b, _, err := store.Find(hashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Commit(hashToken("other_token"), b, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(context.Background(), "other_token"); err != ErrDecryptionFailed {
+		t.Errorf("got %v: expected %v", err, ErrDecryptionFailed)
+	}
+
+	// Session data which isn't bound is rejected unless AllowUnbound is set,
+	// and is bound by ReEncrypt.
+	b, err = EncryptingCodec{Keyring: keyring}.Encode(expiry, map[string]interface{}{"foo": "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Commit(hashToken("unbound_token"), b, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(context.Background(), "unbound_token"); err != ErrDecryptionFailed {
+		t.Errorf("got %v: expected %v", err, ErrDecryptionFailed)
+	}
+
+	s.Codec = EncryptingCodec{Keyring: keyring, BindToken: true, AllowUnbound: true}
+	ctx, err = s.Load(context.Background(), "unbound_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "foo"); got != "baz" {
+		t.Errorf("got %q: expected %q", got, "baz")
+	}
+	n, err := s.ReEncrypt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d: expected %d", n, 1)
+	}
+
+	s.Codec = EncryptingCodec{Keyring: keyring, BindToken: true}
+	ctx, err = s.Load(context.Background(), "unbound_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "foo"); got != "baz" {
+		t.Errorf("got %q: expected %q", got, "baz")
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	t.Parallel()
+
+	keyring, err := NewKeyring(1, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New()
+	s.Store = memstore.NewWithCleanupInterval(0)
+	s.Codec = EncryptingCodec{Keyring: keyring, BindToken: true, AllowPlaintext: true}
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		ctx, err := s.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(ctx, "n", i)
+		token, _, err := s.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	// A session stored before encryption was enabled.
+	b, err := GobCodec{}.Encode(time.Now().Add(time.Hour), map[string]interface{}{"n": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store.Commit("plaintext_token", b, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	tokens = append(tokens, "plaintext_token")
+
+	if err := keyring.AddKey(2, testKey(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.SetActive(2); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.ReEncrypt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("got %d: expected %d", n, 4)
+	}
+
+	n, err = s.ReEncrypt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("got %d: expected %d", n, 0)
+	}
+
+	if err := keyring.RemoveKey(1); err != nil {
+		t.Fatal(err)
+	}
+	s.Codec = EncryptingCodec{Keyring: keyring, BindToken: true}
+	for i, token := range tokens {
+		ctx, err := s.Load(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.GetInt(ctx, "n"); got != i {
+			t.Errorf("got %d: expected %d", got, i)
+		}
+	}
+
+	s.Codec = GobCodec{}
+	if _, err := s.ReEncrypt(context.Background()); err == nil {
+		t.Error("expected error for codec which isn't an EncryptingCodec")
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	t.Parallel()
+
+	// RFC 5869, test case 3.
+	got := hkdfSHA256(bytes.Repeat([]byte{0x0b}, 22), nil, 42)
+	expected := "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8"
+	if hex.EncodeToString(got) != expected {
+		t.Errorf("got %x: expected %s", got, expected)
+	}
+}
+
+func TestTokenEncryption(t *testing.T) {
+	t.Parallel()
+
+	store := memstore.NewWithCleanupInterval(0)
+
+	s := New()
+	s.Store = store
+	s.HashTokenInStore = true
+	s.TokenEncryption = &TokenEncryption{}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "secret value")
+	token, expiry, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, found, err := store.Find(hashToken(token))
+	if err != nil || !found {
+		t.Fatalf("got %v %v: expected session in store", found, err)
+	}
+	if b[0] != tokenSealHeader || bytes.Contains(b, []byte("secret value")) {
+		t.Errorf("session data in store is not encrypted: %q", b)
+	}
+	if _, _, err := s.Codec.Decode(b); err == nil {
+		t.Error("expected error decoding session data without the token")
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "foo"); got != "secret value" {
+		t.Errorf("got %q: expected %q", got, "secret value")
+	}
+
+	// Without an escrow key, Iterate can't decrypt the session data.
+	noop := func(ctx context.Context) error { return nil }
+	if err := s.Iterate(context.Background(), noop); err != ErrTokenRequired {
+		t.Errorf("got %v: expected %v", err, ErrTokenRequired)
+	}
+	s.TokenEncryption.SkipWithoutEscrow = true
+	if err := s.Iterate(context.Background(), noop); err != nil {
+		t.Fatal(err)
+	}
+
+	// Session data copied to a different session can't be decrypted.
+	if err := store.Commit(hashToken("other_token"), b, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(context.Background(), "other_token"); err != ErrDecryptionFailed {
+		t.Errorf("got %v: expected %v", err, ErrDecryptionFailed)
+	}
+
+	s.HashTokenInStore = false
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected LoadAndSave to panic without HashTokenInStore")
+			}
+		}()
+		s.LoadAndSave(http.NotFoundHandler())
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected Load to panic without HashTokenInStore")
+			}
+		}()
+		s.Load(context.Background(), token)
+	}()
+}
+
+func TestTokenEncryptionEscrow(t *testing.T) {
+	t.Parallel()
+
+	escrow, err := NewKeyring(1, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewKeyring(1, testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New()
+	s.Store = memstore.NewWithCleanupInterval(0)
+	s.HashTokenInStore = true
+	s.TokenEncryption = &TokenEncryption{Escrow: escrow}
+	s.Codec = EncryptingCodec{Keyring: keyring}
+
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "foo", "bar")
+	s.SetUserID(ctx, "alice")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = s.Iterate(context.Background(), func(ctx context.Context) error {
+		got = append(got, s.GetString(ctx, "foo"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []string{"bar"}) {
+		t.Errorf("got %v: expected %v", got, []string{"bar"})
+	}
+
+	tokens, err := s.ListUserSessions(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Errorf("got %d sessions: expected 1", len(tokens))
+	}
+
+	// ReEncrypt uses the escrowed data key, so the session can still be loaded
+	// with the token afterwards.
+	if err := keyring.AddKey(2, testKey(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.SetActive(2); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.ReEncrypt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d: expected %d", n, 1)
+	}
+	if err := keyring.RemoveKey(1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetString(ctx, "foo"); got != "bar" {
+		t.Errorf("got %q: expected %q", got, "bar")
+	}
+}
@@ -0,0 +1,196 @@
+package scs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// fingerprintKey is the reserved session data key that the fingerprint a
+// session is bound to is stored under.
+const fingerprintKey = "__fingerprint"
+
+// FingerprintPolicy controls what happens when a session is loaded by a
+// request whose fingerprint doesn't match the one the session is bound to.
+type FingerprintPolicy int
+
+const (
+	// DestroyOnMismatch indicates that the session should be destroyed, as if
+	// Destroy had been called. The rest of the request will use a new, empty
+	// session.
+	DestroyOnMismatch FingerprintPolicy = iota
+
+	// NewSessionOnMismatch indicates that the request should use a new, empty
+	// session. The existing session is left in the store, so the client it is
+	// bound to can carry on using it.
+	NewSessionOnMismatch
+
+	// HookOnMismatch indicates that the session should be used as normal, and
+	// it is up to the OnFingerprintMismatch hook to take any action.
+	HookOnMismatch
+)
+
+// UserAgentFingerprint is a fingerprint function for use with the Fingerprint
+// field. It returns a SHA-256 hash of the User-Agent header of the request.
+func UserAgentFingerprint(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.UserAgent()))
+	return hex.EncodeToString(sum[:])
+}
+
+// IPPrefixFingerprint is a fingerprint function for use with the Fingerprint
+// field. It returns the network prefix of the client IP address in
+// http.Request.RemoteAddr, which is the /24 prefix for IPv4 addresses and the
+// /64 prefix for IPv6 addresses. If your application is behind a proxy, you
+// should use middleware which sets RemoteAddr to the real client IP address
+// before LoadAndSave is called.
+func IPPrefixFingerprint(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// TLSClientCertFingerprint is a fingerprint function for use with the
+// Fingerprint field. It returns a SHA-256 hash of the TLS client certificate
+// presented with the request, or the empty string "" if there is none.
+func TLSClientCertFingerprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CombineFingerprints returns a fingerprint function for use with the
+// Fingerprint field which combines the results of all the given fingerprint
+// functions, so that a session only matches if all of them match.
+func CombineFingerprints(fns ...func(r *http.Request) string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		parts := make([]string, len(fns))
+		for i, fn := range fns {
+			parts[i] = fn(r)
+		}
+		return strings.Join(parts, "|")
+	}
+}
+
+// Rebind binds the session to the fingerprint of the current request,
+// replacing the fingerprint it was bound to before. The session data status
+// will be set to Modified. This is useful after RenewToken, for example when a
+// user logs in again from a new network. It is a no-op unless the Fingerprint
+// field is set and the session was loaded by the LoadAndSave middleware.
+func (s *SessionManager) Rebind(ctx context.Context) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !sd.bindFingerprint {
+		return
+	}
+
+	sd.setReserved(fingerprintKey, sd.fingerprint)
+	sd.status = Modified
+}
+
+// newLoadRequest returns the details of the request which are used when
+// loading session data in the LoadAndSave middleware.
+func (s *SessionManager) newLoadRequest(r *http.Request) *loadRequest {
+	req := &loadRequest{}
+	if s.Fingerprint != nil {
+		req.fingerprint = s.Fingerprint(r)
+		req.bindFingerprint = true
+	}
+	return req
+}
+
+// bindRequest records the fingerprint of the request in the session data in
+// ctx, so that it can be checked against the fingerprint the session is bound
+// to. If the session data has been loaded lazily and not yet accessed, the
+// check is deferred until it is.
+func (s *SessionManager) bindRequest(ctx context.Context, req *loadRequest) error {
+	if !req.bindFingerprint {
+		return nil
+	}
+
+	sd := s.getPendingSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	sd.fingerprint = req.fingerprint
+	sd.bindFingerprint = true
+	pending := sd.pending
+	sd.mu.Unlock()
+
+	if pending {
+		return nil
+	}
+	return s.checkFingerprint(ctx, sd)
+}
+
+// checkFingerprint checks that the session data is bound to the fingerprint of
+// the current request, and applies the FingerprintPolicy if not. Sessions
+// which were created before the Fingerprint field was set are bound to the
+// fingerprint of the current request.
+func (s *SessionManager) checkFingerprint(ctx context.Context, sd *sessionData) error {
+	sd.mu.Lock()
+
+	if !sd.bindFingerprint || sd.token == "" {
+		sd.mu.Unlock()
+		return nil
+	}
+
+	stored, ok := sd.reserved[fingerprintKey].(string)
+	if !ok {
+		sd.setReserved(fingerprintKey, sd.fingerprint)
+		sd.status = Modified
+		sd.mu.Unlock()
+		return nil
+	}
+
+	token := sd.token
+	matches := stored == sd.fingerprint
+	sd.mu.Unlock()
+
+	if matches {
+		return nil
+	}
+
+	s.logger().Warn("scs: session fingerprint mismatch", s.logAttrs("Fingerprint", token)...)
+
+	if s.Hooks.OnFingerprintMismatch != nil {
+		s.Hooks.OnFingerprintMismatch(ctx, token)
+	}
+
+	switch s.FingerprintPolicy {
+	case DestroyOnMismatch:
+		return s.Destroy(ctx)
+	case NewSessionOnMismatch:
+		fresh := newSessionData(s.Lifetime)
+
+		sd.mu.Lock()
+		sd.deadline = fresh.deadline
+		sd.status = fresh.status
+		sd.token = fresh.token
+		sd.values = fresh.values
+		sd.version = 0
+		sd.stored = false
+		sd.touch = false
+		sd.bindUser = false
+		sd.resetChanges()
+		sd.mu.Unlock()
+	}
+
+	return nil
+}
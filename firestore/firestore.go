@@ -3,6 +3,7 @@ package firestore
 import (
 	"context"
 	"log"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
@@ -14,8 +15,13 @@ import (
 // FireStore represents the session store.
 type FireStore struct {
 	*firestore.Client
-	Sessions    *firestore.CollectionRef
-	stopCleanup chan bool
+	Sessions       *firestore.CollectionRef
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
 }
 
 type sessionDoc struct {
@@ -23,6 +29,30 @@ type sessionDoc struct {
 	Expiry time.Time
 }
 
+// Config contains the settings for a FireStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by FireStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
+}
+
 // New returns a new FireStore instance, with a background cleanup goroutine
 // that runs every 5 minutes to remove expired session data.
 func New(client *firestore.Client) *FireStore {
@@ -34,14 +64,20 @@ func New(client *firestore.Client) *FireStore {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(client *firestore.Client, cleanupInterval time.Duration) *FireStore {
+	return NewWithConfig(client, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new FireStore instance with the settings in cfg.
+func NewWithConfig(client *firestore.Client, cfg Config) *FireStore {
 	m := &FireStore{
-		Client:   client,
-		Sessions: client.Collection("Sessions"),
+		Client:         client,
+		Sessions:       client.Collection("Sessions"),
+		logger:         cfg.Logger,
+		onCleanupError: cfg.OnCleanupError,
 	}
 
-	if cleanupInterval > 0 {
-		m.stopCleanup = make(chan bool)
-		go m.startCleanup(cleanupInterval)
+	if cfg.CleanupInterval > 0 {
+		m.startCleanup(cfg.CleanupInterval)
 	}
 
 	return m
@@ -112,58 +148,128 @@ func (m *FireStore) AllCtx(ctx context.Context) (map[string][]byte, error) {
 	return sessions, nil
 }
 
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
 func (m *FireStore) startCleanup(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			err := m.deleteExpired()
-			if err != nil {
-				log.Println(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stopCleanup = cancel
+	m.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(m.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := m.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					m.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-m.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the FireStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (m *FireStore) RunCleanup(ctx context.Context) error {
+	n, err := m.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		m.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the FireStore
-// instance. It's rare to terminate this; generally FireStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the FireStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the FireStore is transient.
-// An example is creating a new FireStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// MySQLStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally FireStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the FireStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the FireStore object from
+// being garbage collected unless you call Close.
+func (m *FireStore) Close(ctx context.Context) error {
+	if m.stopCleanup == nil {
+		return nil
+	}
+	m.stopCleanup()
+
+	select {
+	case <-m.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the FireStore
+// instance. It is equivalent to calling Close with context.Background().
 func (m *FireStore) StopCleanup() {
-	if m.stopCleanup != nil {
-		m.stopCleanup <- true
+	m.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (m *FireStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return m.stats.get()
+}
+
+func (m *FireStore) reportCleanupError(err error) {
+	if m.logger == nil {
+		log.Println(err)
+	} else {
+		m.logger.Error("firestore: cleanup failed", "store", "firestore", "operation", "cleanup", "error", err)
+	}
+
+	if m.onCleanupError != nil {
+		m.onCleanupError(err)
 	}
 }
 
-func (m *FireStore) deleteExpired() error {
-	ctx := context.Background()
+func (m *FireStore) deleteExpired(ctx context.Context) (int64, error) {
 	iter := m.Sessions.Where("Expiry", "<", time.Now()).Documents(ctx)
+	defer iter.Stop()
+
+	var (
+		deleted  int64
+		firstErr error
+	)
 	for {
 		snap, err := iter.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			log.Printf("Failed to iterate: %v", err)
-			break
+			return deleted, err
 		}
 		_, err = snap.Ref.Delete(ctx, firestore.LastUpdateTime(snap.UpdateTime))
 		if err != nil {
-			log.Printf("Failed to delete: %v", err)
+			// The session was updated after it was read, so it may no longer
+			// have expired.
+			if status.Code(err) == codes.FailedPrecondition {
+				continue
+			}
+			// Carry on deleting the other expired sessions, and report the
+			// first error once they're done.
+			if firstErr == nil {
+				firstErr = err
+			}
 			continue
 		}
+		deleted++
 	}
-	iter.Stop()
-	return nil
+	return deleted, firstErr
 }
 
 // We have to add the plain Store methods here to be recognized a Store
@@ -179,3 +285,29 @@ func (m *FireStore) Commit(token string, b []byte, expiry time.Time) error {
 func (m *FireStore) Delete(token string) error {
 	panic("missing context arg")
 }
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
+}
@@ -0,0 +1,97 @@
+package scs
+
+import (
+	"context"
+	"encoding/gob"
+)
+
+// flashKey is the reserved session data key that flash messages are stored
+// under.
+const flashKey = "__flashes"
+
+func init() {
+	gob.Register([]Flash{})
+}
+
+// FlashLevel represents the severity of a flash message.
+type FlashLevel string
+
+const (
+	// FlashInfo is the level for informational flash messages.
+	FlashInfo FlashLevel = "info"
+
+	// FlashSuccess is the level for flash messages which report that an
+	// operation was successful.
+	FlashSuccess FlashLevel = "success"
+
+	// FlashWarning is the level for flash messages which warn the user.
+	FlashWarning FlashLevel = "warning"
+
+	// FlashError is the level for flash messages which report an error.
+	FlashError FlashLevel = "error"
+)
+
+// Flash is a one-time message which is stored in the session data until it is
+// displayed to the user.
+type Flash struct {
+	Level   FlashLevel
+	Message string
+
+	// Data holds an optional structured payload. If you are using the default
+	// GobCodec and Data is a custom type, the type must be registered with
+	// the encoding/gob package. If you are using JSONCodec, Data is decoded
+	// as the generic JSON types (map[string]interface{}, float64, and so on).
+	Data interface{}
+}
+
+// AddFlash adds a flash message with the given level to the session data. The
+// session data status will be set to Modified.
+func (s *SessionManager) AddFlash(ctx context.Context, level FlashLevel, message string) {
+	s.AddFlashData(ctx, level, message, nil)
+}
+
+// AddFlashData adds a flash message with the given level and structured payload
+// to the session data. The session data status will be set to Modified.
+func (s *SessionManager) AddFlashData(ctx context.Context, level FlashLevel, message string, data interface{}) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	flashes, _ := sd.reserved[flashKey].([]Flash)
+	sd.setReserved(flashKey, append(flashes, Flash{Level: level, Message: message, Data: data}))
+	sd.status = Modified
+}
+
+// Flashes returns all flash messages in the session data, in the order that
+// they were added, and then deletes them from the session data. If there are
+// flash messages, the session data status will be set to Modified. If there
+// are no flash messages, nil is returned.
+func (s *SessionManager) Flashes(ctx context.Context) []Flash {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	flashes, _ := sd.reserved[flashKey].([]Flash)
+	if sd.deleteReserved(flashKey) {
+		sd.status = Modified
+	}
+	return flashes
+}
+
+// PeekFlashes returns all flash messages in the session data, in the order
+// that they were added, without deleting them. If there are no flash
+// messages, nil is returned.
+func (s *SessionManager) PeekFlashes(ctx context.Context) []Flash {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	flashes, _ := sd.reserved[flashKey].([]Flash)
+	if flashes == nil {
+		return nil
+	}
+	return append([]Flash(nil), flashes...)
+}
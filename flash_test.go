@@ -0,0 +1,75 @@
+package scs
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlashes(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	sd := newSessionData(time.Hour)
+	ctx := s.addSessionDataToContext(context.Background(), sd)
+
+	if flashes := s.Flashes(ctx); flashes != nil {
+		t.Errorf("got %v: expected %v", flashes, nil)
+	}
+	if sd.status != Unmodified {
+		t.Errorf("got %v: expected %v", sd.status, "unmodified")
+	}
+
+	s.AddFlash(ctx, FlashSuccess, "Saved")
+	s.AddFlashData(ctx, FlashError, "Invalid", map[string]string{"name": "required"})
+
+	if sd.status != Modified {
+		t.Errorf("got %v: expected %v", sd.status, "modified")
+	}
+
+	expected := []Flash{
+		{Level: FlashSuccess, Message: "Saved"},
+		{Level: FlashError, Message: "Invalid", Data: map[string]string{"name": "required"}},
+	}
+
+	flashes := s.PeekFlashes(ctx)
+	if !reflect.DeepEqual(flashes, expected) {
+		t.Errorf("got %v: expected %v", flashes, expected)
+	}
+
+	flashes = s.Flashes(ctx)
+	if !reflect.DeepEqual(flashes, expected) {
+		t.Errorf("got %v: expected %v", flashes, expected)
+	}
+
+	if flashes := s.PeekFlashes(ctx); flashes != nil {
+		t.Errorf("got %v: expected %v", flashes, nil)
+	}
+}
+
+func TestFlashesRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	ctx, err := s.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.AddFlash(ctx, FlashInfo, "Hello")
+	token, _, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = s.Load(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Flash{{Level: FlashInfo, Message: "Hello"}}
+	if flashes := s.Flashes(ctx); !reflect.DeepEqual(flashes, expected) {
+		t.Errorf("got %v: expected %v", flashes, expected)
+	}
+}
@@ -2,6 +2,8 @@ package goredisstore
 
 import (
 	"context"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -50,10 +52,162 @@ func (r *RedisStore) CommitCtx(ctx context.Context, token string, b []byte, expi
 	return err
 }
 
+// TouchCtx updates the expiry time for a given session token in the RedisStore
+// instance using PEXPIREAT, without changing the session data. If the session
+// token is not found or is expired, TouchCtx is a no-op.
+func (r *RedisStore) TouchCtx(ctx context.Context, token string, expiry time.Time) error {
+	return r.client.PExpireAt(ctx, r.prefix+token, expiry).Err()
+}
+
 // DeleteCtx removes a session token and corresponding data from the RedisStore
 // instance.
 func (r *RedisStore) DeleteCtx(ctx context.Context, token string) error {
-	return r.client.Del(ctx, r.prefix+token).Err()
+	userID, err := r.client.Get(ctx, r.prefix+token+userSuffix).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.prefix+token, r.prefix+token+userSuffix)
+		if userID != "" {
+			pipe.ZRem(ctx, r.prefix+userKeyPrefix+userID, token)
+		}
+		return nil
+	})
+	return err
+}
+
+// userSuffix is appended to the session key to give the key which holds the
+// user ID that the session is associated with.
+const userSuffix = ":user"
+
+// userKeyPrefix is appended to the store prefix, followed by a user ID, to give
+// the key of the sorted set which holds the tokens of that user's sessions.
+// Each token is scored by its expiry time as a millisecond timestamp.
+const userKeyPrefix = "user:"
+
+// BindUserCtx associates a session token in the RedisStore instance with a
+// user ID, so that it is returned by UserTokensCtx. Any existing association
+// for the session token is replaced. If the session token is not found or is
+// expired, BindUserCtx is a no-op.
+func (r *RedisStore) BindUserCtx(ctx context.Context, token string, userID string, expiry time.Time) error {
+	n, err := r.client.Exists(ctx, r.prefix+token).Result()
+	if err != nil || n == 0 {
+		return err
+	}
+
+	oldUserID, err := r.client.Get(ctx, r.prefix+token+userSuffix).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	userKey := r.prefix + userKeyPrefix + userID
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if oldUserID != "" && oldUserID != userID {
+			pipe.ZRem(ctx, r.prefix+userKeyPrefix+oldUserID, token)
+		}
+		pipe.Set(ctx, r.prefix+token+userSuffix, userID, 0)
+		pipe.PExpireAt(ctx, r.prefix+token+userSuffix, expiry)
+		pipe.ZAdd(ctx, userKey, redis.Z{Score: float64(expiry.UnixMilli()), Member: token})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The sorted set is kept for as long as its longest-lived session.
+	last, err := r.client.ZRangeWithScores(ctx, userKey, -1, -1).Result()
+	if err != nil || len(last) == 0 {
+		return err
+	}
+	return r.client.PExpireAt(ctx, userKey, time.UnixMilli(int64(last[0].Score))).Err()
+}
+
+// UnbindUserCtx removes any association between a session token in the
+// RedisStore instance and a user ID, so that it is no longer returned by
+// UserTokensCtx.
+func (r *RedisStore) UnbindUserCtx(ctx context.Context, token string) error {
+	userID, err := r.client.Get(ctx, r.prefix+token+userSuffix).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.prefix+token+userSuffix)
+		pipe.ZRem(ctx, r.prefix+userKeyPrefix+userID, token)
+		return nil
+	})
+	return err
+}
+
+// UserTokensCtx returns the tokens for all active (i.e. not expired) sessions
+// in the RedisStore instance which are associated with the given user ID.
+func (r *RedisStore) UserTokensCtx(ctx context.Context, userID string) ([]string, error) {
+	userKey := r.prefix + userKeyPrefix + userID
+
+	err := r.client.ZRemRangeByScore(ctx, userKey, "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10)).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := r.client.ZRange(ctx, userKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// A session can expire before the time it was bound until if it is
+	// idle, so check that the session data still exists.
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, token := range members {
+			pipe.Exists(ctx, r.prefix+token)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []string{}
+
+	for i, cmd := range cmds {
+		if cmd.(*redis.IntCmd).Val() > 0 {
+			tokens = append(tokens, members[i])
+		}
+	}
+
+	return tokens, nil
+}
+
+// aliasKeyPrefix is appended to the store prefix, followed by a session token,
+// to give the key which holds the alias for that token.
+const aliasKeyPrefix = "alias:"
+
+// AliasCtx records the target for a session token in the RedisStore instance,
+// replacing any existing alias for the token. The alias expires at the given
+// expiry time.
+func (r *RedisStore) AliasCtx(ctx context.Context, token string, target string, expiry time.Time) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.prefix+aliasKeyPrefix+token, target, 0)
+		pipe.PExpireAt(ctx, r.prefix+aliasKeyPrefix+token, expiry)
+		return nil
+	})
+	return err
+}
+
+// FindAliasCtx returns the target of the alias for a session token from the
+// RedisStore instance. If there is no alias for the token or it has expired,
+// the returned found flag will be set to false.
+func (r *RedisStore) FindAliasCtx(ctx context.Context, token string) (target string, found bool, err error) {
+	target, err = r.client.Get(ctx, r.prefix+aliasKeyPrefix+token).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
 }
 
 // AllCtx returns a map containing the token and data for all active (i.e.
@@ -75,6 +229,9 @@ func (r *RedisStore) AllCtx(ctx context.Context) (map[string][]byte, error) {
 		}
 		for _, key := range keys {
 			token := key[len(r.prefix):]
+			if strings.HasSuffix(token, userSuffix) || strings.HasPrefix(token, userKeyPrefix) || strings.HasPrefix(token, aliasKeyPrefix) {
+				continue
+			}
 			data, exists, err := r.FindCtx(ctx, token)
 			if err != nil {
 				return nil, err
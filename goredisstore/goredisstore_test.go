@@ -247,3 +247,137 @@ func TestAll(t *testing.T) {
 		t.Fatalf("got %v: expected %v", gotSessions, sessions)
 	}
 }
+
+func TestUserTokens(t *testing.T) {
+	opt, err := redis.ParseURL(os.Getenv("SCS_REDIS_TEST_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(opt)
+	defer client.Close()
+
+	ctx := context.Background()
+	r := New(client)
+
+	err = client.FlushDB(ctx).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"session_token_1", "session_token_2"} {
+		err = r.CommitCtx(ctx, token, []byte("encoded_data"), time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.BindUserCtx(ctx, token, "alice", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = r.BindUserCtx(ctx, "missing_session_token", "alice", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.DeleteCtx(ctx, "session_token_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := r.UserTokensCtx(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(tokens, []string{"session_token_2"}) == false {
+		t.Fatalf("got %v: expected %v", tokens, []string{"session_token_2"})
+	}
+
+	err = r.BindUserCtx(ctx, "session_token_2", "bob", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = r.UserTokensCtx(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("got %v: expected %v", len(tokens), 0)
+	}
+
+	sessions, err := r.AllCtx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(sessions, map[string][]byte{"session_token_2": []byte("encoded_data")}) == false {
+		t.Fatalf("got %v: expected %v", sessions, map[string][]byte{"session_token_2": []byte("encoded_data")})
+	}
+
+	err = r.UnbindUserCtx(ctx, "session_token_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.UnbindUserCtx(ctx, "missing_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = r.UserTokensCtx(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("got %v: expected %v", len(tokens), 0)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	opt, err := redis.ParseURL(os.Getenv("SCS_REDIS_TEST_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(opt)
+	defer client.Close()
+
+	ctx := context.Background()
+	r := New(client)
+
+	err = client.FlushDB(ctx).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.AliasCtx(ctx, "old_session_token", "target", time.Now().Add(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, found, err := r.FindAliasCtx(ctx, "old_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if target != "target" {
+		t.Fatalf("got %v: expected %v", target, "target")
+	}
+
+	sessions, err := r.AllCtx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("got %v: expected %v", len(sessions), 0)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	_, found, err = r.FindAliasCtx(ctx, "old_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
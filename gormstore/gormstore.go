@@ -1,7 +1,9 @@
 package gormstore
 
 import (
+	"context"
 	"log"
+	"sync"
 	"time"
 
 	"gorm.io/gorm"
@@ -9,8 +11,13 @@ import (
 
 // GORMStore represents the session store.
 type GORMStore struct {
-	db          *gorm.DB
-	stopCleanup chan bool
+	db             *gorm.DB
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
 }
 
 type session struct {
@@ -23,6 +30,30 @@ func (session) TableName() string {
 	return "sessions"
 }
 
+// Config contains the settings for a GORMStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by GORMStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
+}
+
 // New returns a new GORMStore instance, with a background cleanup goroutine
 // that runs every 5 minutes to remove expired session data.
 func New(db *gorm.DB) (*GORMStore, error) {
@@ -34,12 +65,17 @@ func New(db *gorm.DB) (*GORMStore, error) {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *gorm.DB, cleanupInterval time.Duration) (*GORMStore, error) {
-	g := &GORMStore{db: db}
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new GORMStore instance with the settings in cfg.
+func NewWithConfig(db *gorm.DB, cfg Config) (*GORMStore, error) {
+	g := &GORMStore{db: db, logger: cfg.Logger, onCleanupError: cfg.OnCleanupError}
 	if err := g.migrate(); err != nil {
 		return nil, err
 	}
-	if cleanupInterval > 0 {
-		go g.startCleanup(cleanupInterval)
+	if cfg.CleanupInterval > 0 {
+		g.startCleanup(cfg.CleanupInterval)
 	}
 	return g, nil
 }
@@ -120,43 +156,125 @@ func (g *GORMStore) migrate() error {
 	return nil
 }
 
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
 func (g *GORMStore) startCleanup(interval time.Duration) {
-	g.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			err := g.deleteExpired()
-			if err != nil {
-				log.Println(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	g.stopCleanup = cancel
+	g.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(g.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := g.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					g.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-g.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the GORMStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (g *GORMStore) RunCleanup(ctx context.Context) error {
+	n, err := g.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		g.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the GORMStore
-// instance. It's rare to terminate this; generally GORMStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the GORMStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the GORMStore is transient.
-// An example is creating a new GORMStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// GORMStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally GORMStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the GORMStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the GORMStore object from
+// being garbage collected unless you call Close.
+func (g *GORMStore) Close(ctx context.Context) error {
+	if g.stopCleanup == nil {
+		return nil
+	}
+	g.stopCleanup()
+
+	select {
+	case <-g.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the GORMStore
+// instance. It is equivalent to calling Close with context.Background().
 func (g *GORMStore) StopCleanup() {
-	if g.stopCleanup != nil {
-		g.stopCleanup <- true
+	g.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (g *GORMStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return g.stats.get()
+}
+
+func (g *GORMStore) reportCleanupError(err error) {
+	if g.logger == nil {
+		log.Println(err)
+	} else {
+		g.logger.Error("gormstore: cleanup failed", "store", "gormstore", "operation", "cleanup", "error", err)
+	}
+
+	if g.onCleanupError != nil {
+		g.onCleanupError(err)
 	}
 }
 
-func (g *GORMStore) deleteExpired() error {
-	row := g.db.Delete(&session{}, "expiry < ?", time.Now())
+func (g *GORMStore) deleteExpired(ctx context.Context) (int64, error) {
+	row := g.db.WithContext(ctx).Delete(&session{}, "expiry < ?", time.Now())
 	if row.Error != nil {
-		return row.Error
+		return 0, row.Error
 	}
-	return nil
+	return row.RowsAffected, nil
+}
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
 }
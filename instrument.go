@@ -0,0 +1,129 @@
+package scs
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Instrumentation is the interface for observing session operations, for
+// example to record traces and metrics.
+type Instrumentation interface {
+	// StartOperation is called at the start of an operation. It should return
+	// the context.Context to use for the rest of the operation (which will be
+	// passed to the StartOperation calls for any nested operations) and a
+	// function which is called with the result once the operation has
+	// finished.
+	StartOperation(ctx context.Context, op Operation) (context.Context, func(OperationResult))
+}
+
+// Operation describes a session operation which is reported to the
+// Instrumentation.
+type Operation struct {
+	// Name is the name of the operation. For operations on the session
+	// manager this is "Load", "Commit", "Destroy", "RenewToken" or
+	// "RotateToken" (for automatic rotation when RotationInterval is set).
+	// For calls to the session store it is the name of the store method,
+	// without any Ctx suffix, for example "Find", "Commit" or "All". For calls
+	// to the codec it is "Encode" or "Decode".
+	Name string
+
+	// Store reports whether the operation is a call to the session store.
+	Store bool
+
+	// Codec reports whether the operation is a call to the session codec.
+	Codec bool
+
+	// Reads reports whether the operation reads session data (or, for
+	// FindAlias, a session token alias), in which case OperationResult.Found
+	// is set.
+	Reads bool
+
+	// StoreType is the Go type of the session store, for example
+	// "*memstore.MemStore".
+	StoreType string
+}
+
+// OperationResult describes the outcome of a session operation which is
+// reported to the Instrumentation.
+type OperationResult struct {
+	// Err is the error returned by the operation, if any.
+	Err error
+
+	// Size is the size in bytes of the encoded session data read or written
+	// by a call to the session store or codec. For All, it is the total size
+	// of all the sessions returned. It is 0 for other operations.
+	Size int
+
+	// Found reports whether the session data was found, for operations which
+	// read session data.
+	Found bool
+
+	// Status is the status of the session data at the end of the operation,
+	// for operations on the session manager.
+	Status Status
+
+	// Created reports whether a Commit operation saved a new session.
+	Created bool
+}
+
+// CombineInstrumentation returns an Instrumentation which reports each
+// operation to all of the given instrumentations, in order. This is useful if
+// you want to record both traces and metrics, for example.
+func CombineInstrumentation(instrumentations ...Instrumentation) Instrumentation {
+	return multiInstrumentation(instrumentations)
+}
+
+type multiInstrumentation []Instrumentation
+
+func (m multiInstrumentation) StartOperation(ctx context.Context, op Operation) (context.Context, func(OperationResult)) {
+	finishes := make([]func(OperationResult), len(m))
+	for i, instrumentation := range m {
+		ctx, finishes[i] = instrumentation.StartOperation(ctx, op)
+	}
+
+	return ctx, func(res OperationResult) {
+		for i := len(finishes) - 1; i >= 0; i-- {
+			finishes[i](res)
+		}
+	}
+}
+
+// noopFinish is returned by instrument when no Instrumentation is set.
+func noopFinish(OperationResult) {}
+
+// instrument reports the start of an operation to the Instrumentation, if one
+// is set, and returns the function to call when it has finished.
+func (s *SessionManager) instrument(ctx context.Context, op Operation) (context.Context, func(OperationResult)) {
+	if s.Instrumentation == nil {
+		return ctx, noopFinish
+	}
+	op.StoreType = fmt.Sprintf("%T", s.Store)
+	return s.Instrumentation.StartOperation(ctx, op)
+}
+
+// codecEncode encodes the session data using the session codec, and records
+// its schema version.
+func (s *SessionManager) codecEncode(ctx context.Context, key string, deadline time.Time, values map[string]interface{}) (b []byte, err error) {
+	_, finish := s.instrument(ctx, Operation{Name: "Encode", Codec: true})
+	defer func() { finish(OperationResult{Err: err, Size: len(b)}) }()
+
+	return s.encodeSchema(key, deadline, values)
+}
+
+// codecDecode decodes the session data using the session codec, or the codec
+// registered for its schema version with UpgradeCodec.
+func (s *SessionManager) codecDecode(ctx context.Context, key string, b []byte) (deadline time.Time, values map[string]interface{}, err error) {
+	_, finish := s.instrument(ctx, Operation{Name: "Decode", Codec: true})
+	defer func() { finish(OperationResult{Err: err, Size: len(b)}) }()
+
+	return s.decodeSchema(key, b)
+}
+
+// currentStatus returns the status of the session data, for reporting to the
+// Instrumentation.
+func (sd *sessionData) currentStatus() Status {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.status
+}
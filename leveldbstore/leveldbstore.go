@@ -1,8 +1,10 @@
 package leveldbstore
 
 import (
+	"context"
 	"encoding/binary"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
@@ -13,8 +15,37 @@ var basePrefix string = "scs:session:"
 
 // LevelDBStore represents the session store.
 type LevelDBStore struct {
-	db          *leveldb.DB
-	stopCleanup chan bool
+	db             *leveldb.DB
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
+}
+
+// Config contains the settings for a LevelDBStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by LevelDBStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
 }
 
 // New returns a new LevelDBStore instance, with a background cleanup goroutine
@@ -28,12 +59,19 @@ func New(db *leveldb.DB) *LevelDBStore {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *leveldb.DB, cleanupInterval time.Duration) *LevelDBStore {
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new LevelDBStore instance with the settings in cfg.
+func NewWithConfig(db *leveldb.DB, cfg Config) *LevelDBStore {
 	bs := &LevelDBStore{
-		db: db,
+		db:             db,
+		logger:         cfg.Logger,
+		onCleanupError: cfg.OnCleanupError,
 	}
 
-	if cleanupInterval > 0 {
-		go bs.startCleanup(cleanupInterval)
+	if cfg.CleanupInterval > 0 {
+		bs.startCleanup(cfg.CleanupInterval)
 	}
 
 	return bs
@@ -101,52 +139,142 @@ func (ls *LevelDBStore) All() (map[string][]byte, error) {
 	return sessions, nil
 }
 
-func (ls *LevelDBStore) startCleanup(cleanupInterval time.Duration) {
-	ls.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(cleanupInterval)
-	for {
-		select {
-		case <-ticker.C:
-			err := ls.deleteExpired()
-			if err != nil {
-				log.Println(err)
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
+func (ls *LevelDBStore) startCleanup(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ls.stopCleanup = cancel
+	ls.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(ls.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := ls.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					ls.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-ls.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the LevelDBStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (ls *LevelDBStore) RunCleanup(ctx context.Context) error {
+	n, err := ls.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		ls.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the LevelDBStore
-// instance. It's rare to terminate this; generally LevelDBStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the LevelDBStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the LevelDBStore is transient.
-// An example is creating a new LevelDBStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// LevelDBStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally LevelDBStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the LevelDBStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the LevelDBStore object from
+// being garbage collected unless you call Close.
+func (ls *LevelDBStore) Close(ctx context.Context) error {
+	if ls.stopCleanup == nil {
+		return nil
+	}
+	ls.stopCleanup()
+
+	select {
+	case <-ls.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the LevelDBStore
+// instance. It is equivalent to calling Close with context.Background().
 func (ls *LevelDBStore) StopCleanup() {
-	if ls.stopCleanup != nil {
-		ls.stopCleanup <- true
+	ls.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (ls *LevelDBStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return ls.stats.get()
+}
+
+func (ls *LevelDBStore) reportCleanupError(err error) {
+	if ls.logger == nil {
+		log.Println(err)
+	} else {
+		ls.logger.Error("leveldbstore: cleanup failed", "store", "leveldbstore", "operation", "cleanup", "error", err)
+	}
+
+	if ls.onCleanupError != nil {
+		ls.onCleanupError(err)
 	}
 }
 
-func (ls *LevelDBStore) deleteExpired() error {
+func (ls *LevelDBStore) deleteExpired(ctx context.Context) (int64, error) {
 	iter := ls.db.NewIterator(util.BytesPrefix([]byte(basePrefix)), nil)
+	defer iter.Release()
+
+	var deleted int64
 	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
 		key := iter.Key()
 		val := iter.Value()
 		if uint64(time.Now().UnixNano()) > binary.BigEndian.Uint64(val[:8]) {
-			return ls.db.Delete([]byte(key), nil)
+			if err := ls.db.Delete(key, nil); err != nil {
+				return deleted, err
+			}
+			deleted++
 		}
 	}
-	iter.Release()
 	if err := iter.Error(); err != nil {
-		return err
+		return deleted, err
 	}
 
-	return nil
+	return deleted, nil
+}
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
 }
@@ -0,0 +1,85 @@
+package scs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Logger is the interface for the structured logger used by the session
+// manager. It is satisfied by *slog.Logger. The args are alternating keys and
+// values, as for slog.Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// stdLogger is the Logger used when the Logger field isn't set. It writes to
+// Go's standard logger.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, args ...interface{}) { stdLog("DEBUG", msg, args) }
+func (stdLogger) Info(msg string, args ...interface{})  { stdLog("INFO", msg, args) }
+func (stdLogger) Warn(msg string, args ...interface{})  { stdLog("WARN", msg, args) }
+func (stdLogger) Error(msg string, args ...interface{}) { stdLog("ERROR", msg, args) }
+
+func stdLog(level string, msg string, args []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", args[i])
+		}
+	}
+	log.Output(3, b.String())
+}
+
+func (s *SessionManager) logger() Logger {
+	if s.Logger == nil {
+		return stdLogger{}
+	}
+	return s.Logger
+}
+
+// logAttrs returns the attributes which are added to all log records about
+// the session token, so that records for the same session can be correlated
+// without logging the token itself.
+func (s *SessionManager) logAttrs(op string, token string) []interface{} {
+	attrs := []interface{}{"store", fmt.Sprintf("%T", s.Store), "operation", op}
+	if token != "" {
+		attrs = append(attrs, "token_hash", hashToken(token))
+	}
+	return attrs
+}
+
+type operationContextKey struct{}
+
+// serveError passes an error encountered by the LoadAndSave middleware to the
+// ErrorFunc. The name of the operation which failed is recorded in the request
+// context, so that it can be logged by the default ErrorFunc.
+func (s *SessionManager) serveError(w http.ResponseWriter, r *http.Request, op string, err error) {
+	errorFunc := s.ErrorFunc
+	if errorFunc == nil {
+		errorFunc = s.defaultErrorFunc
+	}
+
+	ctx := context.WithValue(r.Context(), operationContextKey{}, op)
+	errorFunc(w, r.WithContext(ctx), err)
+}
+
+func (s *SessionManager) defaultErrorFunc(w http.ResponseWriter, r *http.Request, err error) {
+	op, _ := r.Context().Value(operationContextKey{}).(string)
+	attrs := s.logAttrs(op, s.tokenTransport().ReadToken(r))
+	attrs = append(attrs, "method", r.Method, "path", r.URL.Path, "error", err)
+
+	s.logger().Error("scs: session error", attrs...)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
@@ -0,0 +1,60 @@
+//go:build go1.21
+// +build go1.21
+
+package scs
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alexedwards/scs/v2/mockstore"
+)
+
+func TestSlogLogger(t *testing.T) {
+	t.Parallel()
+
+	store := &mockstore.MockStore{}
+	store.ExpectFind("bad_token", nil, false, errors.New("forced failure"))
+
+	var buf bytes.Buffer
+	sessionManager := New()
+	sessionManager.Store = store
+	sessionManager.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+	h := sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called")
+	}))
+
+	r := httptest.NewRequest("GET", "/get", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "bad_token"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("want %d; got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	got := buf.String()
+	for _, want := range []string{
+		"level=ERROR",
+		`msg="scs: session error"`,
+		"store=*mockstore.MockStore",
+		"operation=Load",
+		"token_hash=" + hashToken("bad_token"),
+		"method=GET",
+		"path=/get",
+		`error="forced failure"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %q in %q", want, got)
+		}
+	}
+	if strings.Contains(got, "bad_token") {
+		t.Errorf("log record contains session token: %q", got)
+	}
+}
@@ -1,6 +1,7 @@
 package memstore
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -8,13 +9,25 @@ import (
 type item struct {
 	object     []byte
 	expiration int64
+	version    int64
+	userID     string
+}
+
+type alias struct {
+	target     string
+	expiration int64
 }
 
 // MemStore represents the session store.
 type MemStore struct {
 	items       map[string]item
+	aliases     map[string]alias
 	mu          sync.RWMutex
-	stopCleanup chan bool
+	stopCleanup context.CancelFunc
+	cleanupDone chan struct{}
+
+	lastCleanup    time.Time
+	cleanupDeleted int64
 }
 
 // New returns a new MemStore instance, with a background cleanup goroutine that
@@ -29,11 +42,12 @@ func New() *MemStore {
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(cleanupInterval time.Duration) *MemStore {
 	m := &MemStore{
-		items: make(map[string]item),
+		items:   make(map[string]item),
+		aliases: make(map[string]alias),
 	}
 
 	if cleanupInterval > 0 {
-		go m.startCleanup(cleanupInterval)
+		m.startCleanup(cleanupInterval)
 	}
 
 	return m
@@ -66,12 +80,194 @@ func (m *MemStore) Commit(token string, b []byte, expiry time.Time) error {
 	m.items[token] = item{
 		object:     b,
 		expiration: expiry.UnixNano(),
+		version:    m.currentVersion(token) + 1,
+		userID:     m.items[token].userID,
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Touch updates the expiry time for a given session token in the MemStore
+// instance, without changing the session data. If the session token is not
+// found or is expired, Touch is a no-op.
+func (m *MemStore) Touch(token string, expiry time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.currentVersion(token) == 0 {
+		return nil
+	}
+
+	item := m.items[token]
+	item.expiration = expiry.UnixNano()
+	m.items[token] = item
+
+	return nil
+}
+
+// Merge atomically reads the data for a given session token from the MemStore
+// instance, passes it to fn, and commits the data returned by fn with the given
+// expiry time. If the session token is not found or is expired, fn is called
+// with a nil byte slice and a found value of false.
+func (m *MemStore) Merge(token string, expiry time.Time, fn func(b []byte, found bool) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b []byte
+	version := m.currentVersion(token)
+	if version > 0 {
+		b = m.items[token].object
+	}
+
+	b, err := fn(b, version > 0)
+	if err != nil {
+		return err
+	}
+
+	m.items[token] = item{
+		object:     b,
+		expiration: expiry.UnixNano(),
+		version:    version + 1,
+		userID:     m.items[token].userID,
+	}
+
+	return nil
+}
+
+// FindVersion returns the data and current version for a given session token
+// from the MemStore instance. If the session token is not found or is expired,
+// the returned exists flag will be set to false and the version will be 0.
+func (m *MemStore) FindVersion(token string) ([]byte, int64, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	version := m.currentVersion(token)
+	if version == 0 {
+		return nil, 0, false, nil
+	}
+
+	return m.items[token].object, version, true, nil
+}
+
+// CompareAndCommit adds a session token and data to the MemStore instance with
+// the given expiry time, but only if the current version of the session data
+// is equal to the version parameter. A version of 0 means that the session
+// token must not exist or be expired. If the versions don't match then the
+// returned committed flag will be set to false.
+func (m *MemStore) CompareAndCommit(token string, b []byte, expiry time.Time, version int64) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := m.currentVersion(token)
+	if current != version {
+		return 0, false, nil
+	}
+
+	m.items[token] = item{
+		object:     b,
+		expiration: expiry.UnixNano(),
+		version:    current + 1,
+		userID:     m.items[token].userID,
+	}
+
+	return current + 1, true, nil
+}
+
+// BindUser associates a session token in the MemStore instance with a user ID,
+// so that it is returned by UserTokens. The association is removed when the
+// session token is deleted or expires. If the session token is not found or is
+// expired, BindUser is a no-op.
+func (m *MemStore) BindUser(token string, userID string, expiry time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.currentVersion(token) == 0 {
+		return nil
+	}
+
+	item := m.items[token]
+	item.userID = userID
+	m.items[token] = item
+
+	return nil
+}
+
+// UnbindUser removes any association between a session token in the MemStore
+// instance and a user ID, so that it is no longer returned by UserTokens.
+func (m *MemStore) UnbindUser(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, found := m.items[token]
+	if !found || item.userID == "" {
+		return nil
+	}
+
+	item.userID = ""
+	m.items[token] = item
+
+	return nil
+}
+
+// UserTokens returns the tokens for all active (i.e. not expired) sessions
+// which are associated with the given user ID.
+func (m *MemStore) UserTokens(userID string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := []string{}
+	now := time.Now().UnixNano()
+
+	for token, item := range m.items {
+		if item.userID == userID && item.expiration > now {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens, nil
+}
+
+// Alias records the target for a session token in the MemStore instance,
+// replacing any existing alias for the token. The alias is removed once the
+// expiry time has passed.
+func (m *MemStore) Alias(token string, target string, expiry time.Time) error {
+	m.mu.Lock()
+	m.aliases[token] = alias{
+		target:     target,
+		expiration: expiry.UnixNano(),
 	}
 	m.mu.Unlock()
 
 	return nil
 }
 
+// FindAlias returns the target of the alias for a session token from the
+// MemStore instance. If there is no alias for the token or it has expired, the
+// returned found flag will be set to false.
+func (m *MemStore) FindAlias(token string) (string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	alias, found := m.aliases[token]
+	if !found || time.Now().UnixNano() > alias.expiration {
+		return "", false, nil
+	}
+
+	return alias.target, true, nil
+}
+
+// currentVersion returns the version of the session data for the given token,
+// or 0 if the token is not found or is expired. It must be called with m.mu
+// held.
+func (m *MemStore) currentVersion(token string) int64 {
+	item, found := m.items[token]
+	if !found || time.Now().UnixNano() > item.expiration {
+		return 0
+	}
+	return item.version
+}
+
 // Delete removes a session token and corresponding data from the MemStore
 // instance.
 func (m *MemStore) Delete(token string) error {
@@ -99,34 +295,90 @@ func (m *MemStore) All() (map[string][]byte, error) {
 	return mm, nil
 }
 
+// Count returns the number of active sessions in the MemStore instance.
+func (m *MemStore) Count() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	count := 0
+	for _, item := range m.items {
+		if item.expiration > now {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
 func (m *MemStore) startCleanup(interval time.Duration) {
-	m.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			m.deleteExpired()
-		case <-m.stopCleanup:
-			ticker.Stop()
-			return
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stopCleanup = cancel
+	m.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(m.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.deleteExpired()
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the MemStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running. It always
+// returns nil.
+func (m *MemStore) RunCleanup(ctx context.Context) error {
+	m.deleteExpired()
+	return nil
+}
+
+// Close terminates the background cleanup goroutine for the MemStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It is
+// safe to call Close more than once.
+//
+// It's rare to need this; generally MemStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the MemStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the MemStore object from
+// being garbage collected unless you call Close.
+func (m *MemStore) Close(ctx context.Context) error {
+	if m.stopCleanup == nil {
+		return nil
+	}
+	m.stopCleanup()
+
+	select {
+	case <-m.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 // StopCleanup terminates the background cleanup goroutine for the MemStore
-// instance. It's rare to terminate this; generally MemStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
-//
-// There may be occasions though when your use of the MemStore is transient.
-// An example is creating a new MemStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// MemStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// instance. It is equivalent to calling Close with context.Background().
 func (m *MemStore) StopCleanup() {
-	if m.stopCleanup != nil {
-		m.stopCleanup <- true
-	}
+	m.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered. The MemStore cleanup goroutine never encounters errors.
+func (m *MemStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.lastCleanup, m.cleanupDeleted, 0
 }
 
 func (m *MemStore) deleteExpired() {
@@ -135,7 +387,14 @@ func (m *MemStore) deleteExpired() {
 	for token, item := range m.items {
 		if now > item.expiration {
 			delete(m.items, token)
+			m.cleanupDeleted++
+		}
+	}
+	for token, alias := range m.aliases {
+		if now > alias.expiration {
+			delete(m.aliases, token)
 		}
 	}
+	m.lastCleanup = time.Now()
 	m.mu.Unlock()
 }
@@ -2,7 +2,9 @@ package memstore
 
 import (
 	"bytes"
+	"context"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 )
@@ -123,4 +125,310 @@ func TestCleanupInterval(t *testing.T) {
 	if ok {
 		t.Fatalf("got %v: expected %v", ok, false)
 	}
+
+	lastRun, deleted, failed := m.CleanupStats()
+	if lastRun.IsZero() {
+		t.Fatalf("got %v: expected non-zero time", lastRun)
+	}
+	if deleted != 1 {
+		t.Fatalf("got %v: expected %v", deleted, 1)
+	}
+	if failed != 0 {
+		t.Fatalf("got %v: expected %v", failed, 0)
+	}
+}
+
+func TestCompareAndCommit(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	version, committed, err := m.CompareAndCommit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute), 0)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if committed != true {
+		t.Fatalf("got %v: expected %v", committed, true)
+	}
+	if version != 1 {
+		t.Fatalf("got %v: expected %v", version, 1)
+	}
+
+	_, committed, err = m.CompareAndCommit("session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute), 0)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if committed != false {
+		t.Fatalf("got %v: expected %v", committed, false)
+	}
+
+	version, committed, err = m.CompareAndCommit("session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute), 1)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if committed != true {
+		t.Fatalf("got %v: expected %v", committed, true)
+	}
+	if version != 2 {
+		t.Fatalf("got %v: expected %v", version, 2)
+	}
+
+	b, version, found, err := m.FindVersion("session_token")
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if version != 2 {
+		t.Fatalf("got %v: expected %v", version, 2)
+	}
+	if bytes.Equal(b, []byte("new_encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("new_encoded_data"))
+	}
+}
+
+func TestFindVersionExpired(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+	m.items["session_token"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(-time.Second).UnixNano(), version: 3}
+
+	_, version, found, err := m.FindVersion("session_token")
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+	if version != 0 {
+		t.Fatalf("got %v: expected %v", version, 0)
+	}
+
+	_, committed, err := m.CompareAndCommit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute), 0)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if committed != true {
+		t.Fatalf("got %v: expected %v", committed, true)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	err := m.Merge("session_token", time.Now().Add(time.Minute), func(b []byte, found bool) ([]byte, error) {
+		if found != false {
+			t.Fatalf("got %v: expected %v", found, false)
+		}
+		return []byte("encoded_data"), nil
+	})
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+
+	err = m.Merge("session_token", time.Now().Add(time.Minute), func(b []byte, found bool) ([]byte, error) {
+		if found != true {
+			t.Fatalf("got %v: expected %v", found, true)
+		}
+		return append(b, []byte("_merged")...), nil
+	})
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+
+	b, found, err := m.Find("session_token")
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data_merged")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data_merged"))
+	}
+}
+
+func TestTouch(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+	m.items["session_token"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(time.Second).UnixNano(), version: 1}
+
+	expiry := time.Now().Add(time.Minute)
+	err := m.Touch("session_token", expiry)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+
+	v := m.items["session_token"]
+	if v.expiration != expiry.UnixNano() {
+		t.Fatalf("got %v: expected %v", v.expiration, expiry.UnixNano())
+	}
+	if bytes.Equal(v.object, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", v.object, []byte("encoded_data"))
+	}
+
+	err = m.Touch("missing_session_token", expiry)
+	if err != nil {
+		t.Fatalf("got %v: expected %v", err, nil)
+	}
+	if _, found := m.items["missing_session_token"]; found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
+
+func TestUserTokens(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+	m.items["session_token_1"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(time.Minute).UnixNano(), version: 1}
+	m.items["session_token_2"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(time.Minute).UnixNano(), version: 1}
+	m.items["expired_session_token"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(time.Minute).UnixNano(), version: 1}
+
+	for token := range m.items {
+		err := m.BindUser(token, "alice", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expired := m.items["expired_session_token"]
+	expired.expiration = time.Now().Add(-time.Minute).UnixNano()
+	m.items["expired_session_token"] = expired
+
+	err := m.Commit("session_token_2", []byte("new_encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := m.UserTokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tokens)
+	if reflect.DeepEqual(tokens, []string{"session_token_1", "session_token_2"}) == false {
+		t.Fatalf("got %v: expected %v", tokens, []string{"session_token_1", "session_token_2"})
+	}
+
+	err = m.Delete("session_token_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = m.UserTokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(tokens, []string{"session_token_2"}) == false {
+		t.Fatalf("got %v: expected %v", tokens, []string{"session_token_2"})
+	}
+
+	tokens, err = m.UserTokens("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("got %v: expected %v", len(tokens), 0)
+	}
+
+	err = m.UnbindUser("session_token_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.UnbindUser("missing_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = m.UserTokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("got %v: expected %v", len(tokens), 0)
+	}
+	if _, found := m.items["session_token_2"]; !found {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+
+	err := m.Alias("old_session_token", "target", time.Now().Add(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, found, err := m.FindAlias("old_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if target != "target" {
+		t.Fatalf("got %v: expected %v", target, "target")
+	}
+
+	_, found, err = m.FindAlias("missing_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	_, found, err = m.FindAlias("old_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+
+	m.deleteExpired()
+	if len(m.aliases) != 0 {
+		t.Fatalf("got %v: expected %v", len(m.aliases), 0)
+	}
+}
+
+func TestCount(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+	m.items["session_token_1"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(time.Minute).UnixNano()}
+	m.items["session_token_2"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(time.Minute).UnixNano()}
+	m.items["session_token_3"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(-time.Minute).UnixNano()}
+
+	count, err := m.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("got %v: expected %v", count, 2)
+	}
+}
+
+func TestRunCleanup(t *testing.T) {
+	m := NewWithCleanupInterval(0)
+	m.items["session_token"] = item{object: []byte("encoded_data"), expiration: time.Now().Add(-time.Minute).UnixNano()}
+
+	err := m.RunCleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok := m.items["session_token"]
+	if ok {
+		t.Fatalf("got %v: expected %v", ok, false)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	m := NewWithCleanupInterval(time.Minute)
+	if err := m.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.StopCleanup()
+
+	m = NewWithCleanupInterval(0)
+	if err := m.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
 }
@@ -0,0 +1,99 @@
+package scs
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"net/http"
+	"time"
+)
+
+// metadataKey is the reserved session data key that the session metadata is
+// stored under.
+const metadataKey = "__metadata"
+
+// defaultMetadataInterval is how often the last activity time in the session
+// metadata is updated if TouchInterval isn't set.
+const defaultMetadataInterval = time.Minute
+
+func init() {
+	gob.Register(Metadata{})
+}
+
+// Metadata holds information about a session which is recorded by the
+// LoadAndSave middleware when TrackMetadata is enabled.
+type Metadata struct {
+	// CreatedAt is the time that the metadata was first recorded for the
+	// session.
+	CreatedAt time.Time
+
+	// LastSeen is the time of the most recent request which used the session.
+	// It is updated at most once per TouchInterval, or once a minute if
+	// TouchInterval isn't set.
+	LastSeen time.Time
+
+	// IP is the IP address of the client that made the most recent request,
+	// taken from http.Request.RemoteAddr. If your application is behind a
+	// proxy, you should use middleware which sets RemoteAddr to the real client
+	// IP address before LoadAndSave is called.
+	IP string
+
+	// UserAgent is the User-Agent header of the most recent request.
+	UserAgent string
+}
+
+// Metadata returns the metadata for the session. If no metadata has been
+// recorded for the session, the zero value is returned. It can be called
+// within the function passed to Iterate to read the metadata of each session
+// in the store.
+func (s *SessionManager) Metadata(ctx context.Context) Metadata {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	md, _ := sd.reserved[metadataKey].(Metadata)
+	return md
+}
+
+// recordMetadata updates the session metadata from the request. Metadata is
+// only recorded for sessions which already exist or which have been modified,
+// so that a session is not created for every client. If nothing has changed
+// since the metadata was last recorded and LastSeen is within TouchInterval
+// (or defaultMetadataInterval), it is a no-op. Otherwise the session data
+// status will be set to Modified.
+func (s *SessionManager) recordMetadata(ctx context.Context, r *http.Request) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.status == Destroyed || (sd.token == "" && sd.status != Modified) {
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	userAgent := r.UserAgent()
+	now := time.Now().UTC()
+
+	interval := s.TouchInterval
+	if interval == 0 {
+		interval = defaultMetadataInterval
+	}
+
+	md, _ := sd.reserved[metadataKey].(Metadata)
+	if md.CreatedAt.IsZero() {
+		md.CreatedAt = now
+	} else if md.IP == ip && md.UserAgent == userAgent && now.Sub(md.LastSeen) < interval {
+		return
+	}
+	md.LastSeen = now
+	md.IP = ip
+	md.UserAgent = userAgent
+
+	sd.setReserved(metadataKey, md)
+	sd.status = Modified
+}
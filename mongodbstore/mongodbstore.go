@@ -3,6 +3,7 @@ package mongodbstore
 import (
 	"context"
 	"log"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -18,8 +19,37 @@ type item struct {
 
 // MongoDBStore represents the session store.
 type MongoDBStore struct {
-	collection  *mongo.Collection
-	stopCleanup chan bool
+	collection     *mongo.Collection
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
+}
+
+// Config contains the settings for a MongoDBStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by MongoDBStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
 }
 
 // New returns a new MongoDBStore instance, with a background cleanup goroutine that
@@ -33,14 +63,21 @@ func New(db *mongo.Database) *MongoDBStore {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *mongo.Database, cleanupInterval time.Duration) *MongoDBStore {
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new MongoDBStore instance with the settings in cfg.
+func NewWithConfig(db *mongo.Database, cfg Config) *MongoDBStore {
 	collection := db.Collection("sessions")
 
 	m := &MongoDBStore{
-		collection: collection,
+		collection:     collection,
+		logger:         cfg.Logger,
+		onCleanupError: cfg.OnCleanupError,
 	}
 
-	if cleanupInterval > 0 {
-		go m.startCleanup(cleanupInterval)
+	if cfg.CleanupInterval > 0 {
+		m.startCleanup(cfg.CleanupInterval)
 	}
 
 	return m
@@ -139,46 +176,128 @@ func (m *MongoDBStore) All() (map[string][]byte, error) {
 	return sessions, nil
 }
 
-func (m *MongoDBStore) startCleanup(cleanupInterval time.Duration) {
-	m.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(cleanupInterval)
-	for {
-		select {
-		case <-ticker.C:
-			err := m.deleteExpired()
-			if err != nil {
-				log.Println(err)
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
+func (m *MongoDBStore) startCleanup(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stopCleanup = cancel
+	m.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(m.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := m.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					m.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-m.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the MongoDBStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (m *MongoDBStore) RunCleanup(ctx context.Context) error {
+	n, err := m.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		m.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the MongoDBStore
-// instance. It's rare to terminate this; generally MongoDBStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the MongoDBStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the MongoDBStore is transient.
-// An example is creating a new MongoDBStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// MongoDBStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally MongoDBStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the MongoDBStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the MongoDBStore object from
+// being garbage collected unless you call Close.
+func (m *MongoDBStore) Close(ctx context.Context) error {
+	if m.stopCleanup == nil {
+		return nil
+	}
+	m.stopCleanup()
+
+	select {
+	case <-m.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the MongoDBStore
+// instance. It is equivalent to calling Close with context.Background().
 func (m *MongoDBStore) StopCleanup() {
-	if m.stopCleanup != nil {
-		m.stopCleanup <- true
+	m.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (m *MongoDBStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return m.stats.get()
+}
+
+func (m *MongoDBStore) reportCleanupError(err error) {
+	if m.logger == nil {
+		log.Println(err)
+	} else {
+		m.logger.Error("mongodbstore: cleanup failed", "store", "mongodbstore", "operation", "cleanup", "error", err)
+	}
+
+	if m.onCleanupError != nil {
+		m.onCleanupError(err)
 	}
 }
 
-func (m *MongoDBStore) deleteExpired() error {
+func (m *MongoDBStore) deleteExpired(ctx context.Context) (int64, error) {
 	now := time.Now().UnixNano()
 	filter := bson.M{"expiration": bson.M{"$lt": now}}
-	_, err := m.collection.DeleteMany(context.Background(), filter, nil)
+	res, err := m.collection.DeleteMany(ctx, filter, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return res.DeletedCount, nil
+}
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
 }
@@ -0,0 +1,10 @@
+module github.com/alexedwards/scs/msgpackscs
+
+go 1.19
+
+require (
+	github.com/alexedwards/scs/v2 v2.9.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -0,0 +1,277 @@
+// Package msgpackscs provides a MessagePack codec for SCS session data.
+package msgpackscs
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Type IDs for the types which MsgpackCodec can encode and decode without them
+// being registered. They are negative so that they don't collide with the IDs
+// of registered types.
+const (
+	nilID int8 = -(iota + 1)
+	stringID
+	boolID
+	intID
+	int8ID
+	int16ID
+	int32ID
+	int64ID
+	uintID
+	uint8ID
+	uint16ID
+	uint32ID
+	uint64ID
+	float32ID
+	float64ID
+	bytesID
+	timeID
+	durationID
+	stringsID
+)
+
+var builtinTypes = map[int8]reflect.Type{
+	stringID:   reflect.TypeOf(""),
+	boolID:     reflect.TypeOf(false),
+	intID:      reflect.TypeOf(int(0)),
+	int8ID:     reflect.TypeOf(int8(0)),
+	int16ID:    reflect.TypeOf(int16(0)),
+	int32ID:    reflect.TypeOf(int32(0)),
+	int64ID:    reflect.TypeOf(int64(0)),
+	uintID:     reflect.TypeOf(uint(0)),
+	uint8ID:    reflect.TypeOf(uint8(0)),
+	uint16ID:   reflect.TypeOf(uint16(0)),
+	uint32ID:   reflect.TypeOf(uint32(0)),
+	uint64ID:   reflect.TypeOf(uint64(0)),
+	float32ID:  reflect.TypeOf(float32(0)),
+	float64ID:  reflect.TypeOf(float64(0)),
+	bytesID:    reflect.TypeOf([]byte(nil)),
+	timeID:     reflect.TypeOf(time.Time{}),
+	durationID: reflect.TypeOf(time.Duration(0)),
+	stringsID:  reflect.TypeOf([]string(nil)),
+}
+
+var builtinIDs = func() map[reflect.Type]int8 {
+	ids := make(map[reflect.Type]int8, len(builtinTypes))
+	for id, typ := range builtinTypes {
+		ids[typ] = id
+	}
+	return ids
+}()
+
+// MsgpackCodec implements scs.Codec using MessagePack. The session data is
+// encoded as a two-element array containing the deadline (as a MessagePack
+// timestamp) and a map of the values, sorted by key. Each value is encoded as
+// a two-element array containing a type ID and the value itself, so that it
+// is decoded to the same Go type that it was encoded from and the typed
+// getters such as GetInt, GetTime and GetBytes keep working.
+//
+// Strings, bools, integer and floating-point types, []byte, []string,
+// time.Time and time.Duration are supported without registration. Any other
+// type, such as your own structs, must be registered with a unique ID using
+// the RegisterExt method before it is encoded or decoded. This includes the
+// types that scs stores for flash messages and metadata ([]scs.Flash and
+// scs.Metadata), if you use those features. Structs are encoded as maps keyed by
+// field name, and the `msgpack` struct tag can be used to customize them.
+//
+// The encoding is deterministic: encoding the same values twice produces the
+// same bytes. Note that time.Time values are decoded in the local time zone.
+//
+// The zero value for a MsgpackCodec is ready to use. A MsgpackCodec must not
+// be copied after first use.
+type MsgpackCodec struct {
+	mu    sync.RWMutex
+	types map[int8]reflect.Type
+	ids   map[reflect.Type]int8
+}
+
+// New returns a new MsgpackCodec, which should be assigned to the Codec field
+// of a scs.SessionManager.
+func New() *MsgpackCodec {
+	return &MsgpackCodec{}
+}
+
+// RegisterExt records the type of value under the given ID, which must be
+// between 0 and 127. Values of that type will be encoded with the ID, and
+// values with the ID will be decoded to that type. Because the ID is stored
+// instead of the Go type name, registered types can be renamed or moved
+// without invalidating existing sessions. RegisterExt panics if the ID or the
+// type has already been registered, or if the type is supported without
+// registration.
+func (c *MsgpackCodec) RegisterExt(id int8, value interface{}) {
+	if id < 0 {
+		panic(fmt.Sprintf("msgpackscs: ext ID %d is reserved", id))
+	}
+	typ := reflect.TypeOf(value)
+	if typ == nil {
+		panic("msgpackscs: attempt to register nil value")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.types == nil {
+		c.types = make(map[int8]reflect.Type)
+		c.ids = make(map[reflect.Type]int8)
+	}
+
+	if t, ok := c.types[id]; ok {
+		panic(fmt.Sprintf("msgpackscs: ext ID %d is already registered for type %s", id, t))
+	}
+	if _, ok := builtinIDs[typ]; ok {
+		panic(fmt.Sprintf("msgpackscs: type %s does not need to be registered", typ))
+	}
+	if i, ok := c.ids[typ]; ok {
+		panic(fmt.Sprintf("msgpackscs: type %s is already registered with ext ID %d", typ, i))
+	}
+
+	c.types[id] = typ
+	c.ids[typ] = id
+}
+
+func (c *MsgpackCodec) typeForID(id int8) (reflect.Type, bool) {
+	if typ, ok := builtinTypes[id]; ok {
+		return typ, true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	typ, ok := c.types[id]
+	return typ, ok
+}
+
+func (c *MsgpackCodec) idForType(typ reflect.Type) (int8, bool) {
+	if id, ok := builtinIDs[typ]; ok {
+		return id, true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.ids[typ]
+	return id, ok
+}
+
+// Encode converts a session deadline and values into a byte slice. It returns
+// an error if a value has a type which isn't supported or registered.
+func (c *MsgpackCodec) Encode(deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.SetSortMapKeys(true)
+	enc.UseCompactInts(true)
+
+	if err := enc.EncodeArrayLen(2); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeTime(deadline); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeMapLen(len(keys)); err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		value := values[key]
+
+		id := nilID
+		if value != nil {
+			var ok bool
+			id, ok = c.idForType(reflect.TypeOf(value))
+			if !ok {
+				return nil, fmt.Errorf("msgpackscs: type %T for key %q is not registered", value, key)
+			}
+		}
+
+		if err := enc.EncodeString(key); err != nil {
+			return nil, err
+		}
+		if err := enc.EncodeArrayLen(2); err != nil {
+			return nil, err
+		}
+		if err := enc.EncodeInt8(id); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(value); err != nil {
+			return nil, fmt.Errorf("msgpackscs: encoding key %q: %w", key, err)
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// Decode converts a byte slice into a session deadline and values. It returns
+// an error if a value has a type ID which isn't registered.
+func (c *MsgpackCodec) Decode(b []byte) (time.Time, map[string]interface{}, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+
+	if err := expectArrayLen(dec, 2); err != nil {
+		return time.Time{}, nil, err
+	}
+	deadline, err := dec.DecodeTime()
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	values := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := dec.DecodeString()
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		if err := expectArrayLen(dec, 2); err != nil {
+			return time.Time{}, nil, err
+		}
+		id, err := dec.DecodeInt8()
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+
+		if id == nilID {
+			if err := dec.DecodeNil(); err != nil {
+				return time.Time{}, nil, err
+			}
+			values[key] = nil
+			continue
+		}
+
+		typ, ok := c.typeForID(id)
+		if !ok {
+			return time.Time{}, nil, fmt.Errorf("msgpackscs: ext ID %d for key %q is not registered", id, key)
+		}
+
+		ptr := reflect.New(typ)
+		if err := dec.Decode(ptr.Interface()); err != nil {
+			return time.Time{}, nil, fmt.Errorf("msgpackscs: decoding key %q: %w", key, err)
+		}
+		values[key] = ptr.Elem().Interface()
+	}
+
+	return deadline, values, nil
+}
+
+func expectArrayLen(dec *msgpack.Decoder, want int) error {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n != want {
+		return fmt.Errorf("msgpackscs: invalid session data: got array of length %d, expected %d", n, want)
+	}
+	return nil
+}
@@ -1,15 +1,52 @@
 package mssqlstore
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // MSSQLStore represents the session store.
 type MSSQLStore struct {
-	db          *sql.DB
-	stopCleanup chan bool
+	db             *sql.DB
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
+
+	// aliased is set to 1 once Alias has been called, so that the cleanup
+	// goroutine only deletes expired aliases if there is a session_aliases
+	// table.
+	aliased int32
+}
+
+// Config contains the settings for a MSSQLStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by MSSQLStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
 }
 
 // New returns a new MSSQLStore instance, with a background cleanup goroutine
@@ -23,9 +60,14 @@ func New(db *sql.DB) *MSSQLStore {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *sql.DB, cleanupInterval time.Duration) *MSSQLStore {
-	m := &MSSQLStore{db: db}
-	if cleanupInterval > 0 {
-		go m.startCleanup(cleanupInterval)
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new MSSQLStore instance with the settings in cfg.
+func NewWithConfig(db *sql.DB, cfg Config) *MSSQLStore {
+	m := &MSSQLStore{db: db, logger: cfg.Logger, onCleanupError: cfg.OnCleanupError}
+	if cfg.CleanupInterval > 0 {
+		m.startCleanup(cfg.CleanupInterval)
 	}
 	return m
 }
@@ -57,6 +99,75 @@ func (m *MSSQLStore) Commit(token string, b []byte, expiry time.Time) error {
 	return nil
 }
 
+// BindUser associates a session token with a user ID, so that it is returned
+// by UserTokens. This requires a user_id column in the sessions table. If the
+// session token is not found or is expired, BindUser is a no-op.
+func (m *MSSQLStore) BindUser(token string, userID string, expiry time.Time) error {
+	_, err := m.db.Exec("UPDATE sessions SET user_id = @p2 WHERE token = @p1 AND GETUTCDATE() < expiry", token, userID)
+	return err
+}
+
+// UnbindUser removes any association between a session token and a user ID,
+// so that it is no longer returned by UserTokens.
+func (m *MSSQLStore) UnbindUser(token string) error {
+	_, err := m.db.Exec("UPDATE sessions SET user_id = NULL WHERE token = @p1", token)
+	return err
+}
+
+// UserTokens returns the tokens for all active (i.e. not expired) sessions
+// which are associated with the given user ID.
+func (m *MSSQLStore) UserTokens(userID string) ([]string, error) {
+	rows, err := m.db.Query("SELECT token FROM sessions WHERE user_id = @p1 AND GETUTCDATE() < expiry", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []string{}
+
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Alias records the target for a session token, replacing any existing alias
+// for the token. This requires a session_aliases table. Expired aliases are
+// deleted by the background cleanup goroutine.
+func (m *MSSQLStore) Alias(token string, target string, expiry time.Time) error {
+	atomic.StoreInt32(&m.aliased, 1)
+
+	_, err := m.db.Exec(`MERGE INTO session_aliases WITH (HOLDLOCK) AS T USING (VALUES(@p1)) AS S (token) ON (T.token = S.token)
+						 WHEN MATCHED THEN UPDATE SET target = @p2, expiry = @p3
+						 WHEN NOT MATCHED THEN INSERT (token, target, expiry) VALUES(@p1, @p2, @p3);`, token, target, expiry.UTC())
+	return err
+}
+
+// FindAlias returns the target of the alias for a session token. If there is
+// no alias for the token or it has expired, the returned found flag will be
+// set to false.
+func (m *MSSQLStore) FindAlias(token string) (target string, found bool, err error) {
+	row := m.db.QueryRow("SELECT target FROM session_aliases WHERE token = @p1 AND GETUTCDATE() < expiry", token)
+	err = row.Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
 // Delete removes a session token and corresponding data from the MSSQLStore
 // instance.
 func (m *MSSQLStore) Delete(token string) error {
@@ -97,40 +208,141 @@ func (m *MSSQLStore) All() (map[string][]byte, error) {
 	return sessions, nil
 }
 
+// Count returns the number of active (i.e. not expired) sessions in the
+// MSSQLStore instance.
+func (m *MSSQLStore) Count() (int, error) {
+	var count int
+	err := m.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE GETUTCDATE() < expiry").Scan(&count)
+	return count, err
+}
+
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
 func (m *MSSQLStore) startCleanup(interval time.Duration) {
-	m.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			err := m.deleteExpired()
-			if err != nil {
-				log.Println(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stopCleanup = cancel
+	m.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(m.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := m.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					m.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-m.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the MSSQLStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (m *MSSQLStore) RunCleanup(ctx context.Context) error {
+	n, err := m.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		m.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the MSSQLStore
-// instance. It's rare to terminate this; generally MSSQLStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the MSSQLStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the MSSQLStore is transient.
-// An example is creating a new MSSQLStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// MSSQLStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally MSSQLStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the MSSQLStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the MSSQLStore object from
+// being garbage collected unless you call Close.
+func (m *MSSQLStore) Close(ctx context.Context) error {
+	if m.stopCleanup == nil {
+		return nil
+	}
+	m.stopCleanup()
+
+	select {
+	case <-m.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the MSSQLStore
+// instance. It is equivalent to calling Close with context.Background().
 func (m *MSSQLStore) StopCleanup() {
-	if m.stopCleanup != nil {
-		m.stopCleanup <- true
+	m.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (m *MSSQLStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return m.stats.get()
+}
+
+func (m *MSSQLStore) reportCleanupError(err error) {
+	if m.logger == nil {
+		log.Println(err)
+	} else {
+		m.logger.Error("mssqlstore: cleanup failed", "store", "mssqlstore", "operation", "cleanup", "error", err)
+	}
+
+	if m.onCleanupError != nil {
+		m.onCleanupError(err)
 	}
 }
 
-func (m *MSSQLStore) deleteExpired() error {
-	_, err := m.db.Exec("DELETE FROM sessions WHERE expiry < GETUTCDATE()")
-	return err
+func (m *MSSQLStore) deleteExpired(ctx context.Context) (int64, error) {
+	res, err := m.db.ExecContext(ctx, "DELETE FROM sessions WHERE expiry < GETUTCDATE()")
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if atomic.LoadInt32(&m.aliased) == 1 {
+		_, err = m.db.ExecContext(ctx, "DELETE FROM session_aliases WHERE expiry < GETUTCDATE()")
+	}
+	return n, err
+}
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
 }
@@ -1,18 +1,55 @@
 package mysqlstore
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // MySQLStore represents the session store.
 type MySQLStore struct {
 	*sql.DB
-	version     string
-	stopCleanup chan bool
+	version        string
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
+
+	// aliased is set to 1 once Alias has been called, so that the cleanup
+	// goroutine only deletes expired aliases if there is a session_aliases
+	// table.
+	aliased int32
+}
+
+// Config contains the settings for a MySQLStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by MySQLStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
 }
 
 // New returns a new MySQLStore instance, with a background cleanup goroutine
@@ -26,13 +63,20 @@ func New(db *sql.DB) *MySQLStore {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *sql.DB, cleanupInterval time.Duration) *MySQLStore {
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new MySQLStore instance with the settings in cfg.
+func NewWithConfig(db *sql.DB, cfg Config) *MySQLStore {
 	m := &MySQLStore{
-		DB:      db,
-		version: getVersion(db),
+		DB:             db,
+		version:        getVersion(db),
+		logger:         cfg.Logger,
+		onCleanupError: cfg.OnCleanupError,
 	}
 
-	if cleanupInterval > 0 {
-		go m.startCleanup(cleanupInterval)
+	if cfg.CleanupInterval > 0 {
+		m.startCleanup(cfg.CleanupInterval)
 	}
 
 	return m
@@ -72,6 +116,114 @@ func (m *MySQLStore) Commit(token string, b []byte, expiry time.Time) error {
 	return nil
 }
 
+// Touch updates the expiry time for a given session token in the MySQLStore
+// instance, without changing the session data. If the session token is not
+// found or is expired, Touch is a no-op.
+func (m *MySQLStore) Touch(token string, expiry time.Time) error {
+	var stmt string
+
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "UPDATE sessions SET expiry = ? WHERE token = ? AND UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "UPDATE sessions SET expiry = ? WHERE token = ? AND UTC_TIMESTAMP < expiry"
+	}
+
+	_, err := m.DB.Exec(stmt, expiry.UTC(), token)
+	return err
+}
+
+// BindUser associates a session token with a user ID, so that it is returned
+// by UserTokens. This requires a user_id column in the sessions table. If the
+// session token is not found or is expired, BindUser is a no-op.
+func (m *MySQLStore) BindUser(token string, userID string, expiry time.Time) error {
+	var stmt string
+
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "UPDATE sessions SET user_id = ? WHERE token = ? AND UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "UPDATE sessions SET user_id = ? WHERE token = ? AND UTC_TIMESTAMP < expiry"
+	}
+
+	_, err := m.DB.Exec(stmt, userID, token)
+	return err
+}
+
+// UnbindUser removes any association between a session token and a user ID,
+// so that it is no longer returned by UserTokens.
+func (m *MySQLStore) UnbindUser(token string) error {
+	_, err := m.DB.Exec("UPDATE sessions SET user_id = NULL WHERE token = ?", token)
+	return err
+}
+
+// UserTokens returns the tokens for all active (i.e. not expired) sessions
+// which are associated with the given user ID.
+func (m *MySQLStore) UserTokens(userID string) ([]string, error) {
+	var stmt string
+
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "SELECT token FROM sessions WHERE user_id = ? AND UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "SELECT token FROM sessions WHERE user_id = ? AND UTC_TIMESTAMP < expiry"
+	}
+
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []string{}
+
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Alias records the target for a session token, replacing any existing alias
+// for the token. This requires a session_aliases table. Expired aliases are
+// deleted by the background cleanup goroutine.
+func (m *MySQLStore) Alias(token string, target string, expiry time.Time) error {
+	atomic.StoreInt32(&m.aliased, 1)
+
+	_, err := m.DB.Exec("INSERT INTO session_aliases (token, target, expiry) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE target = VALUES(target), expiry = VALUES(expiry)", token, target, expiry.UTC())
+	return err
+}
+
+// FindAlias returns the target of the alias for a session token. If there is
+// no alias for the token or it has expired, the returned found flag will be
+// set to false.
+func (m *MySQLStore) FindAlias(token string) (string, bool, error) {
+	var target string
+	var stmt string
+
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "SELECT target FROM session_aliases WHERE token = ? AND UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "SELECT target FROM session_aliases WHERE token = ? AND UTC_TIMESTAMP < expiry"
+	}
+
+	row := m.DB.QueryRow(stmt, token)
+	err := row.Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
 // Delete removes a session token and corresponding data from the MySQLStore
 // instance.
 func (m *MySQLStore) Delete(token string) error {
@@ -120,50 +272,130 @@ func (m *MySQLStore) All() (map[string][]byte, error) {
 	return sessions, nil
 }
 
+// Count returns the number of active (i.e. not expired) sessions in the
+// MySQLStore instance.
+func (m *MySQLStore) Count() (int, error) {
+	var stmt string
+
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "SELECT COUNT(*) FROM sessions WHERE UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "SELECT COUNT(*) FROM sessions WHERE UTC_TIMESTAMP < expiry"
+	}
+
+	var count int
+	err := m.DB.QueryRow(stmt).Scan(&count)
+	return count, err
+}
+
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
 func (m *MySQLStore) startCleanup(interval time.Duration) {
-	m.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			err := m.deleteExpired()
-			if err != nil {
-				log.Println(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stopCleanup = cancel
+	m.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(m.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := m.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					m.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-m.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the MySQLStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (m *MySQLStore) RunCleanup(ctx context.Context) error {
+	n, err := m.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		m.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the MySQLStore
-// instance. It's rare to terminate this; generally MySQLStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the MySQLStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the MySQLStore is transient.
-// An example is creating a new MySQLStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// MySQLStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
-func (m *MySQLStore) StopCleanup() {
-	if m.stopCleanup != nil {
-		m.stopCleanup <- true
+// It's rare to need this; generally MySQLStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the MySQLStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the MySQLStore object from
+// being garbage collected unless you call Close.
+func (m *MySQLStore) Close(ctx context.Context) error {
+	if m.stopCleanup == nil {
+		return nil
+	}
+	m.stopCleanup()
+
+	select {
+	case <-m.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (m *MySQLStore) deleteExpired() error {
-	var stmt string
+// StopCleanup terminates the background cleanup goroutine for the MySQLStore
+// instance. It is equivalent to calling Close with context.Background().
+func (m *MySQLStore) StopCleanup() {
+	m.Close(context.Background())
+}
 
-	if compareVersion("5.6.4", m.version) >= 0 {
-		stmt = "DELETE FROM sessions WHERE expiry < UTC_TIMESTAMP(6)"
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (m *MySQLStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return m.stats.get()
+}
+
+func (m *MySQLStore) reportCleanupError(err error) {
+	if m.logger == nil {
+		log.Println(err)
 	} else {
-		stmt = "DELETE FROM sessions WHERE expiry < UTC_TIMESTAMP"
+		m.logger.Error("mysqlstore: cleanup failed", "store", "mysqlstore", "operation", "cleanup", "error", err)
 	}
 
-	_, err := m.DB.Exec(stmt)
-	return err
+	if m.onCleanupError != nil {
+		m.onCleanupError(err)
+	}
+}
+
+func (m *MySQLStore) deleteExpired(ctx context.Context) (int64, error) {
+	now := "UTC_TIMESTAMP"
+	if compareVersion("5.6.4", m.version) >= 0 {
+		now = "UTC_TIMESTAMP(6)"
+	}
+
+	res, err := m.DB.ExecContext(ctx, "DELETE FROM sessions WHERE expiry < "+now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if atomic.LoadInt32(&m.aliased) == 1 {
+		_, err = m.DB.ExecContext(ctx, "DELETE FROM session_aliases WHERE expiry < "+now)
+	}
+	return n, err
 }
 
 func getVersion(db *sql.DB) string {
@@ -205,3 +437,29 @@ func compareVersion(a, b string) (ret int) {
 	}
 	return
 }
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
+}
@@ -1,15 +1,58 @@
 package postgresstore
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // PostgresStore represents the session store.
 type PostgresStore struct {
-	db          *sql.DB
-	stopCleanup chan bool
+	db             *sql.DB
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
+
+	// aliased is set to 1 once Alias has been called, so that the cleanup
+	// goroutine only deletes expired aliases if there is a session_aliases
+	// table.
+	aliased int32
+
+	// versionMu guards hasVersion, which records whether the sessions table
+	// has a version column, and versionChecked.
+	versionMu      sync.Mutex
+	hasVersion     bool
+	versionChecked bool
+}
+
+// Config contains the settings for a PostgresStore instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by PostgresStore. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
 }
 
 // New returns a new PostgresStore instance, with a background cleanup goroutine
@@ -23,9 +66,14 @@ func New(db *sql.DB) *PostgresStore {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *sql.DB, cleanupInterval time.Duration) *PostgresStore {
-	p := &PostgresStore{db: db}
-	if cleanupInterval > 0 {
-		go p.startCleanup(cleanupInterval)
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new PostgresStore instance with the settings in cfg.
+func NewWithConfig(db *sql.DB, cfg Config) *PostgresStore {
+	p := &PostgresStore{db: db, logger: cfg.Logger, onCleanupError: cfg.OnCleanupError}
+	if cfg.CleanupInterval > 0 {
+		p.startCleanup(cfg.CleanupInterval)
 	}
 	return p
 }
@@ -46,15 +94,209 @@ func (p *PostgresStore) Find(token string) (b []byte, exists bool, err error) {
 
 // Commit adds a session token and data to the PostgresStore instance with the
 // given expiry time. If the session token already exists, then the data and expiry
-// time are updated.
+// time are updated. If the sessions table has a version column, the version is
+// incremented, so that concurrent calls to CompareAndCommit with the previous
+// version fail.
 func (p *PostgresStore) Commit(token string, b []byte, expiry time.Time) error {
-	_, err := p.db.Exec("INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry", token, b, expiry)
+	query, err := p.commitQuery()
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.Exec(query, token, b, expiry)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// commitQuery returns the statement used by Commit and Merge to upsert the
+// session data, which increments the version if there is a version column.
+func (p *PostgresStore) commitQuery() (string, error) {
+	versioned, err := p.versionColumn()
+	if err != nil {
+		return "", err
+	}
+	if versioned {
+		return "INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = sessions.version + 1", nil
+	}
+	return "INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry", nil
+}
+
+// versionColumn reports whether the sessions table has a version column. The
+// result is cached after the first successful check, so a version column
+// which is added later is only used once the application is restarted.
+func (p *PostgresStore) versionColumn() (bool, error) {
+	p.versionMu.Lock()
+	defer p.versionMu.Unlock()
+
+	if p.versionChecked {
+		return p.hasVersion, nil
+	}
+
+	row := p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'sessions' AND column_name = 'version')")
+	if err := row.Scan(&p.hasVersion); err != nil {
+		return false, err
+	}
+	p.versionChecked = true
+	return p.hasVersion, nil
+}
+
+// Touch updates the expiry time for a given session token in the PostgresStore
+// instance, without changing the session data. If the session token is not
+// found or is expired, Touch is a no-op.
+func (p *PostgresStore) Touch(token string, expiry time.Time) error {
+	_, err := p.db.Exec("UPDATE sessions SET expiry = $2 WHERE token = $1 AND current_timestamp < expiry", token, expiry)
+	return err
+}
+
+// BindUser associates a session token with a user ID, so that it is returned
+// by UserTokens. This requires a user_id column in the sessions table. If the
+// session token is not found or is expired, BindUser is a no-op.
+func (p *PostgresStore) BindUser(token string, userID string, expiry time.Time) error {
+	_, err := p.db.Exec("UPDATE sessions SET user_id = $2 WHERE token = $1 AND current_timestamp < expiry", token, userID)
+	return err
+}
+
+// UnbindUser removes any association between a session token and a user ID,
+// so that it is no longer returned by UserTokens.
+func (p *PostgresStore) UnbindUser(token string) error {
+	_, err := p.db.Exec("UPDATE sessions SET user_id = NULL WHERE token = $1", token)
+	return err
+}
+
+// UserTokens returns the tokens for all active (i.e. not expired) sessions
+// which are associated with the given user ID.
+func (p *PostgresStore) UserTokens(userID string) ([]string, error) {
+	rows, err := p.db.Query("SELECT token FROM sessions WHERE user_id = $1 AND current_timestamp < expiry", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []string{}
+
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Alias records the target for a session token, replacing any existing alias
+// for the token. This requires a session_aliases table. Expired aliases are
+// deleted by the background cleanup goroutine.
+func (p *PostgresStore) Alias(token string, target string, expiry time.Time) error {
+	atomic.StoreInt32(&p.aliased, 1)
+
+	_, err := p.db.Exec("INSERT INTO session_aliases (token, target, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET target = EXCLUDED.target, expiry = EXCLUDED.expiry", token, target, expiry)
+	return err
+}
+
+// FindAlias returns the target of the alias for a session token. If there is
+// no alias for the token or it has expired, the returned found flag will be
+// set to false.
+func (p *PostgresStore) FindAlias(token string) (target string, found bool, err error) {
+	row := p.db.QueryRow("SELECT target FROM session_aliases WHERE token = $1 AND current_timestamp < expiry", token)
+	err = row.Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
+// Merge atomically reads the data for a given session token from the
+// PostgresStore instance, passes it to fn, and commits the data returned by fn
+// with the given expiry time. The session row is locked for the duration of
+// the update. If the session token is not found or is expired, fn is called
+// with a nil byte slice and a found value of false. If the sessions table has
+// a version column, the version is incremented.
+func (p *PostgresStore) Merge(token string, expiry time.Time, fn func(b []byte, found bool) ([]byte, error)) error {
+	query, err := p.commitQuery()
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var b []byte
+	found := true
+	row := tx.QueryRow("SELECT data FROM sessions WHERE token = $1 AND current_timestamp < expiry FOR UPDATE", token)
+	err = row.Scan(&b)
+	if err == sql.ErrNoRows {
+		found = false
+	} else if err != nil {
+		return err
+	}
+
+	b, err = fn(b, found)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(query, token, b, expiry)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FindVersion returns the data and current version for a given session token
+// from the PostgresStore instance. If the session token is not found or is
+// expired, the returned exists flag will be set to false and the version will
+// be 0. FindVersion requires the sessions table to have a version column (see
+// the README for details).
+func (p *PostgresStore) FindVersion(token string) (b []byte, version int64, exists bool, err error) {
+	row := p.db.QueryRow("SELECT data, version FROM sessions WHERE token = $1 AND current_timestamp < expiry", token)
+	err = row.Scan(&b, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, false, nil
+	} else if err != nil {
+		return nil, 0, false, err
+	}
+	return b, version, true, nil
+}
+
+// CompareAndCommit adds a session token and data to the PostgresStore instance
+// with the given expiry time, but only if the current version of the session
+// data is equal to the version parameter. A version of 0 means that the
+// session token must not exist or be expired. If the versions don't match then
+// the returned committed flag will be set to false. CompareAndCommit requires
+// the sessions table to have a version column (see the README for details).
+func (p *PostgresStore) CompareAndCommit(token string, b []byte, expiry time.Time, version int64) (newVersion int64, committed bool, err error) {
+	var row *sql.Row
+	if version == 0 {
+		row = p.db.QueryRow("INSERT INTO sessions (token, data, expiry, version) VALUES ($1, $2, $3, 1) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = sessions.version + 1 WHERE sessions.expiry <= current_timestamp RETURNING version", token, b, expiry)
+	} else {
+		row = p.db.QueryRow("UPDATE sessions SET data = $2, expiry = $3, version = version + 1 WHERE token = $1 AND version = $4 AND current_timestamp < expiry RETURNING version", token, b, expiry, version)
+	}
+
+	err = row.Scan(&newVersion)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return newVersion, true, nil
+}
+
 // Delete removes a session token and corresponding data from the PostgresStore
 // instance.
 func (p *PostgresStore) Delete(token string) error {
@@ -95,40 +337,141 @@ func (p *PostgresStore) All() (map[string][]byte, error) {
 	return sessions, nil
 }
 
+// Count returns the number of active (i.e. not expired) sessions in the
+// PostgresStore instance.
+func (p *PostgresStore) Count() (int, error) {
+	var count int
+	err := p.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE current_timestamp < expiry").Scan(&count)
+	return count, err
+}
+
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
 func (p *PostgresStore) startCleanup(interval time.Duration) {
-	p.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			err := p.deleteExpired()
-			if err != nil {
-				log.Println(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopCleanup = cancel
+	p.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(p.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := p.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					p.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-p.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the PostgresStore instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (p *PostgresStore) RunCleanup(ctx context.Context) error {
+	n, err := p.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		p.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the PostgresStore
-// instance. It's rare to terminate this; generally PostgresStore instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the PostgresStore instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the PostgresStore is transient.
-// An example is creating a new PostgresStore instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// PostgresStore object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally PostgresStore instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the PostgresStore is transient (for example, in a
+// test function), the cleanup goroutine will prevent the PostgresStore object from
+// being garbage collected unless you call Close.
+func (p *PostgresStore) Close(ctx context.Context) error {
+	if p.stopCleanup == nil {
+		return nil
+	}
+	p.stopCleanup()
+
+	select {
+	case <-p.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the PostgresStore
+// instance. It is equivalent to calling Close with context.Background().
 func (p *PostgresStore) StopCleanup() {
-	if p.stopCleanup != nil {
-		p.stopCleanup <- true
+	p.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (p *PostgresStore) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return p.stats.get()
+}
+
+func (p *PostgresStore) reportCleanupError(err error) {
+	if p.logger == nil {
+		log.Println(err)
+	} else {
+		p.logger.Error("postgresstore: cleanup failed", "store", "postgresstore", "operation", "cleanup", "error", err)
+	}
+
+	if p.onCleanupError != nil {
+		p.onCleanupError(err)
 	}
 }
 
-func (p *PostgresStore) deleteExpired() error {
-	_, err := p.db.Exec("DELETE FROM sessions WHERE expiry < current_timestamp")
-	return err
+func (p *PostgresStore) deleteExpired(ctx context.Context) (int64, error) {
+	res, err := p.db.ExecContext(ctx, "DELETE FROM sessions WHERE expiry < current_timestamp")
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if atomic.LoadInt32(&p.aliased) == 1 {
+		_, err = p.db.ExecContext(ctx, "DELETE FROM session_aliases WHERE expiry < current_timestamp")
+	}
+	return n, err
+}
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
 }
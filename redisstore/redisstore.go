@@ -1,6 +1,8 @@
 package redisstore
 
 import (
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -46,16 +48,53 @@ func (r *RedisStore) Find(token string) (b []byte, exists bool, err error) {
 
 // Commit adds a session token and data to the RedisStore instance with the
 // given expiry time. If the session token already exists then the data and
-// expiry time are updated.
+// expiry time are updated. The version of the session data is incremented, so
+// that concurrent calls to CompareAndCommit with the previous version fail.
 func (r *RedisStore) Commit(token string, b []byte, expiry time.Time) error {
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	err := conn.Send("MULTI")
+	_, err := commitScript.Do(conn, r.prefix+token, r.prefix+token+versionSuffix, b, makeMillisecondTimestamp(expiry))
+	return err
+}
+
+// Delete removes a session token and corresponding data from the RedisStore
+// instance.
+func (r *RedisStore) Delete(token string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	userID, err := redis.String(conn.Do("GET", r.prefix+token+userSuffix))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	err = conn.Send("DEL", r.prefix+token, r.prefix+token+versionSuffix, r.prefix+token+userSuffix)
 	if err != nil {
 		return err
 	}
-	err = conn.Send("SET", r.prefix+token, b)
+	if userID != "" {
+		err = conn.Send("ZREM", r.prefix+userKeyPrefix+userID, token)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Touch updates the expiry time for a given session token in the RedisStore
+// instance using PEXPIREAT, without changing the session data. If the session
+// token is not found or is expired, Touch is a no-op.
+func (r *RedisStore) Touch(token string, expiry time.Time) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
 	if err != nil {
 		return err
 	}
@@ -63,20 +102,283 @@ func (r *RedisStore) Commit(token string, b []byte, expiry time.Time) error {
 	if err != nil {
 		return err
 	}
+	err = conn.Send("PEXPIREAT", r.prefix+token+versionSuffix, makeMillisecondTimestamp(expiry))
+	if err != nil {
+		return err
+	}
 	_, err = conn.Do("EXEC")
 	return err
 }
 
-// Delete removes a session token and corresponding data from the RedisStore
-// instance.
-func (r *RedisStore) Delete(token string) error {
+// versionSuffix is appended to the session key to give the key which holds
+// the session data version.
+const versionSuffix = ":version"
+
+// commitScript atomically commits the session data and increments its
+// version. KEYS[1] is the session key and KEYS[2] the version key. ARGV[1] is
+// the session data and ARGV[2] the expiry time as a millisecond timestamp. It
+// returns the new version.
+var commitScript = redis.NewScript(2, `
+local current = 0
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	current = tonumber(redis.call("GET", KEYS[2]) or "1")
+end
+redis.call("SET", KEYS[1], ARGV[1])
+redis.call("PEXPIREAT", KEYS[1], ARGV[2])
+redis.call("SET", KEYS[2], current + 1)
+redis.call("PEXPIREAT", KEYS[2], ARGV[2])
+return current + 1
+`)
+
+// compareAndCommitScript atomically checks the version of the session data and
+// commits the new data if it matches. KEYS[1] is the session key and KEYS[2]
+// the version key. ARGV[1] is the expected version, ARGV[2] the session data
+// and ARGV[3] the expiry time as a millisecond timestamp. It returns the new
+// version, or 0 if the versions don't match.
+var compareAndCommitScript = redis.NewScript(2, `
+local current = 0
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	current = tonumber(redis.call("GET", KEYS[2]) or "1")
+end
+if current ~= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2])
+redis.call("PEXPIREAT", KEYS[1], ARGV[3])
+redis.call("SET", KEYS[2], current + 1)
+redis.call("PEXPIREAT", KEYS[2], ARGV[3])
+return current + 1
+`)
+
+// FindVersion returns the data and current version for a given session token
+// from the RedisStore instance. If the session token is not found or is
+// expired, the returned exists flag will be set to false and the version will
+// be 0.
+func (r *RedisStore) FindVersion(token string) (b []byte, version int64, exists bool, err error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.ByteSlices(conn.Do("MGET", r.prefix+token, r.prefix+token+versionSuffix))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if reply[0] == nil {
+		return nil, 0, false, nil
+	}
+
+	// Session data which was written before versioning was added has no
+	// version key, and is treated as being at version 1.
+	version = 1
+	if reply[1] != nil {
+		version, err = strconv.ParseInt(string(reply[1]), 10, 64)
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+	return reply[0], version, true, nil
+}
+
+// CompareAndCommit adds a session token and data to the RedisStore instance
+// with the given expiry time, but only if the current version of the session
+// data is equal to the version parameter. A version of 0 means that the
+// session token must not exist or be expired. If the versions don't match then
+// the returned committed flag will be set to false.
+func (r *RedisStore) CompareAndCommit(token string, b []byte, expiry time.Time, version int64) (newVersion int64, committed bool, err error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	newVersion, err = redis.Int64(compareAndCommitScript.Do(conn, r.prefix+token, r.prefix+token+versionSuffix, version, b, makeMillisecondTimestamp(expiry)))
+	if err != nil {
+		return 0, false, err
+	}
+	return newVersion, newVersion > 0, nil
+}
+
+// userSuffix is appended to the session key to give the key which holds the
+// user ID that the session is associated with.
+const userSuffix = ":user"
+
+// userKeyPrefix is appended to the store prefix, followed by a user ID, to give
+// the key of the sorted set which holds the tokens of that user's sessions.
+// Each token is scored by its expiry time as a millisecond timestamp.
+const userKeyPrefix = "user:"
+
+// BindUser associates a session token in the RedisStore instance with a user
+// ID, so that it is returned by UserTokens. Any existing association for the
+// session token is replaced. If the session token is not found or is expired,
+// BindUser is a no-op.
+func (r *RedisStore) BindUser(token string, userID string, expiry time.Time) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", r.prefix+token))
+	if err != nil || !exists {
+		return err
+	}
+
+	oldUserID, err := redis.String(conn.Do("GET", r.prefix+token+userSuffix))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	userKey := r.prefix + userKeyPrefix + userID
+	expiryMS := makeMillisecondTimestamp(expiry)
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	if oldUserID != "" && oldUserID != userID {
+		err = conn.Send("ZREM", r.prefix+userKeyPrefix+oldUserID, token)
+		if err != nil {
+			return err
+		}
+	}
+	err = conn.Send("SET", r.prefix+token+userSuffix, userID)
+	if err != nil {
+		return err
+	}
+	err = conn.Send("PEXPIREAT", r.prefix+token+userSuffix, expiryMS)
+	if err != nil {
+		return err
+	}
+	err = conn.Send("ZADD", userKey, expiryMS, token)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+
+	// The sorted set is kept for as long as its longest-lived session.
+	reply, err := redis.Int64s(conn.Do("ZRANGE", userKey, -1, -1, "WITHSCORES"))
+	if err != nil || len(reply) < 2 {
+		return err
+	}
+	_, err = conn.Do("PEXPIREAT", userKey, reply[1])
+	return err
+}
+
+// UnbindUser removes any association between a session token in the
+// RedisStore instance and a user ID, so that it is no longer returned by
+// UserTokens.
+func (r *RedisStore) UnbindUser(token string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	userID, err := redis.String(conn.Do("GET", r.prefix+token+userSuffix))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	err = conn.Send("DEL", r.prefix+token+userSuffix)
+	if err != nil {
+		return err
+	}
+	err = conn.Send("ZREM", r.prefix+userKeyPrefix+userID, token)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// UserTokens returns the tokens for all active (i.e. not expired) sessions in
+// the RedisStore instance which are associated with the given user ID.
+func (r *RedisStore) UserTokens(userID string) ([]string, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	userKey := r.prefix + userKeyPrefix + userID
+
+	_, err := conn.Do("ZREMRANGEBYSCORE", userKey, "-inf", makeMillisecondTimestamp(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := redis.Strings(conn.Do("ZRANGE", userKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	// A session can expire before the time it was bound until if it is
+	// idle, so check that the session data still exists.
+	for _, token := range members {
+		err = conn.Send("EXISTS", r.prefix+token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []string{}
+
+	for _, token := range members {
+		exists, err := redis.Bool(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens, nil
+}
+
+// aliasKeyPrefix is appended to the store prefix, followed by a session token,
+// to give the key which holds the alias for that token.
+const aliasKeyPrefix = "alias:"
+
+// Alias records the target for a session token in the RedisStore instance,
+// replacing any existing alias for the token. The alias expires at the given
+// expiry time.
+func (r *RedisStore) Alias(token string, target string, expiry time.Time) error {
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do("DEL", r.prefix+token)
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	err = conn.Send("SET", r.prefix+aliasKeyPrefix+token, target)
+	if err != nil {
+		return err
+	}
+	err = conn.Send("PEXPIREAT", r.prefix+aliasKeyPrefix+token, makeMillisecondTimestamp(expiry))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("EXEC")
 	return err
 }
 
+// FindAlias returns the target of the alias for a session token from the
+// RedisStore instance. If there is no alias for the token or it has expired,
+// the returned found flag will be set to false.
+func (r *RedisStore) FindAlias(token string) (target string, found bool, err error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	target, err = redis.String(conn.Do("GET", r.prefix+aliasKeyPrefix+token))
+	if err == redis.ErrNil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
 // All returns a map containing the token and data for all active (i.e.
 // not expired) sessions in the RedisStore instance.
 func (r *RedisStore) All() (map[string][]byte, error) {
@@ -93,7 +395,13 @@ func (r *RedisStore) All() (map[string][]byte, error) {
 	sessions := make(map[string][]byte)
 
 	for _, key := range keys {
+		if strings.HasSuffix(key, versionSuffix) || strings.HasSuffix(key, userSuffix) {
+			continue
+		}
 		token := key[len(r.prefix):]
+		if strings.HasPrefix(token, userKeyPrefix) || strings.HasPrefix(token, aliasKeyPrefix) {
+			continue
+		}
 
 		data, exists, err := r.Find(token)
 		if err == redis.ErrNil {
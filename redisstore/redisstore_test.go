@@ -149,6 +149,53 @@ func TestSaveUpdated(t *testing.T) {
 	}
 }
 
+func TestCommitIncrementsVersion(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, version, _, err := r.FindVersion("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = r.CompareAndCommit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, _, err = r.FindVersion("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Commit("session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, committed, err := r.CompareAndCommit("session_token", []byte("stale_data"), time.Now().Add(time.Minute), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed {
+		t.Fatal("expected commit with a stale version to fail")
+	}
+}
+
 func TestExpiry(t *testing.T) {
 	redisPool := redis.NewPool(func() (redis.Conn, error) {
 		addr := os.Getenv("SCS_REDIS_TEST_DSN")
@@ -223,3 +270,145 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("got %v: expected %v", data, nil)
 	}
 }
+
+func TestUserTokens(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"session_token_1", "session_token_2"} {
+		err = r.Commit(token, []byte("encoded_data"), time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.BindUser(token, "alice", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = r.BindUser("missing_session_token", "alice", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Delete("session_token_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := r.UserTokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(tokens, []string{"session_token_2"}) == false {
+		t.Fatalf("got %v: expected %v", tokens, []string{"session_token_2"})
+	}
+
+	err = r.BindUser("session_token_2", "bob", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = r.UserTokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("got %v: expected %v", len(tokens), 0)
+	}
+
+	sessions, err := r.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(sessions, map[string][]byte{"session_token_2": []byte("encoded_data")}) == false {
+		t.Fatalf("got %v: expected %v", sessions, map[string][]byte{"session_token_2": []byte("encoded_data")})
+	}
+
+	err = r.UnbindUser("session_token_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.UnbindUser("missing_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = r.UserTokens("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("got %v: expected %v", len(tokens), 0)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SCS_REDIS_TEST_DSN")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	r := New(redisPool)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Alias("old_session_token", "target", time.Now().Add(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, found, err := r.FindAlias("old_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if target != "target" {
+		t.Fatalf("got %v: expected %v", target, "target")
+	}
+
+	sessions, err := r.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("got %v: expected %v", len(sessions), 0)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	_, found, err = r.FindAlias("old_session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != false {
+		t.Fatalf("got %v: expected %v", found, false)
+	}
+}
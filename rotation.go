@@ -0,0 +1,122 @@
+package scs
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrReadOnly is returned by Commit when the session data was loaded using a
+// session token which has since been replaced by token rotation, and which is
+// only kept for RotationGracePeriod so that concurrent requests can still read
+// the session data. Changes to the session data are not saved, and the client
+// should keep the session cookie it already has. The LoadAndSave middleware
+// handles this by not committing the session data or writing a cookie.
+var ErrReadOnly = errors.New("scs: session data is a read-only copy for a rotated session token")
+
+// issuedAtKey is the reserved session data key that the time the session
+// token was issued is stored under, as a Unix timestamp in nanoseconds, for
+// use with RotationInterval.
+const issuedAtKey = "__tokenIssuedAt"
+
+// graceCopyKey is the reserved session data key that marks the copy of the
+// session data kept under a rotated session token for RotationGracePeriod.
+const graceCopyKey = "__rotationGraceCopy"
+
+// rotateIfDue replaces the session token with a new one if it was issued more
+// than RotationInterval ago. Sessions without an issue time (for example,
+// those created before RotationInterval was set) are treated as if their token
+// was issued now.
+func (s *SessionManager) rotateIfDue(ctx context.Context) error {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	if sd.token == "" || sd.status == Destroyed || sd.readOnly || s.clientStore() {
+		sd.mu.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	issuedAt, ok := sd.reserved[issuedAtKey].(int64)
+	if !ok {
+		sd.setReserved(issuedAtKey, now.UnixNano())
+		sd.status = Modified
+		sd.mu.Unlock()
+		return nil
+	}
+	if now.Sub(time.Unix(0, issuedAt)) < s.RotationInterval {
+		sd.mu.Unlock()
+		return nil
+	}
+	sd.mu.Unlock()
+
+	octx, finish := s.instrument(ctx, Operation{Name: "RotateToken"})
+	oldToken, newToken, err := s.rotateToken(octx, sd)
+	finish(OperationResult{Err: err, Status: sd.currentStatus()})
+	if err != nil {
+		return err
+	}
+
+	if s.Hooks.OnRenew != nil {
+		s.Hooks.OnRenew(ctx, oldToken, newToken)
+	}
+
+	return nil
+}
+
+// rotateToken replaces the session token with a new one. Unlike renewToken,
+// the session lifetime is not reset. If RotationGracePeriod is set, the old
+// session token is not deleted straight away, so that concurrent requests
+// which still present the old token can be served. If the store implements
+// AliasStore, the old token is aliased to the new one when the session data is
+// committed. Otherwise, it is re-committed to the session store with a
+// read-only copy of the session data and a deadline at the end of the grace
+// period.
+func (s *SessionManager) rotateToken(ctx context.Context, sd *sessionData) (oldToken, newToken string, err error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	now := time.Now()
+	sd.setReserved(issuedAtKey, now.UnixNano())
+
+	oldToken = sd.token
+	if s.RotationGracePeriod > 0 && s.aliasing() {
+		sd.deferRenewal(oldToken, s.RotationGracePeriod, false)
+	} else if s.RotationGracePeriod > 0 {
+		deadline := now.Add(s.RotationGracePeriod).UTC()
+		if sd.deadline.Before(deadline) {
+			deadline = sd.deadline
+		}
+
+		// encodedValues returns a new map here, because the issue time has
+		// just been set.
+		values := sd.encodedValues()
+		values[graceCopyKey] = true
+		b, err := s.encode(ctx, oldToken, deadline, values)
+		if err != nil {
+			return "", "", err
+		}
+		err = s.doStoreCommit(ctx, oldToken, b, s.expiry(deadline))
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		err = s.doStoreDelete(ctx, oldToken)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	newToken, err = generateToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	sd.token = newToken
+	sd.version = 0
+	sd.stored = false
+	sd.status = Modified
+	_, sd.bindUser = sd.reserved[userIDKey]
+
+	return oldToken, newToken, nil
+}
@@ -0,0 +1,221 @@
+package scs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// schemaVersionKey is the reserved session data key that the schema version
+// of the session data is held under while it is loaded, for use with Upgrade.
+// It isn't passed to the Codec. Instead, encoded session data with a schema
+// version starts with a header followed by the version as a uvarint, so that
+// the version can be read without decoding the session data. The header is
+// several bytes long, so that session data encoded by a Codec which happens to
+// start with the same first byte isn't mistaken for it.
+const (
+	schemaVersionKey    = "__schemaVersion"
+	schemaVersionHeader = "\xb0scs"
+)
+
+var errInvalidSchemaVersion = errors.New("scs: invalid schema version header")
+
+// Upgrade registers a function which upgrades session data from the given
+// schema version to the next one. This is useful when the format of the
+// session data changes, for example because a key has been renamed or a
+// struct stored in the session has been replaced by a different type.
+//
+// The schema version of the session data is recorded in a header before the
+// encoded data when it is committed, and is the highest fromVersion
+// registered (with Upgrade or UpgradeCodec) plus one. Session data which was
+// committed before any upgrade functions were registered has schema version
+// 0. When session data with an older schema version is loaded, the
+// upgrade functions for each version in between are applied in order before
+// Load returns, and the session data status is set to Modified so that it is
+// committed in the new format. If an upgrade function returns an error, Load
+// returns it. Session data with a newer schema version (for example, while an
+// application is part way through being deployed) is left alone.
+//
+// Please note that upgrade functions are passed the decoded session data, so
+// the Codec, or the Codec registered for the old version with UpgradeCodec,
+// must still be able to decode it. If you are using GobCodec and replacing a
+// struct type, you should keep the old type registered (with gob.RegisterName
+// if it is renamed) until all sessions have been upgraded:
+//
+//	sessionManager.Upgrade(0, func(values map[string]interface{}) error {
+//		if old, ok := values["user"].(UserV1); ok {
+//			values["user"] = UserV2{ID: old.ID, Name: old.FirstName + " " + old.LastName}
+//		}
+//		return nil
+//	})
+//
+// Upgrade must be called before the SessionManager is used, and will panic if
+// fromVersion is negative or an upgrade function is already registered for
+// it.
+func (s *SessionManager) Upgrade(fromVersion int, fn func(values map[string]interface{}) error) {
+	if fromVersion < 0 {
+		panic(fmt.Sprintf("scs: schema version %d is negative", fromVersion))
+	}
+	if _, ok := s.upgrades[fromVersion]; ok {
+		panic(fmt.Sprintf("scs: an upgrade from schema version %d is already registered", fromVersion))
+	}
+
+	if s.upgrades == nil {
+		s.upgrades = make(map[int]func(values map[string]interface{}) error)
+	}
+	s.upgrades[fromVersion] = fn
+	if fromVersion >= s.schemaVersion {
+		s.schemaVersion = fromVersion + 1
+	}
+}
+
+// UpgradeCodec registers a Codec which is used to decode session data with
+// the given schema version if the SessionManager's Codec fails to decode it.
+// The decoded session data is then upgraded by the functions registered with
+// Upgrade, as usual. This is useful when the Codec is changed, or when a type
+// stored in the session can no longer be decoded by it:
+//
+//	sessionManager.Codec = scs.GobCodec{}
+//	sessionManager.UpgradeCodec(0, &scs.JSONCodec{})
+//
+// Like Upgrade, registering a Codec for fromVersion means that session data
+// is committed with a schema version of at least fromVersion plus one. If the
+// Codec implements TokenCodec, its methods are used. UpgradeCodec must be
+// called before the SessionManager is used, and will panic if fromVersion is
+// negative or a Codec is already registered for it.
+func (s *SessionManager) UpgradeCodec(fromVersion int, codec Codec) {
+	if fromVersion < 0 {
+		panic(fmt.Sprintf("scs: schema version %d is negative", fromVersion))
+	}
+	if _, ok := s.upgradeCodecs[fromVersion]; ok {
+		panic(fmt.Sprintf("scs: a codec for schema version %d is already registered", fromVersion))
+	}
+
+	if s.upgradeCodecs == nil {
+		s.upgradeCodecs = make(map[int]Codec)
+	}
+	s.upgradeCodecs[fromVersion] = codec
+	if fromVersion >= s.schemaVersion {
+		s.schemaVersion = fromVersion + 1
+	}
+}
+
+// upgrade applies the registered upgrade functions to session data with an
+// older schema version, and reports whether any were applied. The schema
+// version is held in the reserved state, and the upgrade functions are passed
+// the application's values. Versions which don't have an upgrade function
+// registered are skipped.
+func (s *SessionManager) upgrade(values, reserved map[string]interface{}) (bool, error) {
+	if s.schemaVersion == 0 {
+		return false, nil
+	}
+
+	version, _ := reserved[schemaVersionKey].(int)
+	if version >= s.schemaVersion {
+		return false, nil
+	}
+
+	for ; version < s.schemaVersion; version++ {
+		fn, ok := s.upgrades[version]
+		if !ok {
+			continue
+		}
+		if err := fn(values); err != nil {
+			return false, fmt.Errorf("scs: failed to upgrade session data from schema version %d: %v", version, err)
+		}
+	}
+
+	reserved[schemaVersionKey] = s.schemaVersion
+	return true, nil
+}
+
+// encodeSchema encodes the session data using the Codec. If the session data
+// has a schema version, it is written in a header before the encoded data
+// rather than being passed to the Codec.
+func (s *SessionManager) encodeSchema(key string, deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	version, _ := values[schemaVersionKey].(int)
+	if version <= 0 {
+		return encodeWith(s.Codec, key, deadline, values)
+	}
+
+	encoded := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if k != schemaVersionKey {
+			encoded[k] = v
+		}
+	}
+	b, err := encodeWith(s.Codec, key, deadline, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	h := len(schemaVersionHeader)
+	out := make([]byte, h+binary.MaxVarintLen64, h+binary.MaxVarintLen64+len(b))
+	copy(out, schemaVersionHeader)
+	n := binary.PutUvarint(out[h:], uint64(version))
+	return append(out[:h+n], b...), nil
+}
+
+// decodeSchema reads the schema version header, if there is one, and decodes
+// the rest of the session data using the Codec. If that fails, and a Codec is
+// registered for the schema version with UpgradeCodec, it is used instead.
+// Session data which was encoded without a header has schema version 0,
+// unless the version is held in its values.
+func (s *SessionManager) decodeSchema(key string, b []byte) (time.Time, map[string]interface{}, error) {
+	version, b, err := splitSchemaVersion(b)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	deadline, values, err := decodeWith(s.Codec, key, b)
+	if codec, ok := s.upgradeCodecs[version]; ok && err != nil {
+		deadline, values, err = decodeWith(codec, key, b)
+	}
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	if version > 0 {
+		if values == nil {
+			values = make(map[string]interface{})
+		}
+		values[schemaVersionKey] = version
+	}
+	return deadline, values, nil
+}
+
+// splitSchemaVersion returns the schema version recorded in the header of the
+// encoded session data b, and the data which follows it. If b doesn't start
+// with a header, it is returned unchanged with schema version 0.
+func splitSchemaVersion(b []byte) (int, []byte, error) {
+	h := len(schemaVersionHeader)
+	if len(b) < h || string(b[:h]) != schemaVersionHeader {
+		return 0, b, nil
+	}
+
+	version, n := binary.Uvarint(b[h:])
+	if n <= 0 || version > math.MaxInt32 {
+		return 0, nil, errInvalidSchemaVersion
+	}
+	return int(version), b[h+n:], nil
+}
+
+// encodeWith encodes the session data using codec, passing it the key that
+// the session data is stored under if it is a TokenCodec.
+func encodeWith(codec Codec, key string, deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	if tc, ok := codec.(TokenCodec); ok {
+		return tc.EncodeToken(key, deadline, values)
+	}
+	return codec.Encode(deadline, values)
+}
+
+// decodeWith decodes the session data using codec, passing it the key that
+// the session data is stored under if it is a TokenCodec.
+func decodeWith(codec Codec, key string, b []byte) (time.Time, map[string]interface{}, error) {
+	if tc, ok := codec.(TokenCodec); ok {
+		return tc.DecodeToken(key, b)
+	}
+	return codec.Decode(b)
+}
@@ -2,7 +2,6 @@ package scs
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"time"
 
@@ -20,6 +19,58 @@ type SessionManager struct {
 	// is not set and there is no inactivity timeout.
 	IdleTimeout time.Duration
 
+	// TouchInterval controls how often the expiry time of an unmodified session
+	// is extended when an IdleTimeout is set and the session store implements
+	// TouchStore. If set, each session will be touched at most once per
+	// TouchInterval by this SessionManager, which reduces the number of writes
+	// to the store at the cost of the idle timeout being up to TouchInterval
+	// less accurate. By default TouchInterval is not set and sessions are
+	// touched on every request.
+	TouchInterval time.Duration
+
+	// RotationInterval controls how often the session token is replaced with a
+	// new one by the LoadAndSave middleware, as a defense against session
+	// tokens which have been leaked. When a request uses a session whose token
+	// was issued more than RotationInterval ago, the token is renewed and the
+	// new token is sent to the client. Unlike RenewToken, this does not reset
+	// the session lifetime. By default RotationInterval is not set and tokens
+	// are only replaced when RenewToken is called.
+	RotationInterval time.Duration
+
+	// RotationGracePeriod controls how long the old session token remains
+	// usable after it has been replaced because of the RotationInterval, so
+	// that concurrent requests which still present the old token don't lose
+	// the session. During the grace period, the old token resolves to a
+	// read-only copy of the session data: any changes made using it are
+	// discarded, and the session cookie is left alone (Commit returns
+	// ErrReadOnly if it is called directly). The
+	// default value is 30 seconds. If the session store implements
+	// AliasStore, the old token is instead aliased to the new one, as
+	// described for RenewGracePeriod.
+	RotationGracePeriod time.Duration
+
+	// RenewGracePeriod controls how long the old session token remains usable
+	// after RenewToken has been called, so that concurrent requests which
+	// still present the old token (for example, an XHR request sent while a
+	// login request is in flight) don't lose the session. It only has an
+	// effect if the session store implements AliasStore. If set, the old token
+	// is replaced by an alias to the new token when the session data is
+	// committed, and requests which present the old token during the grace
+	// period use the new session and are sent the new token.
+	//
+	// Because RenewToken is called when privilege levels change, following an
+	// alias for the old token could let an attacker who planted it in a
+	// victim's browser take over the session once the victim logs in (session
+	// fixation). To prevent this, the alias is only followed by requests in
+	// the LoadAndSave middleware whose fingerprint matches the one the session
+	// is bound to, so RenewGracePeriod has no effect unless the Fingerprint
+	// field is also set. Other requests which present the old token get a new
+	// session and aren't sent the new token. Pick a Fingerprint which an
+	// attacker can't easily copy, and keep the grace period as short as
+	// possible. By default RenewGracePeriod is not set and the old token is
+	// deleted immediately.
+	RenewGracePeriod time.Duration
+
 	// Lifetime controls the maximum length of time that a session is valid for
 	// before it expires. The lifetime is an 'absolute expiry' which is set when
 	// the session is first created and does not change. The default value is 24
@@ -32,22 +83,129 @@ type SessionManager struct {
 	// Cookie contains the configuration settings for session cookies.
 	Cookie SessionCookie
 
+	// TokenTransport controls how the session token is communicated to and from
+	// the client by the LoadAndSave middleware. By default (when it is nil) the
+	// token is communicated in a cookie, using the settings in the Cookie
+	// field. See HeaderTransport and CompositeTransport for alternatives.
+	TokenTransport TokenTransport
+
 	// Codec controls the encoder/decoder used to transform session data to a
 	// byte slice for use by the session store. By default session data is
 	// encoded/decoded using encoding/gob.
 	Codec Codec
 
+	// Hooks contains optional callbacks which are called at points in the
+	// session lifecycle.
+	Hooks SessionHooks
+
+	// CSRF contains the configuration settings for the CSRFToken method and
+	// the CSRFProtect middleware.
+	CSRF CSRF
+
+	// Instrumentation is used to observe session operations and calls to the
+	// session store, for example to record traces and metrics. It is nil by
+	// default, in which case no instrumentation is done.
+	Instrumentation Instrumentation
+
 	// ErrorFunc allows you to control behavior when an error is encountered by
 	// the LoadAndSave middleware. The default behavior is for a HTTP 500
 	// "Internal Server Error" message to be sent to the client and the error
-	// logged using Go's standard logger. If a custom ErrorFunc is set, then
-	// control will be passed to this instead. A typical use would be to provide
-	// a function which logs the error and returns a customized HTML error page.
+	// logged using the Logger. If a custom ErrorFunc is set, then control will
+	// be passed to this instead. A typical use would be to provide a function
+	// which logs the error and returns a customized HTML error page.
 	ErrorFunc func(http.ResponseWriter, *http.Request, error)
 
+	// Logger is the structured logger used to log errors and other events,
+	// such as fingerprint mismatches. It is satisfied by *slog.Logger. Log
+	// records have attributes including the store type, the operation and a
+	// hash of the session token. If it is not set, Go's standard logger is
+	// used.
+	Logger Logger
+
+	// ConflictPolicy controls what happens when two concurrent requests modify
+	// the same session. By default it is set to LastWriteWins, which means that
+	// the session data committed by the last request overwrites any changes
+	// made by other requests. If the session store implements VersionedStore,
+	// you can set this to RetryOnConflict or ErrorOnConflict to enable
+	// optimistic concurrency control. If the store does not implement
+	// VersionedStore, this setting has no effect.
+	ConflictPolicy ConflictPolicy
+
+	// MergeChanges controls whether Commit only writes the keys which have been
+	// changed in the current request. If set to true, Commit re-reads the
+	// session data from the store and merges in the changed keys before
+	// writing it back, so that keys written by concurrent requests are not
+	// lost. If the session store implements MergeStore, the read and write
+	// happen atomically within the store. If the session has been destroyed
+	// by a concurrent request, it is not brought back: only the application
+	// keys changed in the current request are written, or nothing if there
+	// are none. The default value is false. This
+	// setting is ignored if optimistic concurrency control is enabled via
+	// ConflictPolicy.
+	MergeChanges bool
+
+	// LazyLoad controls whether the LoadAndSave middleware defers retrieving
+	// the session data from the store until it is first accessed (for example
+	// by calling Get, Put or Keys). If the session data is not accessed during
+	// a request, then no calls are made to the store at all, and the expiry
+	// time of the session will not be extended by the IdleTimeout. If
+	// retrieving the session data fails, the session is treated as empty for
+	// the rest of the request, it will not be committed, and the error will be
+	// passed to ErrorFunc. The default value is false.
+	LazyLoad bool
+
+	// TrackMetadata controls whether the LoadAndSave middleware records
+	// metadata about each session (the creation time, last activity time,
+	// client IP address and user agent), which can be read with the Metadata
+	// method. The metadata is kept separately from the session data values,
+	// but it is committed to the store with them, so recording it means the
+	// session data is re-committed. To limit this, the last activity time is
+	// only updated at most once per TouchInterval (or once a minute if
+	// TouchInterval isn't set), unless the client IP address or user agent
+	// have changed. Metadata is not
+	// recorded for new sessions until they are modified. The default value is
+	// false.
+	TrackMetadata bool
+
+	// Fingerprint is a function which returns a fingerprint of the client
+	// making a request, for example UserAgentFingerprint, IPPrefixFingerprint,
+	// TLSClientCertFingerprint or a combination of them made with
+	// CombineFingerprints. If set, the LoadAndSave middleware binds each
+	// session to the fingerprint of the request it was created in, and applies
+	// the FingerprintPolicy when the session is loaded by a request with a
+	// different fingerprint. This limits the reuse of stolen session tokens.
+	// By default Fingerprint is nil and sessions are not bound.
+	Fingerprint func(r *http.Request) string
+
+	// FingerprintPolicy controls what happens when a session is loaded by a
+	// request whose fingerprint doesn't match the one the session is bound to.
+	// The default value is DestroyOnMismatch.
+	FingerprintPolicy FingerprintPolicy
+
 	// HashTokenInStore controls whether or not to store the session token or a hashed version in the store.
 	HashTokenInStore bool
 
+	// TokenEncryption, if set, encrypts the session data in the store with a
+	// key derived from the session token. Because the store only sees a hash
+	// of the token, the session data can't be decrypted by anyone with access
+	// to the store unless they also have the token. It requires
+	// HashTokenInStore to be set (LoadAndSave and Load panic if it isn't),
+	// and has no effect if the store is a ClientStore. By default
+	// TokenEncryption is nil and session data is not encrypted with the token.
+	TokenEncryption *TokenEncryption
+
+	// touches records when sessions were last touched, for use with
+	// TouchInterval.
+	touches touchThrottle
+
+	// upgrades and upgradeCodecs hold the functions and codecs registered
+	// with Upgrade and UpgradeCodec, keyed by the schema version that they
+	// upgrade from, and schemaVersion is the schema version that session data
+	// is upgraded to.
+	upgrades      map[int]func(values map[string]interface{}) error
+	upgradeCodecs map[int]Codec
+	schemaVersion int
+
 	// contextKey is the key used to set and retrieve the session data from a
 	// context.Context. It's automatically generated to ensure uniqueness.
 	contextKey contextKey
@@ -101,16 +259,51 @@ type SessionCookie struct {
 	Persist bool
 }
 
+// SessionHooks contains optional callbacks which are called at points in the
+// session lifecycle, for example to write an audit log. Each callback is passed
+// the context.Context for the session, so it can read other values from it
+// (including session data). The callbacks are called synchronously, and any
+// that are nil are skipped.
+type SessionHooks struct {
+	// OnCreate is called by Commit when a new session token has been generated
+	// and the session data has been saved to the store for the first time.
+	OnCreate func(ctx context.Context, token string)
+
+	// OnRenew is called when RenewToken replaces the session token, or when
+	// it is replaced because of the RotationInterval. The old token will be
+	// the empty string "" if the session had not yet been committed.
+	OnRenew func(ctx context.Context, oldToken, newToken string)
+
+	// OnDestroy is called when Destroy has deleted the session data from the
+	// store. By this point the session data in ctx has already been cleared.
+	// The token will be the empty string "" if the session had not yet been
+	// committed.
+	OnDestroy func(ctx context.Context, token string)
+
+	// OnCommit is called after every successful commit of the session data to
+	// the store.
+	OnCommit func(ctx context.Context, token string, expiry time.Time)
+
+	// OnLoadError is called when the session data for a token can't be loaded
+	// from the store.
+	OnLoadError func(ctx context.Context, token string, err error)
+
+	// OnFingerprintMismatch is called when a session is loaded by a request
+	// whose fingerprint doesn't match the one the session is bound to, before
+	// the FingerprintPolicy is applied.
+	OnFingerprintMismatch func(ctx context.Context, token string)
+}
+
 // New returns a new session manager with the default options. It is safe for
 // concurrent use.
 func New() *SessionManager {
 	s := &SessionManager{
-		IdleTimeout: 0,
-		Lifetime:    24 * time.Hour,
-		Store:       memstore.New(),
-		Codec:       GobCodec{},
-		ErrorFunc:   defaultErrorFunc,
-		contextKey:  generateContextKey(),
+		IdleTimeout:         0,
+		Lifetime:            24 * time.Hour,
+		RotationGracePeriod: 30 * time.Second,
+		Store:               memstore.New(),
+		Codec:               GobCodec{},
+		contextKey:          generateContextKey(),
 		Cookie: SessionCookie{
 			Name:        "session",
 			Domain:      "",
@@ -121,7 +314,13 @@ func New() *SessionManager {
 			Partitioned: false,
 			Persist:     true,
 		},
+		CSRF: CSRF{
+			FieldName:  defaultCSRFFieldName,
+			HeaderName: defaultCSRFHeaderName,
+			ErrorFunc:  defaultCSRFErrorFunc,
+		},
 	}
+	s.ErrorFunc = s.defaultErrorFunc
 	return s
 }
 
@@ -133,20 +332,35 @@ func NewSession() *SessionManager {
 
 // LoadAndSave provides middleware which automatically loads and saves session
 // data for the current request, and communicates the session token to and from
-// the client in a cookie.
+// the client using the TokenTransport (by default in a cookie).
 func (s *SessionManager) LoadAndSave(next http.Handler) http.Handler {
+	s.checkTokenEncryption()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Vary", "Cookie")
+		transport := s.tokenTransport()
+		if v, ok := transport.(Varier); ok {
+			for _, header := range v.Vary() {
+				w.Header().Add("Vary", header)
+			}
+		}
 
-		var token string
-		cookie, err := r.Cookie(s.Cookie.Name)
-		if err == nil {
-			token = cookie.Value
+		token := transport.ReadToken(r)
+		req := s.newLoadRequest(r)
+
+		var ctx context.Context
+		if s.LazyLoad {
+			ctx = s.loadLazy(r.Context(), token)
+		} else {
+			var err error
+			ctx, err = s.load(r.Context(), token, req)
+			if err != nil {
+				s.serveError(w, r, "Load", err)
+				return
+			}
 		}
 
-		ctx, err := s.Load(r.Context(), token)
-		if err != nil {
-			s.ErrorFunc(w, r, err)
+		if err := s.bindRequest(ctx, req); err != nil {
+			s.serveError(w, r, "Fingerprint", err)
 			return
 		}
 
@@ -156,30 +370,75 @@ func (s *SessionManager) LoadAndSave(next http.Handler) http.Handler {
 			ResponseWriter: w,
 			request:        sr,
 			sessionManager: s,
+			transport:      responseTransport(transport, r),
 		}
 
 		next.ServeHTTP(sw, sr)
 
 		if !sw.written {
-			s.commitAndWriteSessionCookie(w, sr)
+			s.commitAndWriteSessionCookie(w, sr, sw.transport)
 		}
 	})
 }
 
-func (s *SessionManager) commitAndWriteSessionCookie(w http.ResponseWriter, r *http.Request) {
+func (s *SessionManager) commitAndWriteSessionCookie(w http.ResponseWriter, r *http.Request, transport TokenTransport) {
 	ctx := r.Context()
 
+	// If the session data was loaded lazily and has not been accessed, then it
+	// can't have been changed and there is nothing to do.
+	sd := s.getPendingSessionDataFromContext(ctx)
+	sd.mu.Lock()
+	pending, loadErr, readOnly := sd.pending, sd.loadErr, sd.readOnly
+	sd.mu.Unlock()
+	if pending {
+		return
+	}
+	if loadErr != nil {
+		s.serveError(w, r, "Load", loadErr)
+		return
+	}
+
+	// Session data loaded using a rotated session token is never committed,
+	// and the client keeps the cookie it was sent with the new token, unless
+	// the session is being destroyed.
+	if readOnly && s.Status(ctx) != Destroyed {
+		return
+	}
+
+	if s.TrackMetadata {
+		s.recordMetadata(ctx, r)
+	}
+
+	if s.RotationInterval > 0 {
+		if err := s.rotateIfDue(ctx); err != nil {
+			s.serveError(w, r, "RotateToken", err)
+			return
+		}
+	}
+
 	switch s.Status(ctx) {
 	case Modified:
 		token, expiry, err := s.Commit(ctx)
 		if err != nil {
-			s.ErrorFunc(w, r, err)
+			s.serveError(w, r, "Commit", err)
 			return
 		}
 
-		s.WriteSessionCookie(ctx, w, token, expiry)
+		transport.WriteToken(ctx, w, token, expiry)
+	case Unmodified:
+		token, expiry, touched, err := s.touch(ctx)
+		if err != nil {
+			s.serveError(w, r, "Touch", err)
+			return
+		}
+
+		if touched {
+			transport.WriteToken(ctx, w, token, expiry)
+		} else if token, expiry, reissue := s.reissueToken(ctx); reissue {
+			transport.WriteToken(ctx, w, token, expiry)
+		}
 	case Destroyed:
-		s.WriteSessionCookie(ctx, w, "", time.Time{})
+		transport.WriteToken(ctx, w, "", time.Time{})
 	}
 }
 
@@ -208,7 +467,7 @@ func (s *SessionManager) WriteSessionCookie(ctx context.Context, w http.Response
 	if expiry.IsZero() {
 		cookie.Expires = time.Unix(1, 0)
 		cookie.MaxAge = -1
-	} else if s.Cookie.Persist || s.GetBool(ctx, "__rememberMe") {
+	} else if s.Cookie.Persist || s.rememberMe(ctx) {
 		cookie.Expires = time.Unix(expiry.Unix()+1, 0)        // Round up to the nearest second.
 		cookie.MaxAge = int(time.Until(expiry).Seconds() + 1) // Round up to the nearest second.
 	}
@@ -217,21 +476,17 @@ func (s *SessionManager) WriteSessionCookie(ctx context.Context, w http.Response
 	w.Header().Add("Cache-Control", `no-cache="Set-Cookie"`)
 }
 
-func defaultErrorFunc(w http.ResponseWriter, r *http.Request, err error) {
-	log.Output(2, err.Error())
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-}
-
 type sessionResponseWriter struct {
 	http.ResponseWriter
 	request        *http.Request
 	sessionManager *SessionManager
+	transport      TokenTransport
 	written        bool
 }
 
 func (sw *sessionResponseWriter) Write(b []byte) (int, error) {
 	if !sw.written {
-		sw.sessionManager.commitAndWriteSessionCookie(sw.ResponseWriter, sw.request)
+		sw.sessionManager.commitAndWriteSessionCookie(sw.ResponseWriter, sw.request, sw.transport)
 		sw.written = true
 	}
 
@@ -240,7 +495,7 @@ func (sw *sessionResponseWriter) Write(b []byte) (int, error) {
 
 func (sw *sessionResponseWriter) WriteHeader(code int) {
 	if !sw.written {
-		sw.sessionManager.commitAndWriteSessionCookie(sw.ResponseWriter, sw.request)
+		sw.sessionManager.commitAndWriteSessionCookie(sw.ResponseWriter, sw.request, sw.transport)
 		sw.written = true
 	}
 
@@ -12,8 +12,13 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/alexedwards/scs/v2/cookiestore"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/alexedwards/scs/v2/mockstore"
 )
 
 type testServer struct {
@@ -348,3 +353,955 @@ func TestIterate(t *testing.T) {
 		t.Fatal("didn't get expected error")
 	}
 }
+
+// countingStore wraps a Store and counts the number of calls to Find, Commit
+// and Touch.
+type countingStore struct {
+	Store
+	mu      sync.Mutex
+	finds   int
+	commits int
+	touches int
+}
+
+func (c *countingStore) Find(token string) ([]byte, bool, error) {
+	c.mu.Lock()
+	c.finds++
+	c.mu.Unlock()
+	return c.Store.Find(token)
+}
+
+func (c *countingStore) Commit(token string, b []byte, expiry time.Time) error {
+	c.mu.Lock()
+	c.commits++
+	c.mu.Unlock()
+	return c.Store.Commit(token, b, expiry)
+}
+
+func (c *countingStore) findCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.finds
+}
+
+func (c *countingStore) counts() (commits, touches int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commits, c.touches
+}
+
+// countingTouchStore is a countingStore which also implements TouchStore.
+type countingTouchStore struct {
+	*countingStore
+}
+
+func (c countingTouchStore) Touch(token string, expiry time.Time) error {
+	c.mu.Lock()
+	c.touches++
+	c.mu.Unlock()
+	return c.Store.(TouchStore).Touch(token, expiry)
+}
+
+func TestLazyLoad(t *testing.T) {
+	t.Parallel()
+
+	store := &countingStore{Store: memstore.New()}
+
+	sessionManager := New()
+	sessionManager.Store = store
+	sessionManager.IdleTimeout = time.Hour
+	sessionManager.LazyLoad = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+	mux.HandleFunc("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put")
+	token1 := extractTokenFromCookie(header.Get("Set-Cookie"))
+	if store.findCount() != 0 {
+		t.Errorf("want %d finds; got %d", 0, store.findCount())
+	}
+
+	header, _ = ts.execute(t, "/health")
+	if header.Get("Set-Cookie") != "" {
+		t.Errorf("want %q; got %q", "", header.Get("Set-Cookie"))
+	}
+	if store.findCount() != 0 {
+		t.Errorf("want %d finds; got %d", 0, store.findCount())
+	}
+
+	header, body := ts.execute(t, "/get")
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+	if store.findCount() != 1 {
+		t.Errorf("want %d finds; got %d", 1, store.findCount())
+	}
+
+	// The idle timeout should still cause the session to be re-committed once
+	// it has been accessed.
+	token2 := extractTokenFromCookie(header.Get("Set-Cookie"))
+	if token1 != token2 {
+		t.Error("want tokens to be the same")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name            string
+		touchInterval   time.Duration
+		lazyLoad        bool
+		expectedTouches int
+	}{
+		{"every request", 0, false, 2},
+		{"throttled", time.Hour, false, 0},
+		{"lazy load", 0, true, 2},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := countingTouchStore{&countingStore{Store: memstore.New()}}
+
+			sessionManager := New()
+			sessionManager.Store = store
+			sessionManager.IdleTimeout = time.Hour
+			sessionManager.TouchInterval = tc.touchInterval
+			sessionManager.LazyLoad = tc.lazyLoad
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sessionManager.Put(r.Context(), "foo", "bar")
+			}))
+			mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+			}))
+
+			ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+			defer ts.Close()
+
+			header, _ := ts.execute(t, "/put")
+			token := extractTokenFromCookie(header.Get("Set-Cookie"))
+
+			for i := 0; i < 2; i++ {
+				header, body := ts.execute(t, "/get")
+				if body != "bar" {
+					t.Errorf("want %q; got %q", "bar", body)
+				}
+				if tc.expectedTouches > 0 && header.Get("Set-Cookie") == "" {
+					t.Error("want Set-Cookie header to be set")
+				}
+			}
+
+			commits, touches := store.counts()
+			if commits != 1 {
+				t.Errorf("want %d commits; got %d", 1, commits)
+			}
+			if touches != tc.expectedTouches {
+				t.Errorf("want %d touches; got %d", tc.expectedTouches, touches)
+			}
+
+			// Outside of LoadAndSave, the session can only be extended by
+			// committing it, so it is marked as modified.
+			ctx, err := sessionManager.Load(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := sessionManager.Status(ctx); status != Modified {
+				t.Errorf("want %d; got %d", Modified, status)
+			}
+		})
+	}
+}
+
+func TestClientStore(t *testing.T) {
+	t.Parallel()
+
+	store, err := cookiestore.New([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionManager := New()
+	sessionManager.Store = store
+	sessionManager.HashTokenInStore = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+	mux.HandleFunc("/destroy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := sessionManager.Destroy(r.Context()); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put")
+	token := extractTokenFromCookie(header.Get("Set-Cookie"))
+	b, found, err := store.Find(token)
+	if err != nil || !found {
+		t.Fatalf("want sealed session data in token; got %v %v", found, err)
+	}
+	if len(b) == 0 {
+		t.Error("want sealed session data to be non-empty")
+	}
+
+	_, body := ts.execute(t, "/get")
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+
+	ts.execute(t, "/destroy")
+	_, body = ts.execute(t, "/get")
+	if body != "" {
+		t.Errorf("want %q; got %q", "", body)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	sessionManager := New()
+	sessionManager.Hooks = SessionHooks{
+		OnCreate: func(ctx context.Context, token string) {
+			record("create")
+		},
+		OnRenew: func(ctx context.Context, oldToken, newToken string) {
+			if oldToken == "" || newToken == "" || oldToken == newToken {
+				t.Errorf("unexpected tokens %q and %q", oldToken, newToken)
+			}
+			record("renew")
+		},
+		OnDestroy: func(ctx context.Context, token string) {
+			// The session data should be accessible from the hook.
+			record("destroy:" + sessionManager.GetString(ctx, "foo"))
+		},
+		OnCommit: func(ctx context.Context, token string, expiry time.Time) {
+			record("commit:" + sessionManager.GetString(ctx, "foo"))
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/renew", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := sessionManager.RenewToken(r.Context()); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	}))
+	mux.HandleFunc("/destroy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := sessionManager.Destroy(r.Context()); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	ts.execute(t, "/put")
+	ts.execute(t, "/renew")
+	ts.execute(t, "/destroy")
+
+	expected := []string{"create", "commit:bar", "renew", "commit:bar", "destroy:"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("want %v; got %v", expected, events)
+	}
+}
+
+func TestOnLoadErrorHook(t *testing.T) {
+	t.Parallel()
+
+	store := &mockstore.MockStore{}
+	store.ExpectFind("bad_token", nil, false, errors.New("forced failure"))
+
+	var hookErr error
+	sessionManager := New()
+	sessionManager.Store = store
+	sessionManager.Hooks.OnLoadError = func(ctx context.Context, token string, err error) {
+		if token != "bad_token" {
+			t.Errorf("want %q; got %q", "bad_token", token)
+		}
+		hookErr = err
+	}
+
+	_, err := sessionManager.Load(context.Background(), "bad_token")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if hookErr != err {
+		t.Errorf("want %v; got %v", err, hookErr)
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	t.Parallel()
+
+	type iterableOnly struct {
+		Store
+		IterableStore
+	}
+
+	for _, tc := range []struct {
+		name  string
+		store func(*memstore.MemStore) Store
+	}{
+		{"UserIndexStore", func(m *memstore.MemStore) Store { return m }},
+		{"IterableStore", func(m *memstore.MemStore) Store { return iterableOnly{m, m} }},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			sessionManager := New()
+			sessionManager.Store = tc.store(memstore.NewWithCleanupInterval(0))
+			sessionManager.HashTokenInStore = true
+
+			login := func(userID string) context.Context {
+				ctx, err := sessionManager.Load(context.Background(), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				sessionManager.SetUserID(ctx, userID)
+				if _, _, err := sessionManager.Commit(ctx); err != nil {
+					t.Fatal(err)
+				}
+				return ctx
+			}
+
+			alice1 := login("alice")
+			alice2 := login("alice")
+			bob := login("bob")
+
+			// The user ID should be carried over when the token is renewed.
+			if err := sessionManager.RenewToken(alice2); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := sessionManager.Commit(alice2); err != nil {
+				t.Fatal(err)
+			}
+			if sessionManager.UserID(alice2) != "alice" {
+				t.Fatalf("got %q: expected %q", sessionManager.UserID(alice2), "alice")
+			}
+
+			tokens, err := sessionManager.ListUserSessions(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(tokens)
+			expected := []string{hashToken(sessionManager.Token(alice1)), hashToken(sessionManager.Token(alice2))}
+			sort.Strings(expected)
+			if !reflect.DeepEqual(tokens, expected) {
+				t.Fatalf("got %v: expected %v", tokens, expected)
+			}
+
+			// Logging out without destroying the session should remove it from
+			// the user's sessions, whether the user ID is unbound directly or
+			// by clearing the session data.
+			for _, logout := range []func(context.Context){
+				sessionManager.UnbindUser,
+				func(ctx context.Context) { sessionManager.SetUserID(ctx, "") },
+				func(ctx context.Context) { sessionManager.Clear(ctx) },
+			} {
+				ctx := login("carol")
+				logout(ctx)
+				if _, _, err := sessionManager.Commit(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if sessionManager.UserID(ctx) != "" {
+					t.Fatalf("got %q: expected %q", sessionManager.UserID(ctx), "")
+				}
+				tokens, err := sessionManager.ListUserSessions(context.Background(), "carol")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tokens) != 0 {
+					t.Fatalf("got %v: expected %v", tokens, []string{})
+				}
+			}
+
+			err = sessionManager.DestroyUserSessions(alice1, "alice", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ctx := range []context.Context{alice1, alice2, bob} {
+				_, found, err := sessionManager.Store.Find(hashToken(sessionManager.Token(ctx)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected := ctx != alice2; found != expected {
+					t.Errorf("got %v: expected %v", found, expected)
+				}
+			}
+
+			err = sessionManager.DestroyUserSessions(alice1, "alice", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sessionManager.Status(alice1) != Destroyed {
+				t.Fatalf("got %v: expected %v", sessionManager.Status(alice1), Destroyed)
+			}
+			tokens, err = sessionManager.ListUserSessions(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != 0 {
+				t.Fatalf("got %v: expected %v", len(tokens), 0)
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	t.Parallel()
+
+	// Without a TouchInterval, the last activity time is updated at most once
+	// per defaultMetadataInterval.
+	for _, interval := range []time.Duration{0, time.Hour} {
+		interval := interval
+		t.Run(interval.String(), func(t *testing.T) {
+			t.Parallel()
+
+			sessionManager := New()
+			sessionManager.TrackMetadata = true
+			sessionManager.TouchInterval = interval
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sessionManager.Put(r.Context(), "foo", "bar")
+			}))
+			mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				md := sessionManager.Metadata(r.Context())
+				w.Write([]byte(md.IP + " " + md.UserAgent))
+			}))
+
+			ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+			defer ts.Close()
+
+			header, _ := ts.execute(t, "/get")
+			if header.Get("Set-Cookie") != "" {
+				t.Errorf("want %q; got %q", "", header.Get("Set-Cookie"))
+			}
+
+			ts.execute(t, "/put")
+
+			header, body := ts.execute(t, "/get")
+			if body != "127.0.0.1 Go-http-client/1.1" {
+				t.Errorf("want %q; got %q", "127.0.0.1 Go-http-client/1.1", body)
+			}
+			if header.Get("Set-Cookie") != "" {
+				t.Errorf("want %q; got %q", "", header.Get("Set-Cookie"))
+			}
+
+			var md Metadata
+			err := sessionManager.Iterate(context.Background(), func(ctx context.Context) error {
+				md = sessionManager.Metadata(ctx)
+				if keys := sessionManager.Keys(ctx); !reflect.DeepEqual(keys, []string{"foo"}) {
+					t.Errorf("want %v; got %v", []string{"foo"}, keys)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if md.CreatedAt.IsZero() || md.LastSeen.Before(md.CreatedAt) {
+				t.Errorf("unexpected times: created %v, last seen %v", md.CreatedAt, md.LastSeen)
+			}
+			if md.IP != "127.0.0.1" {
+				t.Errorf("want %q; got %q", "127.0.0.1", md.IP)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []FingerprintPolicy{DestroyOnMismatch, NewSessionOnMismatch, HookOnMismatch} {
+		policy := policy
+		t.Run(strconv.Itoa(int(policy)), func(t *testing.T) {
+			t.Parallel()
+
+			var mismatches int
+			sessionManager := New()
+			sessionManager.Fingerprint = UserAgentFingerprint
+			sessionManager.FingerprintPolicy = policy
+			sessionManager.Hooks.OnFingerprintMismatch = func(ctx context.Context, token string) {
+				mismatches++
+			}
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sessionManager.Put(r.Context(), "foo", "bar")
+			}))
+			mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+			}))
+			mux.HandleFunc("/rebind", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sessionManager.Rebind(r.Context())
+			}))
+
+			ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+			defer ts.Close()
+
+			execute := func(urlPath, userAgent string) (http.Header, string) {
+				req, err := http.NewRequest("GET", ts.URL+urlPath, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("User-Agent", userAgent)
+				rs, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rs.Body.Close()
+				body, err := ioutil.ReadAll(rs.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return rs.Header, string(body)
+			}
+
+			execute("/put", "browser-a")
+
+			_, body := execute("/get", "browser-a")
+			if body != "bar" {
+				t.Errorf("want %q; got %q", "bar", body)
+			}
+
+			header, body := execute("/get", "browser-b")
+			if mismatches != 1 {
+				t.Errorf("want %d; got %d", 1, mismatches)
+			}
+
+			switch policy {
+			case DestroyOnMismatch:
+				if body != "" {
+					t.Errorf("want %q; got %q", "", body)
+				}
+				if !strings.HasPrefix(header.Get("Set-Cookie"), "session=;") {
+					t.Errorf("want session cookie to be cleared; got %q", header.Get("Set-Cookie"))
+				}
+				_, body = execute("/get", "browser-a")
+				if body != "" {
+					t.Errorf("want %q; got %q", "", body)
+				}
+			case NewSessionOnMismatch:
+				if body != "" {
+					t.Errorf("want %q; got %q", "", body)
+				}
+				_, body = execute("/get", "browser-a")
+				if body != "bar" {
+					t.Errorf("want %q; got %q", "bar", body)
+				}
+			case HookOnMismatch:
+				if body != "bar" {
+					t.Errorf("want %q; got %q", "bar", body)
+				}
+				execute("/rebind", "browser-b")
+				_, body = execute("/get", "browser-b")
+				if body != "bar" {
+					t.Errorf("want %q; got %q", "bar", body)
+				}
+				if mismatches != 2 {
+					t.Errorf("want %d; got %d", 2, mismatches)
+				}
+			}
+		})
+	}
+}
+
+func TestRotationInterval(t *testing.T) {
+	t.Parallel()
+
+	// The store is wrapped so that it doesn't implement AliasStore, and the
+	// old token is kept with a copy of the session data.
+	sessionManager := New()
+	sessionManager.Store = struct{ Store }{memstore.New()}
+	sessionManager.RotationInterval = 200 * time.Millisecond
+	sessionManager.RotationGracePeriod = 200 * time.Millisecond
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", r.URL.Query().Get("foo"))
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put?foo=bar")
+	token1 := extractTokenFromCookie(header.Get("Set-Cookie"))
+
+	header, _ = ts.execute(t, "/get")
+	if header.Get("Set-Cookie") != "" {
+		t.Errorf("want %q; got %q", "", header.Get("Set-Cookie"))
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	header, body := ts.execute(t, "/get")
+	if body != "bar" {
+		t.Errorf("want %q; got %q", "bar", body)
+	}
+	token2 := extractTokenFromCookie(header.Get("Set-Cookie"))
+	if token1 == token2 {
+		t.Error("want tokens to be different")
+	}
+
+	// The old token should still resolve during the grace period.
+	ctx, err := sessionManager.Load(context.Background(), token1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionManager.GetString(ctx, "foo") != "bar" {
+		t.Errorf("want %q; got %q", "bar", sessionManager.GetString(ctx, "foo"))
+	}
+
+	// A request which still presents the old token must not write the copy
+	// back or send the old token to the client, which would replace the
+	// cookie with the new token.
+	req := httptest.NewRequest("GET", "/put?foo=baz", nil)
+	req.AddCookie(&http.Cookie{Name: sessionManager.Cookie.Name, Value: token1})
+	rr := httptest.NewRecorder()
+	sessionManager.LoadAndSave(mux).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Header().Get("Set-Cookie") != "" {
+		t.Errorf("want %q; got %q", "", rr.Header().Get("Set-Cookie"))
+	}
+
+	sessionManager.Put(ctx, "foo", "baz")
+	if _, _, err := sessionManager.Commit(ctx); err != ErrReadOnly {
+		t.Errorf("want %v; got %v", ErrReadOnly, err)
+	}
+
+	ctx, err = sessionManager.Load(context.Background(), token2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionManager.GetString(ctx, "foo") != "bar" {
+		t.Errorf("want %q; got %q", "bar", sessionManager.GetString(ctx, "foo"))
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	_, found, err := sessionManager.Store.Find(token1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("want old token to have expired")
+	}
+}
+
+func TestRenewGracePeriod(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.RenewGracePeriod = time.Minute
+	sessionManager.HashTokenInStore = true
+	sessionManager.Fingerprint = UserAgentFingerprint
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/renew", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := sessionManager.RenewToken(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		sessionManager.Put(r.Context(), "foo", "baz")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	header, _ := ts.execute(t, "/put")
+	oldToken := extractTokenFromCookie(header.Get("Set-Cookie"))
+
+	header, _ = ts.execute(t, "/renew")
+	newToken := extractTokenFromCookie(header.Get("Set-Cookie"))
+	if oldToken == newToken {
+		t.Fatal("want tokens to be different")
+	}
+
+	_, found, err := sessionManager.Store.Find(hashToken(oldToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("want old session data to be deleted")
+	}
+
+	get := func(token, userAgent string) (string, string) {
+		req, err := http.NewRequest("GET", ts.URL+"/get", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Cookie", "session="+token)
+		req.Header.Set("User-Agent", userAgent)
+
+		client := &http.Client{Transport: ts.Client().Transport}
+		rs, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		body, err := ioutil.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body), rs.Header.Get("Set-Cookie")
+	}
+
+	// A request from the same client which presents the old token should use
+	// the new session, and be sent the new token.
+	body, cookie := get(oldToken, "Go-http-client/1.1")
+	if body != "baz" {
+		t.Errorf("want %q; got %q", "baz", body)
+	}
+	if token := extractTokenFromCookie(cookie); token != newToken {
+		t.Errorf("want %q; got %q", newToken, token)
+	}
+
+	// A request from a different client which presents the old token (for
+	// example, one which planted it before the victim logged in) should not.
+	body, cookie = get(oldToken, "attacker")
+	if body != "" {
+		t.Errorf("want %q; got %q", "", body)
+	}
+	if cookie != "" {
+		t.Errorf("want no cookie; got %q", cookie)
+	}
+
+	// Manual calls to Load don't follow aliases for renewed tokens either.
+	ctx, err := sessionManager.Load(context.Background(), oldToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sessionManager.GetString(ctx, "foo"); got != "" {
+		t.Errorf("want %q; got %q", "", got)
+	}
+}
+
+type testInstrumentation struct {
+	mu  sync.Mutex
+	ops []string
+}
+
+func (i *testInstrumentation) StartOperation(ctx context.Context, op Operation) (context.Context, func(OperationResult)) {
+	return ctx, func(res OperationResult) {
+		name := op.Name
+		if op.Store {
+			name = "store." + name
+		}
+		if op.Codec {
+			name = "codec." + name
+		}
+		if op.Reads {
+			name = fmt.Sprintf("%s(found=%t)", name, res.Found)
+		}
+		if op.StoreType != "*memstore.MemStore" {
+			name += " " + op.StoreType
+		}
+		i.mu.Lock()
+		i.ops = append(i.ops, name)
+		i.mu.Unlock()
+	}
+}
+
+func (i *testInstrumentation) reset() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	ops := i.ops
+	i.ops = nil
+	return ops
+}
+
+func TestInstrumentation(t *testing.T) {
+	t.Parallel()
+
+	instrumentation := &testInstrumentation{}
+	sessionManager := New()
+	sessionManager.Instrumentation = instrumentation
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.GetString(r.Context(), "foo")
+	}))
+	mux.HandleFunc("/renew", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := sessionManager.RenewToken(r.Context()); err != nil {
+			t.Error(err)
+		}
+	}))
+	mux.HandleFunc("/destroy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := sessionManager.Destroy(r.Context()); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	ts := newTestServer(t, sessionManager.LoadAndSave(mux))
+	defer ts.Close()
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/put", []string{"Load(found=false)", "codec.Encode", "store.Commit", "Commit"}},
+		{"/get", []string{"store.Find(found=true)", "codec.Decode", "Load(found=true)"}},
+		{"/renew", []string{"store.Find(found=true)", "codec.Decode", "Load(found=true)", "store.Delete", "RenewToken", "codec.Encode", "store.Commit", "Commit"}},
+		{"/destroy", []string{"store.Find(found=true)", "codec.Decode", "Load(found=true)", "store.Delete", "Destroy"}},
+	}
+
+	for _, tt := range tests {
+		ts.execute(t, tt.path)
+		got := instrumentation.reset()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: want %v; got %v", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestInstrumentationOptionalStores(t *testing.T) {
+	t.Parallel()
+
+	instrumentation := &testInstrumentation{}
+	sessionManager := New()
+	sessionManager.Instrumentation = instrumentation
+	sessionManager.RenewGracePeriod = time.Minute
+
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.SetUserID(ctx, "alice")
+	oldToken, _, err := sessionManager.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessionManager.ListUserSessions(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Load(found=false)", "codec.Encode", "store.Commit", "store.BindUser", "Commit", "store.UserTokens"}
+	if got := instrumentation.reset(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v; got %v", want, got)
+	}
+
+	ctx, err = sessionManager.Load(context.Background(), oldToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionManager.RenewToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sessionManager.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessionManager.Load(context.Background(), oldToken); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []string{
+		"store.Find(found=true)", "codec.Decode", "Load(found=true)",
+		"RenewToken",
+		"codec.Encode", "store.Commit", "store.Delete", "store.Alias", "store.BindUser", "Commit",
+		"store.Find(found=false)", "store.FindAlias(found=true)", "store.Find(found=true)", "codec.Decode", "Load(found=false)",
+	}
+	if got := instrumentation.reset(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v; got %v", want, got)
+	}
+}
+
+func TestCombineInstrumentation(t *testing.T) {
+	t.Parallel()
+
+	first := &testInstrumentation{}
+	second := &testInstrumentation{}
+	sessionManager := New()
+	sessionManager.Instrumentation = CombineInstrumentation(first, second)
+
+	ctx, err := sessionManager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionManager.Put(ctx, "foo", "bar")
+	if _, _, err := sessionManager.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Load(found=false)", "codec.Encode", "store.Commit", "Commit"}
+	for _, instrumentation := range []*testInstrumentation{first, second} {
+		if got := instrumentation.reset(); !reflect.DeepEqual(got, want) {
+			t.Errorf("want %v; got %v", want, got)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+
+	for i := 0; i < 3; i++ {
+		ctx, err := sessionManager.Load(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionManager.Put(ctx, "foo", i)
+		if _, _, err := sessionManager.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := sessionManager.Count(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("want %d; got %d", 3, count)
+	}
+}
@@ -1,15 +1,52 @@
 package sqlite3store
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // SQLite3Store represents the session store.
 type SQLite3Store struct {
-	db          *sql.DB
-	stopCleanup chan bool
+	db             *sql.DB
+	logger         Logger
+	onCleanupError func(error)
+	stopCleanup    context.CancelFunc
+	cleanupDone    chan struct{}
+
+	stats cleanupStats
+
+	// aliased is set to 1 once Alias has been called, so that the cleanup
+	// goroutine only deletes expired aliases if there is a session_aliases
+	// table.
+	aliased int32
+}
+
+// Config contains the settings for a SQLite3Store instance created with
+// NewWithConfig.
+type Config struct {
+	// CleanupInterval controls how frequently expired session data is removed
+	// by the background cleanup goroutine. Setting it to 0 prevents the
+	// cleanup goroutine from running (i.e. expired sessions will not be
+	// removed).
+	CleanupInterval time.Duration
+
+	// Logger is used to log errors encountered by the background cleanup
+	// goroutine. If it is nil, errors are logged using Go's standard logger.
+	Logger Logger
+
+	// OnCleanupError, if set, is called with each error encountered by the
+	// background cleanup goroutine, after it has been logged.
+	OnCleanupError func(err error)
+}
+
+// Logger is the interface for the structured logger used by SQLite3Store. It is
+// satisfied by *slog.Logger.
+type Logger interface {
+	Error(msg string, args ...interface{})
 }
 
 // New returns a new SQLite3Store instance, with a background cleanup goroutine
@@ -23,10 +60,14 @@ func New(db *sql.DB) *SQLite3Store {
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
 func NewWithCleanupInterval(db *sql.DB, cleanupInterval time.Duration) *SQLite3Store {
-	p := &SQLite3Store{db: db}
-	if cleanupInterval > 0 {
-		p.stopCleanup = make(chan bool)
-		go p.startCleanup(cleanupInterval)
+	return NewWithConfig(db, Config{CleanupInterval: cleanupInterval})
+}
+
+// NewWithConfig returns a new SQLite3Store instance with the settings in cfg.
+func NewWithConfig(db *sql.DB, cfg Config) *SQLite3Store {
+	p := &SQLite3Store{db: db, logger: cfg.Logger, onCleanupError: cfg.OnCleanupError}
+	if cfg.CleanupInterval > 0 {
+		p.startCleanup(cfg.CleanupInterval)
 	}
 	return p
 }
@@ -49,13 +90,80 @@ func (p *SQLite3Store) Find(token string) (b []byte, exists bool, err error) {
 // given expiry time. If the session token already exists, then the data and expiry
 // time are updated.
 func (p *SQLite3Store) Commit(token string, b []byte, expiry time.Time) error {
-	_, err := p.db.Exec("REPLACE INTO sessions (token, data, expiry) VALUES ($1, $2, julianday($3))", token, b, expiry.UTC().Format("2006-01-02T15:04:05.999"))
+	_, err := p.db.Exec("INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, julianday($3)) ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry", token, b, expiry.UTC().Format("2006-01-02T15:04:05.999"))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// BindUser associates a session token with a user ID, so that it is returned
+// by UserTokens. This requires a user_id column in the sessions table. If the
+// session token is not found or is expired, BindUser is a no-op.
+func (p *SQLite3Store) BindUser(token string, userID string, expiry time.Time) error {
+	_, err := p.db.Exec("UPDATE sessions SET user_id = $2 WHERE token = $1 AND julianday('now') < expiry", token, userID)
+	return err
+}
+
+// UnbindUser removes any association between a session token and a user ID,
+// so that it is no longer returned by UserTokens.
+func (p *SQLite3Store) UnbindUser(token string) error {
+	_, err := p.db.Exec("UPDATE sessions SET user_id = NULL WHERE token = $1", token)
+	return err
+}
+
+// UserTokens returns the tokens for all active (i.e. not expired) sessions
+// which are associated with the given user ID.
+func (p *SQLite3Store) UserTokens(userID string) ([]string, error) {
+	rows, err := p.db.Query("SELECT token FROM sessions WHERE user_id = $1 AND julianday('now') < expiry", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []string{}
+
+	for rows.Next() {
+		var token string
+		err = rows.Scan(&token)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Alias records the target for a session token, replacing any existing alias
+// for the token. This requires a session_aliases table. Expired aliases are
+// deleted by the background cleanup goroutine.
+func (p *SQLite3Store) Alias(token string, target string, expiry time.Time) error {
+	atomic.StoreInt32(&p.aliased, 1)
+
+	_, err := p.db.Exec("INSERT INTO session_aliases (token, target, expiry) VALUES ($1, $2, julianday($3)) ON CONFLICT (token) DO UPDATE SET target = excluded.target, expiry = excluded.expiry", token, target, expiry.UTC().Format("2006-01-02T15:04:05.999"))
+	return err
+}
+
+// FindAlias returns the target of the alias for a session token. If there is
+// no alias for the token or it has expired, the returned found flag will be
+// set to false.
+func (p *SQLite3Store) FindAlias(token string) (target string, found bool, err error) {
+	row := p.db.QueryRow("SELECT target FROM session_aliases WHERE token = $1 AND julianday('now') < expiry", token)
+	err = row.Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
 // Delete removes a session token and corresponding data from the SQLite3Store
 // instance.
 func (p *SQLite3Store) Delete(token string) error {
@@ -96,39 +204,141 @@ func (p *SQLite3Store) All() (map[string][]byte, error) {
 	return sessions, nil
 }
 
+// Count returns the number of active (i.e. not expired) sessions in the
+// SQLite3Store instance.
+func (p *SQLite3Store) Count() (int, error) {
+	var count int
+	err := p.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE julianday('now') < expiry").Scan(&count)
+	return count, err
+}
+
+// startCleanup starts the background cleanup goroutine, which runs until Close
+// is called.
 func (p *SQLite3Store) startCleanup(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	for {
-		select {
-		case <-ticker.C:
-			err := p.deleteExpired()
-			if err != nil {
-				log.Println(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopCleanup = cancel
+	p.cleanupDone = make(chan struct{})
+
+	go func() {
+		defer close(p.cleanupDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := p.RunCleanup(ctx)
+				if err != nil && ctx.Err() == nil {
+					p.reportCleanupError(err)
+				}
+			case <-ctx.Done():
+				return
 			}
-		case <-p.stopCleanup:
-			ticker.Stop()
-			return
 		}
+	}()
+}
+
+// RunCleanup removes expired session data from the SQLite3Store instance
+// immediately, rather than waiting for the background cleanup goroutine. It
+// can be used whether or not the cleanup goroutine is running.
+func (p *SQLite3Store) RunCleanup(ctx context.Context) error {
+	n, err := p.deleteExpired(ctx)
+	// A run which was interrupted because ctx was cancelled, for example by
+	// StopCleanup, isn't counted as a failure.
+	if ctx.Err() == nil {
+		p.stats.record(n, err)
 	}
+	return err
 }
 
-// StopCleanup terminates the background cleanup goroutine for the SQLite3Store
-// instance. It's rare to terminate this; generally SQLite3Store instances and
-// their cleanup goroutines are intended to be long-lived and run for the lifetime
-// of your application.
+// Close terminates the background cleanup goroutine for the SQLite3Store instance,
+// if it is running, and waits for it to finish or for ctx to be done. It does
+// not close the underlying database connection. It is safe to call Close more
+// than once.
 //
-// There may be occasions though when your use of the SQLite3Store is transient.
-// An example is creating a new SQLite3Store instance in a test function. In this
-// scenario, the cleanup goroutine (which will run forever) will prevent the
-// SQLite3Store object from being garbage collected even after the test function
-// has finished. You can prevent this by manually calling StopCleanup.
+// It's rare to need this; generally SQLite3Store instances and their cleanup
+// goroutines are intended to be long-lived and run for the lifetime of your
+// application. But if your use of the SQLite3Store is transient (for example, in a
+// test function), the cleanup goroutine will prevent the SQLite3Store object from
+// being garbage collected unless you call Close.
+func (p *SQLite3Store) Close(ctx context.Context) error {
+	if p.stopCleanup == nil {
+		return nil
+	}
+	p.stopCleanup()
+
+	select {
+	case <-p.cleanupDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the background cleanup goroutine for the SQLite3Store
+// instance. It is equivalent to calling Close with context.Background().
 func (p *SQLite3Store) StopCleanup() {
-	if p.stopCleanup != nil {
-		p.stopCleanup <- true
+	p.Close(context.Background())
+}
+
+// CleanupStats returns the time that the background cleanup goroutine last
+// ran, and the total number of expired sessions it has deleted and errors it
+// has encountered.
+func (p *SQLite3Store) CleanupStats() (lastRun time.Time, deleted int64, failed int64) {
+	return p.stats.get()
+}
+
+func (p *SQLite3Store) reportCleanupError(err error) {
+	if p.logger == nil {
+		log.Println(err)
+	} else {
+		p.logger.Error("sqlite3store: cleanup failed", "store", "sqlite3store", "operation", "cleanup", "error", err)
+	}
+
+	if p.onCleanupError != nil {
+		p.onCleanupError(err)
 	}
 }
 
-func (p *SQLite3Store) deleteExpired() error {
-	_, err := p.db.Exec("DELETE FROM sessions WHERE expiry < julianday('now')")
-	return err
+func (p *SQLite3Store) deleteExpired(ctx context.Context) (int64, error) {
+	res, err := p.db.ExecContext(ctx, "DELETE FROM sessions WHERE expiry < julianday('now')")
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if atomic.LoadInt32(&p.aliased) == 1 {
+		_, err = p.db.ExecContext(ctx, "DELETE FROM session_aliases WHERE expiry < julianday('now')")
+	}
+	return n, err
+}
+
+// cleanupStats records statistics about the background cleanup goroutine.
+type cleanupStats struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	deleted int64
+	failed  int64
+}
+
+func (c *cleanupStats) record(deleted int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = time.Now()
+	c.deleted += deleted
+	if err != nil {
+		c.failed++
+	}
+}
+
+func (c *cleanupStats) get() (lastRun time.Time, deleted int64, failed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastRun, c.deleted, c.failed
 }
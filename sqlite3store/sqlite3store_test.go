@@ -2,10 +2,13 @@ package sqlite3store
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -296,6 +299,205 @@ func TestCleanup(t *testing.T) {
 	if count != 0 {
 		t.Fatalf("got %d: expected %d", count, 0)
 	}
+
+	lastRun, deleted, failed := p.CleanupStats()
+	if lastRun.IsZero() {
+		t.Fatalf("got %v: expected non-zero time", lastRun)
+	}
+	if deleted != 1 {
+		t.Fatalf("got %d: expected %d", deleted, 1)
+	}
+	if failed != 0 {
+		t.Fatalf("got %d: expected %d", failed, 0)
+	}
+}
+
+func TestCount(t *testing.T) {
+	dsn := "./testSQL3lite.db"
+	if err := removeDBfile(dsn); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(dsn)
+
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	err = p.Commit("session_token_1", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit("session_token_2", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := p.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d: expected %d", count, 1)
+	}
+}
+
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Error(msg string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprint(append([]interface{}{msg}, args...)...))
+}
+
+func TestCleanupLogger(t *testing.T) {
+	dsn := "./testSQL3lite.db"
+	if err := removeDBfile(dsn); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(dsn)
+
+	// Without a sessions table, the cleanup goroutine will fail.
+	logger := &testLogger{}
+	p := NewWithConfig(db, Config{CleanupInterval: 50 * time.Millisecond, Logger: logger})
+	time.Sleep(200 * time.Millisecond)
+	p.StopCleanup()
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.msgs) == 0 {
+		t.Fatal("expected cleanup errors to be logged")
+	}
+	if !strings.Contains(logger.msgs[0], "cleanup failed") || !strings.Contains(logger.msgs[0], "no such table") {
+		t.Fatalf("unexpected log message %q", logger.msgs[0])
+	}
+
+	_, _, failed := p.CleanupStats()
+	if failed != int64(len(logger.msgs)) {
+		t.Fatalf("got %d: expected %d", failed, len(logger.msgs))
+	}
+}
+
+func TestOnCleanupError(t *testing.T) {
+	dsn := "./testSQL3lite.db"
+	if err := removeDBfile(dsn); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(dsn)
+
+	// Without a sessions table, the cleanup goroutine will fail.
+	errs := make(chan error, 100)
+	p := NewWithConfig(db, Config{
+		CleanupInterval: 50 * time.Millisecond,
+		Logger:          &testLogger{},
+		OnCleanupError:  func(err error) { errs <- err },
+	})
+	defer p.Close(context.Background())
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "no such table") {
+			t.Fatalf("unexpected error %q", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected OnCleanupError to be called")
+	}
+}
+
+func TestRunCleanup(t *testing.T) {
+	dsn := "./testSQL3lite.db"
+	if err := removeDBfile(dsn); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(dsn)
+
+	if err = createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	err = p.Commit("session_token", []byte("encoded_data"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.RunCleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token = 'session_token'")
+	var count int
+	err = row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d: expected %d", count, 0)
+	}
+
+	_, deleted, _ := p.CleanupStats()
+	if deleted != 1 {
+		t.Fatalf("got %d: expected %d", deleted, 1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = p.RunCleanup(ctx)
+	if err != context.Canceled {
+		t.Fatalf("got %v: expected %v", err, context.Canceled)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	dsn := "./testSQL3lite.db"
+	if err := removeDBfile(dsn); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(dsn)
+
+	p := NewWithCleanupInterval(db, time.Minute)
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.StopCleanup()
 }
 
 func TestStopNilCleanup(t *testing.T) {
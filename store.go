@@ -34,6 +34,14 @@ type IterableStore interface {
 	All() (map[string][]byte, error)
 }
 
+// CountStore is the interface for session stores which can count the active
+// sessions without retrieving them.
+type CountStore interface {
+	// Count should return the number of active sessions (i.e. sessions which
+	// have not expired).
+	Count() (int, error)
+}
+
 // CtxStore is an interface for session stores which take a context.Context
 // parameter.
 type CtxStore interface {
@@ -56,3 +64,180 @@ type IterableCtxStore interface {
 	// context.Context.
 	AllCtx(ctx context.Context) (map[string][]byte, error)
 }
+
+// CountCtxStore is the interface for session stores which can count the
+// active sessions without retrieving them, and which take a context.Context
+// parameter.
+type CountCtxStore interface {
+	// CountCtx is the same as CountStore.Count, except it takes a
+	// context.Context.
+	CountCtx(ctx context.Context) (int, error)
+}
+
+// CleanupStore is the interface for session stores which remove expired
+// sessions with a background cleanup goroutine.
+type CleanupStore interface {
+	// RunCleanup should remove expired session data immediately, whether or
+	// not the background cleanup goroutine is running.
+	RunCleanup(ctx context.Context) error
+
+	// Close should terminate the background cleanup goroutine, if it is
+	// running, and wait for it to finish or for ctx to be done. It should be
+	// safe to call Close more than once.
+	Close(ctx context.Context) error
+}
+
+// VersionedStore is the interface for session stores which support optimistic
+// concurrency control. It is only used if SessionManager.ConflictPolicy is set
+// to something other than LastWriteWins.
+type VersionedStore interface {
+	// FindVersion is the same as Store.Find, except it also returns the current
+	// version of the session data. If the session token is not found or is
+	// expired, the version return value should be 0.
+	FindVersion(token string) (b []byte, version int64, found bool, err error)
+
+	// CompareAndCommit should add the session token and data to the store with
+	// the given expiry time, but only if the version of the session data
+	// currently in the store is equal to the version parameter. A version of 0
+	// means that the session token should not exist (or be expired). If the
+	// commit succeeds, CompareAndCommit should return the new version (which
+	// must be greater than 0) and a committed value of true. If the versions
+	// don't match then the committed return value should be false (and the err
+	// return value should be nil).
+	CompareAndCommit(token string, b []byte, expiry time.Time, version int64) (newVersion int64, committed bool, err error)
+}
+
+// VersionedCtxStore is the interface for session stores which support
+// optimistic concurrency control and which take a context.Context parameter.
+type VersionedCtxStore interface {
+	// FindVersionCtx is the same as VersionedStore.FindVersion, except it takes
+	// a context.Context.
+	FindVersionCtx(ctx context.Context, token string) (b []byte, version int64, found bool, err error)
+
+	// CompareAndCommitCtx is the same as VersionedStore.CompareAndCommit,
+	// except it takes a context.Context.
+	CompareAndCommitCtx(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, committed bool, err error)
+}
+
+// MergeStore is the interface for session stores which can atomically update
+// the data for a session token. It is only used if SessionManager.MergeChanges
+// is set to true.
+type MergeStore interface {
+	// Merge should atomically read the current data for the session token, pass
+	// it to fn, and then commit the data returned by fn to the store with the
+	// given expiry time. If the session token is not found or is expired, fn
+	// should be called with a nil byte slice and a found value of false. If fn
+	// returns an error then nothing should be committed, and Merge should
+	// return the error.
+	Merge(token string, expiry time.Time, fn func(b []byte, found bool) ([]byte, error)) (err error)
+}
+
+// MergeCtxStore is the interface for session stores which can atomically
+// update the data for a session token and which take a context.Context
+// parameter.
+type MergeCtxStore interface {
+	// MergeCtx is the same as MergeStore.Merge, except it takes a
+	// context.Context.
+	MergeCtx(ctx context.Context, token string, expiry time.Time, fn func(b []byte, found bool) ([]byte, error)) (err error)
+}
+
+// TouchStore is the interface for session stores which can extend the expiry
+// time of a session without rewriting the session data. If the session store
+// implements it, TouchStore is used instead of Commit to extend the expiry
+// time of unmodified sessions when SessionManager.IdleTimeout is set.
+type TouchStore interface {
+	// Touch should update the expiry time for the session token, leaving the
+	// session data unchanged. If the session token does not exist or is
+	// expired then Touch should be a no-op and return nil (not an error).
+	Touch(token string, expiry time.Time) (err error)
+}
+
+// TouchCtxStore is the interface for session stores which can extend the
+// expiry time of a session without rewriting the session data and which take
+// a context.Context parameter.
+type TouchCtxStore interface {
+	// TouchCtx is the same as TouchStore.Touch, except it takes a
+	// context.Context.
+	TouchCtx(ctx context.Context, token string, expiry time.Time) (err error)
+}
+
+// ClientStore is the interface for session stores which keep the session data
+// on the client instead of on the server. Rather than committing the session
+// data against a random token, the session manager calls Seal and uses the
+// returned value as the session token. The Find method of the Store should
+// reverse this, returning the session data from a sealed token.
+type ClientStore interface {
+	Store
+
+	// Seal should encrypt and authenticate the session data along with the
+	// expiry time, and return the result as a session token. The Find method
+	// should treat the token as not found once the expiry time has passed.
+	Seal(b []byte, expiry time.Time) (token string, err error)
+}
+
+// UserIndexStore is the interface for session stores which can keep an index of
+// the sessions belonging to each user. It is used by the SetUserID,
+// UnbindUser, ListUserSessions and DestroyUserSessions methods of
+// SessionManager.
+type UserIndexStore interface {
+	// BindUser should associate the session token with the given user ID,
+	// replacing any existing association for the token. The association
+	// should be removed when the session token is deleted or expires.
+	BindUser(token string, userID string, expiry time.Time) (err error)
+
+	// UnbindUser should remove any association between the session token and
+	// a user ID. If there is no association, it should return a nil error.
+	UnbindUser(token string) (err error)
+
+	// UserTokens should return the session tokens of all active (i.e. not
+	// expired) sessions which are associated with the user ID. If there are
+	// no such sessions, it should return an empty slice and a nil error.
+	UserTokens(userID string) (tokens []string, err error)
+}
+
+// UserIndexCtxStore is the interface for session stores which can keep an
+// index of the sessions belonging to each user and which take a
+// context.Context parameter.
+type UserIndexCtxStore interface {
+	// BindUserCtx is the same as UserIndexStore.BindUser, except it takes a
+	// context.Context.
+	BindUserCtx(ctx context.Context, token string, userID string, expiry time.Time) (err error)
+
+	// UnbindUserCtx is the same as UserIndexStore.UnbindUser, except it takes
+	// a context.Context.
+	UnbindUserCtx(ctx context.Context, token string) (err error)
+
+	// UserTokensCtx is the same as UserIndexStore.UserTokens, except it takes
+	// a context.Context.
+	UserTokensCtx(ctx context.Context, userID string) (tokens []string, err error)
+}
+
+// AliasStore is the interface for session stores which can keep a short-lived
+// alias from a session token which has been replaced to its replacement. It is
+// used by RenewToken when RenewGracePeriod is set, and by the automatic token
+// rotation controlled by RotationInterval.
+type AliasStore interface {
+	// Alias should record the target for the given session token, replacing
+	// any existing alias for the token. The alias should be removed once the
+	// expiry time has passed. The target is an opaque string which should be
+	// returned unchanged by FindAlias.
+	Alias(token string, target string, expiry time.Time) (err error)
+
+	// FindAlias should return the target of the alias for a session token. If
+	// there is no alias for the token or it has expired, the found return value
+	// should be false (and the err return value should be nil).
+	FindAlias(token string) (target string, found bool, err error)
+}
+
+// AliasCtxStore is the interface for session stores which can keep a
+// short-lived alias from a session token to its replacement and which take a
+// context.Context parameter.
+type AliasCtxStore interface {
+	// AliasCtx is the same as AliasStore.Alias, except it takes a
+	// context.Context.
+	AliasCtx(ctx context.Context, token string, target string, expiry time.Time) (err error)
+
+	// FindAliasCtx is the same as AliasStore.FindAlias, except it takes a
+	// context.Context.
+	FindAliasCtx(ctx context.Context, token string) (target string, found bool, err error)
+}
@@ -0,0 +1,239 @@
+package scs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrTokenRequired is returned when session data which is encrypted with a key
+// derived from the session token is read without the token (for example by
+// Iterate), and there is no escrowed copy of the key which can be used
+// instead.
+var ErrTokenRequired = errors.New("scs: session data is encrypted with the session token")
+
+// TokenEncryption configures the encryption of session data with a key derived
+// from the session token. See SessionManager.TokenEncryption.
+//
+// Operations which read session data from the store without a session token
+// (Iterate, ListUserSessions and ReEncrypt) can't decrypt it unless an escrow
+// keyring is configured. Otherwise they return ErrTokenRequired, or skip the
+// session if SkipWithoutEscrow is set.
+type TokenEncryption struct {
+	// Escrow, if set, is used to encrypt a copy of each session's data key,
+	// which is stored alongside the session data. This means that the session
+	// data can be decrypted without the session token by anyone with the
+	// escrow keys, so they should be kept separate from the store.
+	Escrow *Keyring
+
+	// SkipWithoutEscrow controls whether Iterate, ListUserSessions and
+	// ReEncrypt skip sessions which can't be decrypted without the session
+	// token, rather than returning ErrTokenRequired.
+	SkipWithoutEscrow bool
+
+	// AllowPlaintext controls whether session data which isn't encrypted with
+	// the session token is decoded. It can be set temporarily when you enable
+	// TokenEncryption, so that existing sessions are still valid. They are
+	// encrypted the next time they are committed.
+	AllowPlaintext bool
+}
+
+// Session data encrypted with the session token starts with a header byte. If
+// the data key is escrowed, the header byte is followed by the ID of the
+// escrow key and the encrypted data key. Bytes in this range are never the
+// first byte of data encoded by GobCodec, CompressingCodec or EncryptingCodec.
+const (
+	tokenSealHeader       byte = 0xc0
+	tokenSealHeaderEscrow byte = 0xc1
+
+	// The escrowed data key is encrypted with AES-GCM, so it is made up of a
+	// 12 byte nonce, the 32 byte key and a 16 byte tag.
+	escrowHeaderLen = 5 + 12 + 32 + 16
+)
+
+// tokenDataKey derives the key used to encrypt session data from the session
+// token. It is domain separated from hashToken and aliasCipher, so that it
+// can't be derived from a hashed token in the store.
+func tokenDataKey(token string) []byte {
+	return hkdfSHA256([]byte(token), []byte("scs session data key"), 32)
+}
+
+// hkdfSHA256 implements HKDF (RFC 5869) with SHA-256 and no salt.
+func hkdfSHA256(secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(t)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		t = expand.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+func (s *SessionManager) tokenEncrypted() bool {
+	return s.TokenEncryption != nil && !s.clientStore()
+}
+
+// checkTokenEncryption panics if TokenEncryption is enabled without
+// HashTokenInStore, because the store would then see the token that the
+// session data is encrypted with.
+func (s *SessionManager) checkTokenEncryption() {
+	if s.tokenEncrypted() && !s.HashTokenInStore {
+		panic("scs: TokenEncryption requires HashTokenInStore to be set")
+	}
+}
+
+// encode encodes the session data for the given session token using the
+// Codec, and encrypts it with the token if TokenEncryption is set.
+func (s *SessionManager) encode(ctx context.Context, token string, deadline time.Time, values map[string]interface{}) ([]byte, error) {
+	b, err := s.codecEncode(ctx, s.codecKey(token), deadline, values)
+	if err != nil || !s.tokenEncrypted() {
+		return b, err
+	}
+	s.checkTokenEncryption()
+
+	return s.TokenEncryption.seal(tokenDataKey(token), b)
+}
+
+// decode decrypts the session data for the given session token, if
+// necessary, and decodes it using the Codec.
+func (s *SessionManager) decode(ctx context.Context, token string, b []byte) (time.Time, map[string]interface{}, error) {
+	if s.tokenEncrypted() {
+		s.checkTokenEncryption()
+
+		var err error
+		if b, err = s.TokenEncryption.open(tokenDataKey(token), b); err != nil {
+			return time.Time{}, nil, err
+		}
+	}
+
+	return s.codecDecode(ctx, s.codecKey(token), b)
+}
+
+// decodeStored is the same as decode, except that it takes the key that the
+// session data is stored under rather than the session token. If the session
+// data is encrypted with the token, the escrowed data key is used.
+func (s *SessionManager) decodeStored(ctx context.Context, key string, b []byte) (time.Time, map[string]interface{}, error) {
+	b, _, err := s.unsealStored(b)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	return s.codecDecode(ctx, key, b)
+}
+
+// unsealStored decrypts session data which is encrypted with the session token
+// using the escrowed data key, and returns the data key. If TokenEncryption
+// isn't set, b is returned unchanged.
+func (s *SessionManager) unsealStored(b []byte) ([]byte, []byte, error) {
+	if !s.tokenEncrypted() {
+		return b, nil, nil
+	}
+	return s.TokenEncryption.openEscrow(b)
+}
+
+// skipStored reports whether a session returned by the store should be
+// skipped by Iterate or ListUserSessions because of err.
+func (s *SessionManager) skipStored(err error) bool {
+	return err == ErrTokenRequired && s.TokenEncryption != nil && s.TokenEncryption.SkipWithoutEscrow
+}
+
+func (te *TokenEncryption) seal(dataKey []byte, b []byte) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte{tokenSealHeader}
+	if te.Escrow != nil {
+		id, escrow := te.Escrow.active()
+
+		header = make([]byte, 5+escrow.NonceSize(), escrowHeaderLen)
+		header[0] = tokenSealHeaderEscrow
+		binary.BigEndian.PutUint32(header[1:5], id)
+
+		nonce := header[5:]
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		header = escrow.Seal(header, nonce, dataKey, header[:5])
+	}
+
+	out := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(b)+aead.Overhead())
+	copy(out, header)
+
+	nonce := out[len(header):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, nonce, b, header), nil
+}
+
+func (te *TokenEncryption) open(dataKey []byte, b []byte) ([]byte, error) {
+	var headerLen int
+	switch {
+	case len(b) > 0 && b[0] == tokenSealHeader:
+		headerLen = 1
+	case len(b) > 0 && b[0] == tokenSealHeaderEscrow:
+		headerLen = escrowHeaderLen
+	case te.AllowPlaintext:
+		return b, nil
+	default:
+		return nil, ErrDecryptionFailed
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < headerLen+aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+
+	nonce := b[headerLen : headerLen+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, b[headerLen+aead.NonceSize():], b[:headerLen])
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+func (te *TokenEncryption) openEscrow(b []byte) ([]byte, []byte, error) {
+	if len(b) == 0 || b[0] != tokenSealHeaderEscrow {
+		if len(b) > 0 && b[0] == tokenSealHeader {
+			return nil, nil, ErrTokenRequired
+		}
+		plaintext, err := te.open(nil, b)
+		return plaintext, nil, err
+	}
+	if te.Escrow == nil || len(b) < escrowHeaderLen {
+		return nil, nil, ErrTokenRequired
+	}
+
+	escrow, ok := te.Escrow.key(binary.BigEndian.Uint32(b[1:5]))
+	if !ok {
+		return nil, nil, ErrTokenRequired
+	}
+	nonce := b[5 : 5+escrow.NonceSize()]
+	dataKey, err := escrow.Open(nil, nonce, b[5+escrow.NonceSize():escrowHeaderLen], b[:5])
+	if err != nil {
+		return nil, nil, ErrDecryptionFailed
+	}
+
+	plaintext, err := te.open(dataKey, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, dataKey, nil
+}
@@ -0,0 +1,209 @@
+package scs
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenTransport is the interface for communicating the session token to and
+// from the client. It is used by the LoadAndSave middleware.
+type TokenTransport interface {
+	// ReadToken should return the session token sent by the client in the
+	// request, or the empty string "" if no token was sent.
+	ReadToken(r *http.Request) string
+
+	// WriteToken should communicate the session token and its expiry time to
+	// the client in the response. If expiry is the zero time.Time (so that its
+	// IsZero() method returns true), then the session has been destroyed and
+	// the client should be told to discard the token.
+	WriteToken(ctx context.Context, w http.ResponseWriter, token string, expiry time.Time)
+}
+
+// Varier is an optional interface for token transports which read the session
+// token from request headers. If a TokenTransport implements it, the
+// LoadAndSave middleware adds the headers returned by Vary to the Vary response
+// header, so that caches don't serve a response for one session to another.
+type Varier interface {
+	Vary() []string
+}
+
+// cookieTransport communicates the session token in a cookie, using the
+// settings in SessionManager.Cookie.
+type cookieTransport struct {
+	s *SessionManager
+}
+
+func (c cookieTransport) ReadToken(r *http.Request) string {
+	cookie, err := r.Cookie(c.s.Cookie.Name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (c cookieTransport) WriteToken(ctx context.Context, w http.ResponseWriter, token string, expiry time.Time) {
+	c.s.WriteSessionCookie(ctx, w, token, expiry)
+}
+
+func (c cookieTransport) Vary() []string {
+	return []string{"Cookie"}
+}
+
+// CookieTransport returns a TokenTransport which communicates the session token
+// in a cookie, using the settings in the Cookie field. This is the default
+// behavior if the TokenTransport field is not set, and is mainly useful as part
+// of a CompositeTransport.
+func (s *SessionManager) CookieTransport() TokenTransport {
+	return cookieTransport{s: s}
+}
+
+// HeaderTransport is a TokenTransport which communicates the session token in
+// HTTP headers. This is useful for API clients and mobile apps which don't
+// support cookies.
+type HeaderTransport struct {
+	// RequestHeader sets the name of the request header that the session token
+	// is read from. The default is "X-Session-Token".
+	RequestHeader string
+
+	// Scheme sets an authentication scheme which must prefix the session token
+	// in the request header. For example, setting RequestHeader to
+	// "Authorization" and Scheme to "Bearer" will read the token from a
+	// request header like "Authorization: Bearer <token>". By default there is
+	// no scheme.
+	Scheme string
+
+	// ResponseHeader sets the name of the response header that the session
+	// token is written to. When the session is destroyed, the header is sent
+	// with an empty value. The default is "X-Session-Token".
+	ResponseHeader string
+
+	// ExpiryHeader sets the name of an optional response header that the
+	// session expiry time is written to, in http.TimeFormat. By default no
+	// expiry header is sent.
+	ExpiryHeader string
+}
+
+// ReadToken returns the session token from the request header.
+func (h HeaderTransport) ReadToken(r *http.Request) string {
+	val := strings.TrimSpace(r.Header.Get(h.requestHeader()))
+	if h.Scheme == "" {
+		return val
+	}
+
+	// Authentication schemes are case-insensitive.
+	if len(val) <= len(h.Scheme) || !strings.EqualFold(val[:len(h.Scheme)], h.Scheme) || val[len(h.Scheme)] != ' ' {
+		return ""
+	}
+	return strings.TrimSpace(val[len(h.Scheme)+1:])
+}
+
+// WriteToken writes the session token (and optionally the expiry time) to the
+// response headers.
+func (h HeaderTransport) WriteToken(ctx context.Context, w http.ResponseWriter, token string, expiry time.Time) {
+	name := h.ResponseHeader
+	if name == "" {
+		name = "X-Session-Token"
+	}
+
+	w.Header().Set(name, token)
+	if h.ExpiryHeader != "" {
+		if expiry.IsZero() {
+			w.Header().Set(h.ExpiryHeader, time.Unix(1, 0).UTC().Format(http.TimeFormat))
+		} else {
+			w.Header().Set(h.ExpiryHeader, expiry.UTC().Format(http.TimeFormat))
+		}
+	}
+	w.Header().Add("Cache-Control", `no-cache="`+name+`"`)
+}
+
+// Vary returns the name of the request header that the session token is read
+// from.
+func (h HeaderTransport) Vary() []string {
+	return []string{h.requestHeader()}
+}
+
+func (h HeaderTransport) requestHeader() string {
+	if h.RequestHeader == "" {
+		return "X-Session-Token"
+	}
+	return h.RequestHeader
+}
+
+// CompositeTransport is a TokenTransport which combines several other
+// transports. The session token is read using the first transport which finds
+// a token in the request. The LoadAndSave middleware writes the session token
+// back using the same transport, so that (for example) a token read from a
+// cookie isn't also exposed in a response header which can be read by
+// JavaScript. New sessions are written using the first transport, so it
+// should be the one used by clients which create sessions most often. For
+// example, to support both browsers and API clients:
+//
+//	sessionManager.TokenTransport = scs.CompositeTransport{
+//		sessionManager.CookieTransport(),
+//		scs.HeaderTransport{RequestHeader: "Authorization", Scheme: "Bearer"},
+//	}
+type CompositeTransport []TokenTransport
+
+// ReadToken returns the session token from the first transport which finds a
+// token in the request.
+func (c CompositeTransport) ReadToken(r *http.Request) string {
+	for _, t := range c {
+		if token := t.ReadToken(r); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// WriteToken writes the session token using the first transport.
+func (c CompositeTransport) WriteToken(ctx context.Context, w http.ResponseWriter, token string, expiry time.Time) {
+	if len(c) > 0 {
+		c[0].WriteToken(ctx, w, token, expiry)
+	}
+}
+
+// Vary returns the request headers which the session token is read from by
+// any of the transports.
+func (c CompositeTransport) Vary() []string {
+	var headers []string
+	for _, t := range c {
+		if v, ok := t.(Varier); ok {
+			headers = append(headers, v.Vary()...)
+		}
+	}
+	return headers
+}
+
+// source returns the transport which the session token in the request is read
+// from, or the first transport if there is no token in the request. c must not
+// be empty.
+func (c CompositeTransport) source(r *http.Request) TokenTransport {
+	for _, t := range c {
+		if t.ReadToken(r) != "" {
+			return t
+		}
+	}
+	return c[0]
+}
+
+func (s *SessionManager) tokenTransport() TokenTransport {
+	if s.TokenTransport == nil {
+		return s.CookieTransport()
+	}
+	return s.TokenTransport
+}
+
+// responseTransport returns the transport which the session token should be
+// written to the response with. For a CompositeTransport, this is the
+// transport which the token was read from.
+func responseTransport(transport TokenTransport, r *http.Request) TokenTransport {
+	for {
+		c, ok := transport.(CompositeTransport)
+		if !ok || len(c) == 0 {
+			return transport
+		}
+		transport = c.source(r)
+	}
+}
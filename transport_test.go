@@ -0,0 +1,141 @@
+package scs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderTransport(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.TokenTransport = HeaderTransport{
+		RequestHeader:  "Authorization",
+		Scheme:         "Bearer",
+		ResponseHeader: "X-Session-Token",
+		ExpiryHeader:   "X-Session-Expires",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", "bar")
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+	mux.HandleFunc("/destroy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := sessionManager.Destroy(r.Context()); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	h := sessionManager.LoadAndSave(mux)
+
+	execute := func(urlPath, authorization string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", urlPath, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		h.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := execute("/put", "")
+	token := rr.Header().Get("X-Session-Token")
+	if token == "" {
+		t.Fatal("want X-Session-Token header to be set")
+	}
+	if rr.Header().Get("X-Session-Expires") == "" {
+		t.Error("want X-Session-Expires header to be set")
+	}
+	if rr.Header().Get("Set-Cookie") != "" {
+		t.Errorf("want %q; got %q", "", rr.Header().Get("Set-Cookie"))
+	}
+	if rr.Header().Get("Vary") != "Authorization" {
+		t.Errorf("want %q; got %q", "Authorization", rr.Header().Get("Vary"))
+	}
+
+	rr = execute("/get", "bearer "+token)
+	if rr.Body.String() != "bar" {
+		t.Errorf("want %q; got %q", "bar", rr.Body.String())
+	}
+	if _, ok := rr.Header()["X-Session-Token"]; ok {
+		t.Error("want X-Session-Token header not to be set")
+	}
+
+	rr = execute("/get", "Basic "+token)
+	if rr.Body.String() != "" {
+		t.Errorf("want %q; got %q", "", rr.Body.String())
+	}
+
+	rr = execute("/destroy", "Bearer "+token)
+	if v, ok := rr.Header()["X-Session-Token"]; !ok || v[0] != "" {
+		t.Errorf("want empty X-Session-Token header; got %q", v)
+	}
+}
+
+func TestCompositeTransport(t *testing.T) {
+	t.Parallel()
+
+	sessionManager := New()
+	sessionManager.TokenTransport = CompositeTransport{
+		sessionManager.CookieTransport(),
+		HeaderTransport{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionManager.Put(r.Context(), "foo", r.URL.Query().Get("foo"))
+	}))
+	mux.HandleFunc("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sessionManager.GetString(r.Context(), "foo")))
+	}))
+	h := sessionManager.LoadAndSave(mux)
+
+	// New sessions are written using the first transport only.
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/put?foo=cookie", nil))
+	cookieToken := extractTokenFromCookie(rr.Header().Get("Set-Cookie"))
+	if _, ok := rr.Header()["X-Session-Token"]; ok {
+		t.Error("want X-Session-Token header not to be set")
+	}
+	if vary := rr.Header()["Vary"]; len(vary) != 2 || vary[0] != "Cookie" || vary[1] != "X-Session-Token" {
+		t.Errorf("want Vary headers %q; got %q", []string{"Cookie", "X-Session-Token"}, vary)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/put?foo=header", nil))
+	headerToken := extractTokenFromCookie(rr.Header().Get("Set-Cookie"))
+
+	// A token read from a header is written back using the header transport
+	// only.
+	r := httptest.NewRequest("GET", "/put?foo=header", nil)
+	r.Header.Set("X-Session-Token", headerToken)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Header().Get("X-Session-Token") != headerToken {
+		t.Errorf("want token %q in header; got %q", headerToken, rr.Header().Get("X-Session-Token"))
+	}
+	if rr.Header().Get("Set-Cookie") != "" {
+		t.Errorf("want no Set-Cookie header; got %q", rr.Header().Get("Set-Cookie"))
+	}
+
+	// The cookie transport comes first, so it takes precedence.
+	r = httptest.NewRequest("GET", "/get", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: cookieToken})
+	r.Header.Set("X-Session-Token", headerToken)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Body.String() != "cookie" {
+		t.Errorf("want %q; got %q", "cookie", rr.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/get", nil)
+	r.Header.Set("X-Session-Token", headerToken)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Body.String() != "header" {
+		t.Errorf("want %q; got %q", "header", rr.Body.String())
+	}
+}
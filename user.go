@@ -0,0 +1,204 @@
+package scs
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// userIDKey is the reserved session data key that the user ID is stored under.
+const userIDKey = "__userID"
+
+// SetUserID associates the session with the given user ID. The session data
+// status will be set to Modified. If the session store implements
+// UserIndexStore, the association is also recorded in the store when the
+// session is committed, so that the session can be found by ListUserSessions
+// and DestroyUserSessions. The association is carried over to the new session
+// token when RenewToken is called. Calling SetUserID with the empty string ""
+// is the same as calling UnbindUser.
+func (s *SessionManager) SetUserID(ctx context.Context, userID string) {
+	if userID == "" {
+		s.UnbindUser(ctx)
+		return
+	}
+
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.setReserved(userIDKey, userID)
+	sd.bindUser = true
+	sd.status = Modified
+}
+
+// UnbindUser removes the association between the session and a user ID made
+// by SetUserID, for example when the user logs out without the session being
+// destroyed. If the session store implements UserIndexStore, the association
+// is also removed from the store when the session is committed, so that the
+// session is no longer returned by ListUserSessions. If the session is not
+// associated with a user ID, UnbindUser is a no-op.
+func (s *SessionManager) UnbindUser(ctx context.Context) {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !sd.deleteReserved(userIDKey) {
+		return
+	}
+	sd.bindUser = true
+	sd.status = Modified
+}
+
+// UserID returns the user ID associated with the session by SetUserID, or the
+// empty string "" if there is none.
+func (s *SessionManager) UserID(ctx context.Context) string {
+	sd := s.getSessionDataFromContext(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	userID, _ := sd.reserved[userIDKey].(string)
+	return userID
+}
+
+// ListUserSessions returns the tokens of all active (i.e. not expired) sessions
+// which are associated with the given user ID. Please note that if
+// HashTokenInStore is set, the returned tokens will be hashed.
+//
+// If the session store implements UserIndexStore then the index in the store
+// is used. Otherwise, if the session store supports iteration, every session in
+// the store is checked. If the session store supports neither then an error is
+// returned.
+func (s *SessionManager) ListUserSessions(ctx context.Context, userID string) ([]string, error) {
+	switch s.Store.(type) {
+	case UserIndexCtxStore, UserIndexStore:
+		return s.doStoreUserTokens(ctx, userID)
+	case IterableCtxStore, IterableStore:
+	default:
+		return nil, fmt.Errorf("scs: type %T does not support listing user sessions", s.Store)
+	}
+
+	allSessions, err := s.doStoreAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []string{}
+	for token, b := range allSessions {
+		_, values, err := s.decodeStored(ctx, token, b)
+		if s.skipStored(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if id, ok := values[userIDKey].(string); ok && id == userID {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens, nil
+}
+
+// DestroyUserSessions deletes all sessions which are associated with the given
+// user ID from the session store. This is useful for logging a user out
+// everywhere, for example after they change their password.
+//
+// If ctx contains the session data for one of the user's sessions, then that
+// session is destroyed using Destroy, so that the LoadAndSave middleware will
+// also remove the session cookie. If exceptCurrent is true, that session is
+// left alone instead.
+func (s *SessionManager) DestroyUserSessions(ctx context.Context, userID string, exceptCurrent bool) error {
+	tokens, err := s.ListUserSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	var current string
+	if _, ok := ctx.Value(s.contextKey).(*sessionData); ok {
+		current = s.Token(ctx)
+		if current != "" && s.HashTokenInStore {
+			current = hashToken(current)
+		}
+	}
+
+	for _, token := range tokens {
+		if current != "" && token == current {
+			if exceptCurrent {
+				continue
+			}
+			err = s.Destroy(ctx)
+		} else {
+			err = s.doStoreDeleteStoredToken(ctx, token)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SessionManager) userIndexed() bool {
+	switch s.Store.(type) {
+	case UserIndexCtxStore, UserIndexStore:
+		return true
+	}
+	return false
+}
+
+func (s *SessionManager) doStoreBindUser(ctx context.Context, token string, userID string, expiry time.Time) (err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "BindUser", Store: true})
+	defer func() { finish(OperationResult{Err: err}) }()
+
+	if s.HashTokenInStore {
+		token = hashToken(token)
+	}
+	cs, ok := s.Store.(UserIndexCtxStore)
+	if ok {
+		return cs.BindUserCtx(ctx, token, userID, expiry)
+	}
+	return s.Store.(UserIndexStore).BindUser(token, userID, expiry)
+}
+
+func (s *SessionManager) doStoreUnbindUser(ctx context.Context, token string) (err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "UnbindUser", Store: true})
+	defer func() { finish(OperationResult{Err: err}) }()
+
+	if s.HashTokenInStore {
+		token = hashToken(token)
+	}
+	cs, ok := s.Store.(UserIndexCtxStore)
+	if ok {
+		return cs.UnbindUserCtx(ctx, token)
+	}
+	return s.Store.(UserIndexStore).UnbindUser(token)
+}
+
+func (s *SessionManager) doStoreUserTokens(ctx context.Context, userID string) (tokens []string, err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "UserTokens", Store: true})
+	defer func() { finish(OperationResult{Err: err}) }()
+
+	cs, ok := s.Store.(UserIndexCtxStore)
+	if ok {
+		return cs.UserTokensCtx(ctx, userID)
+	}
+	return s.Store.(UserIndexStore).UserTokens(userID)
+}
+
+// doStoreDeleteStoredToken is the same as doStoreDelete, except that token is
+// the token as it is held in the session store, so it is never hashed.
+func (s *SessionManager) doStoreDeleteStoredToken(ctx context.Context, token string) (err error) {
+	ctx, finish := s.instrument(ctx, Operation{Name: "Delete", Store: true})
+	defer func() { finish(OperationResult{Err: err}) }()
+
+	c, ok := s.Store.(interface {
+		DeleteCtx(context.Context, string) error
+	})
+	if ok {
+		return c.DeleteCtx(ctx, token)
+	}
+	return s.Store.Delete(token)
+}